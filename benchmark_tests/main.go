@@ -361,6 +361,124 @@ func insertLargeKeyValue() {
 	conn.Close()
 }
 
+// Reads 5000 keys using a single connection, one GET at a time
+func getSingleConnection() time.Duration {
+	start := time.Now()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:7676")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Connect to the address with tcp
+	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	// Send a message to the ChromoDB running instance
+	_, err = conn.Write([]byte("YWxleFwwc29tZXBhc3N3b3Jk\n")) // we are using a user of alex and password of somepassword
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	_, err = reader.ReadString('\n')
+	if err != nil {
+		fmt.Println(err)
+		return 0
+	}
+
+	for i := 0; i < 5000; i++ {
+		_, err = conn.Write([]byte(fmt.Sprintf("GET->key%d\r\n", i)))
+		if err != nil {
+			fmt.Println(err)
+			return 0
+		}
+
+		// Read from the connection untill a new line is send
+		_, err = reader.ReadString('\n')
+		if err != nil {
+			fmt.Println(err)
+			return 0
+		}
+	}
+
+	conn.Close()
+	elapsed := time.Since(start)
+	log.Printf("ChromoDB took to read 5000 keys with a single connection: %s", elapsed)
+
+	return elapsed
+}
+
+// Reads 5000 keys using 100 connections, 50 GETs each.  GETs only share a read lock so they run in parallel
+func getParallel() time.Duration {
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(j int) {
+			defer wg.Done()
+			// Resolve the string address to a TCP address
+			tcpAddr, err := net.ResolveTCPAddr("tcp", "localhost:7676")
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			// Connect to the address with tcp
+			conn, err := net.DialTCP("tcp", nil, tcpAddr)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			defer conn.Close()
+
+			reader := bufio.NewReader(conn)
+
+			// Send a message to the ChromoDB running instance
+			_, err = conn.Write([]byte("YWxleFwwc29tZXBhc3N3b3Jk\n")) // we are using a user of alex and password of somepassword
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			_, err = reader.ReadString('\n')
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			for z := 0; z < 50; z++ {
+				_, err = conn.Write([]byte(fmt.Sprintf("GET->key%d\r\n", j*50+z)))
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+
+				// Read from the connection untill a new line is send
+				_, err = reader.ReadString('\n')
+				if err != nil {
+					fmt.Println(err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	log.Printf("ChromoDB took to read 5000 keys with 100 connections: %s", elapsed)
+
+	return elapsed
+}
+
 // Make sure you have a local database running
 func main() {
 
@@ -371,4 +489,9 @@ func main() {
 	testConsistencyAfter() // should be 499
 	insertLargeKeyValue()
 
+	// Keys 0 to 4999 were inserted by insertSingleConnection
+	single := getSingleConnection()
+	parallel := getParallel()
+	log.Printf("Parallel GETs were %.1fx faster than a single connection", float64(single)/float64(parallel))
+
 }
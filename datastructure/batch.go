@@ -0,0 +1,207 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"time"
+)
+
+// Batch is a group of mutations applied atomically by WriteBatch
+type Batch struct {
+	ops     []batchOp
+	expects []batchExpect // Versions keys must be at for the batch to be applied
+}
+
+// batchOp is a single mutation in a batch
+type batchOp struct {
+	key       []byte
+	value     []byte
+	delete    bool
+	expiresAt int64     // Unix time in milliseconds the key expires at, 0 if it never does
+	valueType ValueType // Type of the value put
+	internal  bool      // Whether the key is an element of a collection, only these may use reserved keys
+}
+
+// batchExpect is a version a key must be at for the batch to be applied
+type batchExpect struct {
+	key     []byte
+	version uint64
+}
+
+// NewBatch creates an empty batch
+func NewBatch() *Batch {
+	return &Batch{}
+}
+
+// Put adds a put of key to the batch
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// PutWithExpiry adds a put of key to the batch that expires at expiresAt
+func (b *Batch) PutWithExpiry(key, value []byte, expiresAt time.Time) {
+	b.ops = append(b.ops, batchOp{key: key, value: value, expiresAt: expiresAt.UnixMilli()})
+}
+
+// Delete adds a delete of key to the batch
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Expect makes the batch conditional on key being at version when it is written, WriteBatch returns
+// ErrConflict otherwise.  Version 0 expects the key not to exist
+func (b *Batch) Expect(key []byte, version uint64) {
+	b.expects = append(b.expects, batchExpect{key: key, version: version})
+}
+
+// Len returns the number of mutations in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+	b.expects = b.expects[:0]
+}
+
+// WriteBatch applies every mutation in the batch atomically.  All records are logged in a single
+// write-ahead log frame so after a crash either the whole batch is replayed or none of it,
+// and with SyncAlways the whole batch costs a single fsync.
+// Nothing is written and ErrConflict is returned if a key expected by the batch is at another version, or
+// ErrReservedKey if the batch writes a key with the prefix kept for the elements of collections
+func (db *DataStructure) WriteBatch(b *Batch) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.writeBatch(b)
+}
+
+// MultiGet retrieves the values of many keys at once, all as of the same moment.
+// Values of missing keys and keys holding a list, set or hash are nil
+func (db *DataStructure) MultiGet(keys [][]byte) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		entry, ok := db.liveEntry(string(key), now)
+		if !ok || entry.valueType != TypeString {
+			continue
+		}
+
+		_, value, err := db.readDataRecord(entry.offset)
+		if err != nil {
+			return nil, err
+		}
+
+		// Empty values are told apart from missing keys
+		if value == nil {
+			value = []byte{}
+		}
+
+		values[i] = value
+	}
+
+	return values, nil
+}
+
+// writeBatch does the work of WriteBatch, the caller must hold the lock
+func (db *DataStructure) writeBatch(b *Batch) error {
+	// Every expected version must still be current, expired keys are at version 0
+	now := time.Now().UnixMilli()
+	for _, expect := range b.expects {
+		if entry, _ := db.liveEntry(string(expect.key), now); entry.version != expect.version {
+			return ErrConflict
+		}
+	}
+
+	if b.Len() == 0 {
+		return nil
+	}
+
+	// Keys with the reserved prefix only hold the elements of collections
+	for _, op := range b.ops {
+		if !op.internal && reservedKey(string(op.key)) {
+			return ErrReservedKey
+		}
+	}
+
+	// Keys put earlier in the batch exist by the time a later delete is applied
+	exists := make(map[string]bool)
+
+	var records []byte
+	var applied []dataRecord
+
+	// Each record takes the next version
+	version := db.sequence
+
+	for _, op := range db.withElementDeletes(b.ops) {
+		if op.delete {
+			_, indexed := db.index[string(op.key)]
+			if present, ok := exists[string(op.key)]; (ok && !present) || (!ok && !indexed) {
+				continue // nothing to delete
+			}
+		}
+
+		version++
+
+		record := dataRecord{
+			key:       op.key,
+			value:     op.value,
+			tombstone: op.delete,
+			version:   version,
+			expiresAt: op.expiresAt,
+			valueType: op.valueType,
+		}
+
+		start := len(records)
+		records = encodeDataRecord(records, db.nextOffset+int64(start), record)
+		record.size = int64(len(records) - start)
+
+		applied = append(applied, record)
+		exists[string(op.key)] = !op.delete
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	offset, err := db.writeRecords(records)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range applied {
+		if err := db.applyRecord(offset, record); err != nil {
+			return err
+		}
+		offset += record.size
+	}
+
+	// Keep the write-ahead log from growing forever
+	if db.wal.size >= walCheckpointSize {
+		return db.checkpoint()
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ValueType is the type of the value a key holds.  Each data record is tagged with it
+type ValueType uint8
+
+const (
+	TypeString     ValueType = iota // Opaque byte value, what Put writes
+	TypeList                        // Ordered list of elements
+	TypeSet                         // Set of unique members
+	TypeHash                        // Map of fields to values
+	TypeZSet                        // Set of unique members ordered by score
+	TypeTimeSeries                  // Samples of a value over time
+
+	maxValueType = TypeTimeSeries // Highest value type a data record may hold
+)
+
+// String returns the name of the value type
+func (t ValueType) String() string {
+	switch t {
+	case TypeString:
+		return "string"
+	case TypeList:
+		return "list"
+	case TypeSet:
+		return "set"
+	case TypeHash:
+		return "hash"
+	case TypeZSet:
+		return "zset"
+	case TypeTimeSeries:
+		return "timeseries"
+	}
+
+	return "unknown"
+}
+
+var (
+	// ErrWrongType is returned when a key is used as a type other than the one it holds
+	ErrWrongType = errors.New("key holds the wrong type of value")
+
+	// ErrReservedKey is returned when writing a key starting with the prefix the DB keeps for the elements of collections
+	ErrReservedKey = errors.New("key is reserved")
+)
+
+// errUnchanged is returned by an update function to leave the key as it is
+var errUnchanged = errors.New("unchanged")
+
+// Type returns the type of the value of key
+func (db *DataStructure) Type(key []byte) (ValueType, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entry, ok := db.liveEntry(string(key), time.Now().UnixMilli())
+	if !ok {
+		return TypeString, ErrKeyNotFound
+	}
+
+	return entry.valueType, nil
+}
+
+// Collections keep each of their elements in a record of its own, so a change only writes the elements it
+// changes.  The key of a collection holds a small metadata record tagged with its type: the number of members of
+// a set or fields of a hash, and the positions a list spans.  Elements are keyed under elementPrefix, out of
+// reach of the keys users write, and are part of the index, the log and snapshots like any other key.
+// Deleting a collection, writing another type over it or writing over it once expired deletes its elements
+// along with it
+
+const (
+	internalPrefix = "\xff\x00" // Prefix of the keys the DB keeps for itself
+	internalEnd    = "\xff\x01" // First key after every key with internalPrefix
+)
+
+// Families of elements, each collection type keys its elements under its own
+const (
+	familyListItem  byte = 'l' // List element by position
+	familySetMember byte = 'm' // Set member, the value is empty
+	familyHashField byte = 'f' // Hash field, the value is the value of the field
+)
+
+// reservedKey reports whether key is one the DB keeps for itself
+func reservedKey(key string) bool {
+	return strings.HasPrefix(key, internalPrefix)
+}
+
+// collectionPrefix returns the prefix of the keys of every element of the collection at key.  The length of key
+// is part of it so no collection's elements share a prefix with another's
+func collectionPrefix(key []byte) []byte {
+	prefix := make([]byte, 0, len(internalPrefix)+binary.MaxVarintLen64+len(key)+1)
+	prefix = append(prefix, internalPrefix...)
+	prefix = binary.AppendUvarint(prefix, uint64(len(key)))
+
+	return append(prefix, key...)
+}
+
+// elementPrefix returns the prefix of the keys of the elements of family of the collection at key
+func elementPrefix(key []byte, family byte) []byte {
+	return append(collectionPrefix(key), family)
+}
+
+// elementKey returns the key of element of family of the collection at key
+func elementKey(key []byte, family byte, element []byte) []byte {
+	return append(elementPrefix(key, family), element...)
+}
+
+// putElement returns the op putting element of family of the collection at key
+func putElement(key []byte, valueType ValueType, family byte, element, value []byte) batchOp {
+	return batchOp{key: elementKey(key, family, element), value: value, valueType: valueType, internal: true}
+}
+
+// deleteElement returns the op deleting element of family of the collection at key
+func deleteElement(key []byte, family byte, element []byte) batchOp {
+	return batchOp{key: elementKey(key, family, element), delete: true, internal: true}
+}
+
+// sortableInt encodes n so integers sort in order as keys, big-endian with the sign bit flipped
+func sortableInt(n int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(n)^(1<<63))
+}
+
+// decodeSortableInt decodes an integer encoded by sortableInt
+func decodeSortableInt(encoded []byte) int64 {
+	return int64(binary.BigEndian.Uint64(encoded) ^ (1 << 63))
+}
+
+// decodeCount decodes the metadata of a set or hash, the number of elements it holds
+func decodeCount(meta []byte) (int, error) {
+	count, n := binary.Uvarint(meta)
+	if n <= 0 {
+		return 0, errors.New("malformed collection metadata")
+	}
+
+	return int(count), nil
+}
+
+// encodeCount encodes the metadata of a set or hash
+func encodeCount(count int) []byte {
+	return binary.AppendUvarint(nil, uint64(count))
+}
+
+// openCollection returns the index entry and metadata of the collection of type valueType at key and whether it
+// exists, the caller must hold the lock.  Missing and expired keys do not exist, ErrWrongType is returned for keys
+// holding another type
+func (db *DataStructure) openCollection(key []byte, valueType ValueType) (indexEntry, []byte, bool, error) {
+	entry, ok := db.liveEntry(string(key), time.Now().UnixMilli())
+	if !ok {
+		return indexEntry{}, nil, false, nil
+	}
+
+	if entry.valueType != valueType {
+		return indexEntry{}, nil, false, ErrWrongType
+	}
+
+	_, meta, err := db.readDataRecord(entry.offset)
+	if err != nil {
+		return indexEntry{}, nil, false, err
+	}
+
+	return entry, meta, true, nil
+}
+
+// writeCollection writes the metadata of the collection of type valueType at key along with ops changing its
+// elements, all in one batch, the caller must hold the lock.  A nil meta deletes the collection and its elements.
+// The expiry of the collection is kept
+func (db *DataStructure) writeCollection(key []byte, valueType ValueType, entry indexEntry, meta []byte, ops []batchOp) error {
+	batch := &Batch{ops: make([]batchOp, 0, len(ops)+1)}
+
+	if meta == nil {
+		batch.ops = append(batch.ops, batchOp{key: key, delete: true})
+	} else {
+		batch.ops = append(batch.ops, batchOp{key: key, value: meta, expiresAt: entry.expiresAt, valueType: valueType})
+	}
+
+	batch.ops = append(batch.ops, ops...)
+
+	return db.writeBatch(batch)
+}
+
+// element reads the value of the element with key, the caller must hold the lock
+func (db *DataStructure) element(key []byte) ([]byte, bool, error) {
+	entry, ok := db.index[string(key)]
+	if !ok {
+		return nil, false, nil
+	}
+
+	_, value, err := db.readDataRecord(entry.offset)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value, true, nil
+}
+
+// walkElements calls fn with every element with prefix from start on in ascending order, without the prefix,
+// and its index entry until fn returns false, the caller must hold the lock
+func (db *DataStructure) walkElements(prefix, start []byte, fn func(element []byte, entry indexEntry) (bool, error)) error {
+	for node := db.keys.seek(string(start)); node != nil && strings.HasPrefix(node.key, string(prefix)); node = node.next() {
+		// Deleted elements stay in the ordered index while snapshots can see them
+		entry, ok := db.index[node.key]
+		if !ok {
+			continue
+		}
+
+		more, err := fn([]byte(node.key[len(prefix):]), entry)
+		if err != nil || !more {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withElementDeletes returns ops with a delete of every element of each collection they delete, replace with
+// another type or write over after it expired, right after the op doing so, the caller must hold the lock
+func (db *DataStructure) withElementDeletes(ops []batchOp) []batchOp {
+	var expanded []batchOp
+	seen := make(map[string]struct{})
+	now := time.Now().UnixMilli()
+
+	for i, op := range ops {
+		if expanded != nil {
+			expanded = append(expanded, op)
+		}
+
+		// Only the first op on a key can find the collection still there
+		if _, ok := seen[string(op.key)]; ok || op.internal {
+			continue
+		}
+		seen[string(op.key)] = struct{}{}
+
+		entry, ok := db.index[string(op.key)]
+		if !ok || entry.valueType == TypeString || (!op.delete && op.valueType == entry.valueType && !expired(entry.expiresAt, now)) {
+			continue
+		}
+
+		if expanded == nil {
+			expanded = append(expanded, ops[:i+1]...)
+		}
+
+		prefix := collectionPrefix(op.key)
+		db.walkElements(prefix, prefix, func(element []byte, _ indexEntry) (bool, error) {
+			key := append(append([]byte{}, prefix...), element...)
+			expanded = append(expanded, batchOp{key: key, delete: true, internal: true})
+			return true, nil
+		})
+	}
+
+	if expanded == nil {
+		return ops
+	}
+
+	return expanded
+}
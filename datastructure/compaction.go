@@ -0,0 +1,214 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bufio"
+	"os"
+	"sort"
+)
+
+// Compact rewrites every live record into a new data file, swaps it in place of the current
+// data file and rebuilds the index.  It returns the number of bytes reclaimed
+func (db *DataStructure) Compact() (int64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.compact()
+}
+
+// compact does the work of Compact, the caller must hold the lock
+func (db *DataStructure) compact() (int64, error) {
+	// The write-ahead log refers to offsets in the current data file so it must be empty before the swap
+	if err := db.checkpoint(); err != nil {
+		return 0, err
+	}
+
+	// Copy records in data file order so the new file is read sequentially
+	keys := make([]string, 0, len(db.index))
+	for key := range db.index {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return db.index[keys[i]].offset < db.index[keys[j]].offset
+	})
+
+	tmpFilename := db.dataFilename + ".compact"
+	compactFile, err := os.OpenFile(tmpFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFilename) // no-op once renamed
+
+	writer := bufio.NewWriter(compactFile)
+	compactIndex := make(map[string]indexEntry, len(db.index))
+
+	// Compaction always writes the current format, which is how older data files get upgraded
+	// Tombstones are dropped, the header keeps the sequence so their versions are never handed out again
+	sequence := db.sequence
+	if _, err := writer.Write(encodeDataHeader(sequence)); err != nil {
+		compactFile.Close()
+		return 0, err
+	}
+
+	offset := int64(dataHeaderSize)
+	var record []byte
+
+	// Versions open snapshots still see are copied ahead of the live records, followed by the tombstones of
+	// keys deleted since, so walking the new data file still ends on the latest state of every key
+	historyKeys := make([]string, 0, len(db.history))
+	for key := range db.history {
+		historyKeys = append(historyKeys, key)
+	}
+	sort.Strings(historyKeys)
+
+	compactHistory := make(map[string][]versionEntry, len(db.history))
+	var tombstones []string
+	for _, key := range historyKeys {
+		versions := append([]versionEntry(nil), db.history[key]...)
+
+		for i, version := range versions {
+			if version.tombstone {
+				continue
+			}
+
+			previous, err := db.readRecord(version.offset)
+			if err != nil {
+				compactFile.Close()
+				return 0, err
+			}
+
+			record = encodeDataRecord(record[:0], offset, previous)
+			if _, err := writer.Write(record); err != nil {
+				compactFile.Close()
+				return 0, err
+			}
+
+			versions[i].offset = offset
+			offset += int64(len(record))
+		}
+
+		compactHistory[key] = versions
+
+		if _, live := db.index[key]; !live {
+			tombstones = append(tombstones, key)
+		}
+	}
+
+	for _, key := range tombstones {
+		versions := compactHistory[key]
+
+		record = encodeDataRecord(record[:0], offset, dataRecord{key: []byte(key), tombstone: true, version: versions[len(versions)-1].version})
+		if _, err := writer.Write(record); err != nil {
+			compactFile.Close()
+			return 0, err
+		}
+
+		offset += int64(len(record))
+	}
+
+	var liveBytes int64
+	for _, key := range keys {
+		current, err := db.readRecord(db.index[key].offset)
+		if err != nil {
+			compactFile.Close()
+			return 0, err
+		}
+
+		// Records from before versions existed are given one, in data file order
+		if current.version == 0 {
+			sequence++
+			current.version = sequence
+		}
+
+		record = encodeDataRecord(record[:0], offset, current)
+		if _, err := writer.Write(record); err != nil {
+			compactFile.Close()
+			return 0, err
+		}
+
+		compactIndex[key] = indexEntry{offset: offset, size: int64(len(record)), version: current.version, expiresAt: current.expiresAt, valueType: current.valueType}
+		offset += int64(len(record))
+		liveBytes += int64(len(record))
+	}
+
+	// Make sure the new data file is on disk before it replaces the old one
+	if err := writer.Flush(); err != nil {
+		compactFile.Close()
+		return 0, err
+	}
+
+	// Versions handed out while upgrading raise the sequence in the header
+	if sequence != db.sequence {
+		if _, err := compactFile.WriteAt(encodeDataHeader(sequence), 0); err != nil {
+			compactFile.Close()
+			return 0, err
+		}
+	}
+
+	if err := compactFile.Sync(); err != nil {
+		compactFile.Close()
+		return 0, err
+	}
+
+	if err := compactFile.Close(); err != nil {
+		return 0, err
+	}
+
+	// Swap the compacted data file in
+	if err := db.dataFile.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmpFilename, db.dataFilename); err != nil {
+		return 0, err
+	}
+
+	dataFile, err := os.OpenFile(db.dataFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	reclaimed := db.nextOffset - offset
+
+	db.dataFile = dataFile
+	db.formatVersion = dataVersion
+	db.nextOffset = offset
+	db.sequence = sequence
+	db.index = compactIndex
+	db.history = compactHistory
+	db.liveBytes = liveBytes
+
+	// Rebuild the index file for the new offsets.  Should we crash before this completes
+	// the stale index no longer matches the data file and is rebuilt from it on open
+	if err := db.writeIndex(); err != nil {
+		return 0, err
+	}
+
+	// The vector log is opened after the data file is upgraded, so it is only compacted once open
+	if db.vectorFile != nil {
+		if err := db.compactVectorLog(); err != nil {
+			return 0, err
+		}
+	}
+
+	return reclaimed, nil
+}
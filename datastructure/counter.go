@@ -0,0 +1,149 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrNotInteger is returned when incrementing a key whose value is not an integer
+	ErrNotInteger = errors.New("value is not an integer")
+
+	// ErrNotFloat is returned when incrementing a key whose value is not a number
+	ErrNotFloat = errors.New("value is not a number")
+
+	// ErrOverflow is returned when an increment would overflow or produce NaN or infinity
+	ErrOverflow = errors.New("increment would overflow")
+)
+
+// NumberError describes a value that cannot be incremented.  It matches ErrNotInteger or ErrNotFloat with errors.Is
+type NumberError struct {
+	Key   []byte // Key holding the value
+	Value []byte // The value
+	Err   error  // ErrNotInteger or ErrNotFloat
+}
+
+// Error returns the error message
+func (e *NumberError) Error() string {
+	return fmt.Sprintf("value %q of key %s: %v", e.Value, e.Key, e.Err)
+}
+
+// Unwrap returns ErrNotInteger or ErrNotFloat
+func (e *NumberError) Unwrap() error {
+	return e.Err
+}
+
+// IncrBy atomically adds delta to the integer value of key and returns the result.  Missing keys count as 0.
+// The expiry of the key is kept
+func (db *DataStructure) IncrBy(key []byte, delta int64) (int64, error) {
+	var result int64
+
+	err := db.update(key, TypeString, func(value []byte, exists bool) ([]byte, error) {
+		var current int64
+		if exists {
+			var err error
+			current, err = strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return nil, &NumberError{Key: key, Value: value, Err: ErrNotInteger}
+			}
+		}
+
+		if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+			return nil, ErrOverflow
+		}
+
+		result = current + delta
+		return strconv.AppendInt(nil, result, 10), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// IncrByFloat atomically adds delta to the numeric value of key and returns the result.  Missing keys count as 0.
+// The expiry of the key is kept
+func (db *DataStructure) IncrByFloat(key []byte, delta float64) (float64, error) {
+	var result float64
+
+	err := db.update(key, TypeString, func(value []byte, exists bool) ([]byte, error) {
+		var current float64
+		if exists {
+			var err error
+			current, err = strconv.ParseFloat(string(value), 64)
+			if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+				return nil, &NumberError{Key: key, Value: value, Err: ErrNotFloat}
+			}
+		}
+
+		result = current + delta
+		if math.IsNaN(result) || math.IsInf(result, 0) {
+			return nil, ErrOverflow
+		}
+
+		return strconv.AppendFloat(nil, result, 'f', -1, 64), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return result, nil
+}
+
+// update replaces the value of key with what fn returns for the current value, all under the write lock.
+// fn is told whether the key exists.  ErrWrongType is returned if the key holds a value of another type.
+// A nil value from fn deletes the key and errUnchanged leaves it as it is.  The expiry of the key is kept
+func (db *DataStructure) update(key []byte, valueType ValueType, fn func(value []byte, exists bool) ([]byte, error)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var value []byte
+	entry, exists := db.liveEntry(string(key), time.Now().UnixMilli())
+	if exists && entry.valueType != valueType {
+		return ErrWrongType
+	}
+	if exists {
+		var err error
+		_, value, err = db.readDataRecord(entry.offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	updated, err := fn(value, exists)
+	if err == errUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if updated == nil {
+		return db.writeBatch(&Batch{ops: []batchOp{{key: key, delete: true}}})
+	}
+
+	return db.writeBatch(&Batch{ops: []batchOp{{key: key, value: updated, expiresAt: entry.expiresAt, valueType: valueType}}})
+}
@@ -22,308 +22,453 @@ package datastructure
 import (
 	"bytes"
 	"encoding/binary"
-	"fmt"
-	"io"
+	"errors"
 	"os"
+	"sync"
+	"time"
 )
 
+// ErrKeyNotFound is returned when a key does not exist
+var ErrKeyNotFound = errors.New("key not found")
+
 // DataStructure represents the ChromoDB database structure
 type DataStructure struct {
-	dataFile   *os.File
-	indexFile  *os.File
-	nextOffset int64
+	dataFile         *os.File
+	dataFilename     string
+	indexFile        *os.File
+	indexFilename    string
+	formatVersion    uint16 // Format version of the data file
+	nextOffset       int64
+	index            map[string]indexEntry      // In-memory hash index of key to data record
+	keys             *skiplist                  // Keys of the index in sorted order
+	liveBytes        int64                      // Bytes in the data file used by records the index points at
+	sequence         uint64                     // Highest key version handed out, every write takes the next one
+	history          map[string][]versionEntry  // Replaced versions of keys still visible to open snapshots
+	snapshots        map[*Snapshot]struct{}     // Open snapshots
+	expiring         *expiryQueue               // Keys with an expiry, soonest first, popped by DeleteExpired
+	secondaryIndexes map[string]*secondaryIndex // Secondary indexes on JSON fields by name
+	textIndexes      map[string]*textIndex      // Full-text indexes by name
+	vectorIndexes    map[string]*vectorIndex    // Vector indexes by name
+	vectorFile       *os.File                   // Log the vector indexes are rebuilt from
+	vectorSize       int64                      // Offset the next vector log entry is written at
+	wal              *writeAheadLog             // Every mutation is logged here before it is applied
+	options          Options
+	stopSync         chan struct{} // Stops the interval sync of the write-ahead log
+	indexSize        int64         // Offset the next index entry is written at
+	mu               sync.RWMutex  // Readers share the lock, every read goes through ReadAt so they never move a file position
+}
+
+// indexEntry is the in-memory index entry of a key
+type indexEntry struct {
+	offset    int64     // Offset of the data record
+	size      int64     // Size of the data record
+	version   uint64    // Version of the key
+	expiresAt int64     // Unix time in milliseconds the key expires at, 0 if it never does
+	valueType ValueType // Type of the value
 }
 
-// Delete takes a provided key and deletes the entry
+// Delete takes a provided key and deletes the entry.
+// A tombstone record is appended to the data file so the deletion is part of the log
 func (db *DataStructure) Delete(key []byte) error {
-	// Reset the offset of the index file to the beginning
-	_, err := db.indexFile.Seek(0, io.SeekStart)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Append the tombstone, nothing is written if the key is not indexed
+	return db.writeBatch(&Batch{ops: []batchOp{{key: key, delete: true}}})
+}
+
+// OpenDB opens or creates a DataStructure bassed DB with the default options
+func OpenDB(dataFilename, indexFilename string) (*DataStructure, error) {
+	return OpenDBWithOptions(dataFilename, indexFilename, DefaultOptions)
+}
+
+// OpenDBWithOptions opens or creates a DataStructure bassed DB.
+// Mutations left in the write-ahead log by a crash are replayed before the DB is returned
+func OpenDBWithOptions(dataFilename, indexFilename string, options Options) (*DataStructure, error) {
+	if options.WALFilename == "" {
+		options.WALFilename = walFilename(dataFilename)
+	}
+
+	dataFile, err := os.OpenFile(dataFilename, os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Initialize a buffer to store the updated index data
-	var updatedIndexBuffer bytes.Buffer
+	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		dataFile.Close()
+		return nil, err
+	}
 
-	for {
-		// Read key from the index file
-		indexKey := make([]byte, len(key))
-		_, err := db.indexFile.Read(indexKey)
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return err
+	wal, err := openWAL(options.WALFilename)
+	if err != nil {
+		dataFile.Close()
+		indexFile.Close()
+		return nil, err
+	}
+
+	// Calculate the next offset
+	dataFileInfo, err := dataFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	nextOffset := dataFileInfo.Size()
+
+	// A new data file starts with a header
+	if nextOffset == 0 {
+		header := encodeDataHeader(0)
+		if _, err := dataFile.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+		if err := dataFile.Sync(); err != nil {
+			return nil, err
 		}
+		nextOffset = int64(len(header))
+	}
 
-		// Compare keys
-		if bytes.Equal(indexKey, key) {
+	formatVersion, sequence, err := readDataHeader(dataFile, nextOffset)
+	if err != nil {
+		dataFile.Close()
+		indexFile.Close()
+		wal.close()
+		return nil, err
+	}
 
-			// Read and discard the offset
-			var offset int64
-			if err := binary.Read(db.indexFile, binary.LittleEndian, &offset); err != nil {
-				return err
-			}
+	db := &DataStructure{
+		dataFile:         dataFile,
+		dataFilename:     dataFilename,
+		indexFile:        indexFile,
+		indexFilename:    indexFilename,
+		formatVersion:    formatVersion,
+		nextOffset:       nextOffset,
+		sequence:         sequence,
+		index:            make(map[string]indexEntry),
+		keys:             newSkiplist(),
+		history:          make(map[string][]versionEntry),
+		snapshots:        make(map[*Snapshot]struct{}),
+		expiring:         newExpiryQueue(),
+		secondaryIndexes: make(map[string]*secondaryIndex),
+		textIndexes:      make(map[string]*textIndex),
+		vectorIndexes:    make(map[string]*vectorIndex),
+		wal:              wal,
+		options:          options,
+		stopSync:         make(chan struct{}),
+	}
 
-			// Seek to the corresponding offset in the data file
-			_, err := db.dataFile.Seek(offset, io.SeekStart)
-			if err != nil {
-				return err
-			}
+	// Load the index file into memory so lookups don't have to scan it
+	if err := db.loadIndex(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
 
-			// Read the key length
-			var keyLength uint32
-			if err := binary.Read(db.dataFile, binary.LittleEndian, &keyLength); err != nil {
-				return err
-			}
+	// Restore anything a crash left half applied
+	if err := db.replayWAL(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
 
-			// Read the value length
-			var valueLength uint32
-			if err := binary.Read(db.dataFile, binary.LittleEndian, &valueLength); err != nil {
-				return err
-			}
+	// Deleted keys are not in the index, the last record has the highest version written
+	db.readLastVersion()
 
-			// Calculate the size of the data record
-			dataRecordSize := int64(binary.Size(keyLength)) + int64(binary.Size(valueLength)) + int64(keyLength) + int64(valueLength) + int64(binary.Size(int64(0)))
+	// Data files from older versions are upgraded by rewriting them in the current format
+	if db.formatVersion < dataVersion {
+		if _, err := db.compact(); err != nil {
+			db.closeFiles()
+			return nil, err
+		}
+	}
 
-			// Skip the data record in the data file
-			if _, err := db.dataFile.Seek(dataRecordSize, io.SeekCurrent); err != nil {
-				return err
-			}
+	// Secondary and full-text indexes are only kept in memory, they are built from the data file
+	if err := db.loadSecondaryIndexes(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
+	if err := db.loadTextIndexes(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
 
-		} else {
-			// Write the key to the updated index buffer
-			if _, err := updatedIndexBuffer.Write(indexKey); err != nil {
-				return err
-			}
+	if err := db.openVectorLog(); err != nil {
+		db.closeFiles()
+		return nil, err
+	}
 
-			// Read and write the offset to the updated index buffer
-			var offset int64
-			if err := binary.Read(db.indexFile, binary.LittleEndian, &offset); err != nil {
-				return err
-			}
-			if err := binary.Write(&updatedIndexBuffer, binary.LittleEndian, offset); err != nil {
-				return err
-			}
-		}
+	if options.SyncPolicy == SyncInterval && options.SyncInterval > 0 {
+		go db.syncWAL()
 	}
 
-	// Truncate the index file to remove the deleted key
-	if err := db.indexFile.Truncate(0); err != nil {
+	return db, nil
+}
+
+// Close flushes and closes the DB
+func (db *DataStructure) Close() error {
+	close(db.stopSync)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.checkpoint(); err != nil {
+		db.closeFiles()
 		return err
 	}
 
-	// Write the updated index data to the index file
-	if _, err := db.indexFile.Write(updatedIndexBuffer.Bytes()); err != nil {
+	// The next open loads the secondary and full-text indexes instead of building them
+	if err := db.writeIndexesContents(); err != nil {
+		db.closeFiles()
 		return err
 	}
 
-	return nil
+	return db.closeFiles()
 }
 
-// OpenDB opens or creates a DataStructure bassed DB
-func OpenDB(dataFilename, indexFilename string) (*DataStructure, error) {
-	dataFile, err := os.OpenFile(dataFilename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, err
-	}
+// Filenames returns the names of the files the DB keeps on disk, the index definitions and contents files only
+// once they exist
+func (db *DataStructure) Filenames() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 
-	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, err
+	filenames := []string{db.dataFilename, db.indexFilename, db.options.WALFilename}
+	if db.vectorFile != nil {
+		filenames = append(filenames, db.vectorFile.Name())
 	}
 
-	// Calculate the next offset
-	dataFileInfo, err := dataFile.Stat()
-	if err != nil {
-		return nil, err
+	for _, ext := range []string{secondaryIndexExtension, secondaryContentsExtension, textIndexExtension, textContentsExtension} {
+		if _, err := os.Stat(siblingFilename(db.dataFilename, ext)); err == nil {
+			filenames = append(filenames, siblingFilename(db.dataFilename, ext))
+		}
 	}
-	nextOffset := dataFileInfo.Size()
 
-	return &DataStructure{
-		dataFile:   dataFile,
-		indexFile:  indexFile,
-		nextOffset: nextOffset,
-	}, nil
+	return filenames
 }
 
-// Close closes the DB
-func (db *DataStructure) Close() error {
+// closeFiles closes the data, index, write-ahead log and vector log files
+func (db *DataStructure) closeFiles() error {
 	if err := db.dataFile.Close(); err != nil {
 		return err
 	}
-	return db.indexFile.Close()
+	if err := db.wal.close(); err != nil {
+		return err
+	}
+	if err := db.indexFile.Close(); err != nil {
+		return err
+	}
+
+	// The vector log is opened last, it may not be open yet
+	if db.vectorFile == nil {
+		return nil
+	}
+	if err := db.vectorFile.Sync(); err != nil {
+		db.vectorFile.Close()
+		return err
+	}
+	return db.vectorFile.Close()
 }
 
 // Put is like insert & update.  Will create a key-value but will replace an existing
-// if key already exists
+// if key already exists.  Records are never overwritten, a new version is appended to the data file
+// and the index is pointed at it
 func (db *DataStructure) Put(key, value []byte) error {
-	// Reset the offset of the index file to the beginning
-	_, err := db.indexFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return err
-	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-	// Check if the key already exists
-	for {
-		// Read key from the index file
-		indexKey := make([]byte, len(key))
-		if _, err := db.indexFile.Read(indexKey); err == io.EOF {
-			break
-		} else if err != nil {
+	// Append the new version of the key-value pair
+	return db.writeBatch(&Batch{ops: []batchOp{{key: key, value: value}}})
+}
+
+// applyRecord points the index at a record written to the data file at offset.  Tombstones remove the key
+func (db *DataStructure) applyRecord(offset int64, record dataRecord) error {
+	// Write the entry to the index file
+	if record.tombstone {
+		if err := db.appendIndexEntry(record.key, 0, indexFlagDeleted); err != nil {
 			return err
 		}
+	} else {
+		if err := db.appendIndexEntry(record.key, offset, 0); err != nil {
+			return err
+		}
+	}
 
-		// Compare keys
-		if bytes.Equal(indexKey, key) {
-			// Key already exists, update the value
-
-			// Read offset from the index file
-			var offset int64
-			if err := binary.Read(db.indexFile, binary.LittleEndian, &offset); err != nil {
-				return err
-			}
+	db.setIndexEntry(offset, record)
+	db.indexRecord(record)
+	db.indexText(record)
 
-			// Seek to the corresponding offset in the data file
-			_, err := db.dataFile.Seek(offset, io.SeekStart)
-			if err != nil {
-				return err
-			}
+	// Vectors belong to their key and go with it
+	if record.tombstone {
+		return db.unindexVectors(string(record.key))
+	}
 
-			// Update the value in the data file
-			if err := db.writeDataRecord(db.dataFile, offset, key, value); err != nil {
-				return err
-			}
+	return nil
+}
 
-			return nil
-		}
+// Get retrieves the value associated with a key.  Expired keys are deleted when read.
+// ErrWrongType is returned for keys holding a list, set or hash
+func (db *DataStructure) Get(key []byte) ([]byte, error) {
+	db.mu.RLock()
+
+	// Look up the record offset in the in-memory index
+	entry, ok := db.index[string(key)]
+	if !ok || reservedKey(string(key)) {
+		// Key not found
+		db.mu.RUnlock()
+		return nil, ErrKeyNotFound
+	}
 
-		// Read and discard the offset (we don't need it for lookup)
-		if _, err := db.indexFile.Seek(int64(binary.Size(int64(0))), io.SeekCurrent); err != nil {
-			return err
-		}
+	if expired(entry.expiresAt, time.Now().UnixMilli()) {
+		db.mu.RUnlock()
+		return nil, db.expireKey(key)
 	}
 
-	// Key does not exist, proceed with adding the new key-value pair
+	defer db.mu.RUnlock()
 
-	// Write key to the index file
-	if _, err := db.indexFile.Write(key); err != nil {
-		return err
+	if entry.valueType != TypeString {
+		return nil, ErrWrongType
 	}
 
-	// Get the current offset in the data file
-	offset, err := db.dataFile.Seek(0, io.SeekEnd)
+	_, value, err := db.readDataRecord(entry.offset)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Write offset to the index file
-	if err := binary.Write(db.indexFile, binary.LittleEndian, offset); err != nil {
-		return err
-	}
+	return value, nil
+}
 
-	// Write key-value pair to the data file
-	// (using the offset obtained before writing to the index file)
-	if err := db.writeDataRecord(db.dataFile, offset, key, value); err != nil {
-		return err
+// DeadSpaceRatio returns the fraction of the data file taken up by overwritten records and tombstones
+func (db *DataStructure) DeadSpaceRatio() float64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	total := db.nextOffset - db.dataStart()
+	if total <= 0 {
+		return 0
 	}
 
-	return nil
+	return float64(total-db.liveBytes) / float64(total)
 }
 
-// writeDataRecord writes a key-value record to the specified data file at the specified offset
-func (db *DataStructure) writeDataRecord(dataFile io.Writer, offset int64, key, value []byte) error {
-	// Write key length
-	if err := binary.Write(dataFile, binary.LittleEndian, uint32(len(key))); err != nil {
-		return err
+// setIndexEntry points the in-memory index at the record at offset, keeping track of live bytes, expiring keys
+// and the highest version seen.  Tombstones remove the key
+func (db *DataStructure) setIndexEntry(offset int64, record dataRecord) {
+	key := record.key
+	previous, exists := db.index[string(key)]
+
+	if record.version > db.sequence {
+		db.sequence = record.version
 	}
 
-	// Write value length
-	if err := binary.Write(dataFile, binary.LittleEndian, uint32(len(value))); err != nil {
-		return err
+	db.expiring.remove(string(key))
+
+	// The previous version is now dead space
+	if exists {
+		db.liveBytes -= previous.size
 	}
 
-	// Write key
-	if _, err := dataFile.Write(key); err != nil {
-		return err
+	// Open snapshots may still need the version being replaced, unless they are too old to be kept
+	db.expireSnapshots(time.Now())
+	if len(db.snapshots) > 0 {
+		db.keepVersion(key, previous, exists, record.version, record.tombstone)
 	}
 
-	// Write value
-	if _, err := dataFile.Write(value); err != nil {
-		return err
+	if record.tombstone {
+		if exists {
+			delete(db.index, string(key))
+
+			// Snapshots can still iterate over a key deleted after they were opened
+			if _, kept := db.history[string(key)]; !kept {
+				db.keys.remove(string(key))
+			}
+		}
+		return
 	}
 
-	// Write offset of the next record in the data file
-	if err := binary.Write(dataFile, binary.LittleEndian, offset); err != nil {
-		return err
+	db.index[string(key)] = indexEntry{offset: offset, size: record.size, version: record.version, expiresAt: record.expiresAt, valueType: record.valueType}
+	db.liveBytes += record.size
+
+	if record.expiresAt != 0 {
+		db.expiring.set(string(key), record.expiresAt)
 	}
 
-	return nil
+	if !exists {
+		db.keys.insert(string(key))
+	}
 }
 
-// Get retrieves the value associated with a key
-func (db *DataStructure) Get(key []byte) ([]byte, error) {
-	// Reset the offset of the index file to the beginning
-	_, err := db.indexFile.Seek(0, io.SeekStart)
-	if err != nil {
-		return nil, err
-	}
+// resetIndex empties the in-memory index
+func (db *DataStructure) resetIndex() {
+	db.index = make(map[string]indexEntry)
+	db.keys = newSkiplist()
+	db.history = make(map[string][]versionEntry)
+	db.expiring = newExpiryQueue()
+	db.liveBytes = 0
+}
+
+// rebuildIndex rebuilds the in-memory index by walking every record of the data file.
+// Later records win over earlier ones and tombstones remove the key
+func (db *DataStructure) rebuildIndex() error {
+	db.resetIndex()
 
-	for {
-		// Read key from the index file
-		indexKey := make([]byte, len(key))
-		if _, err := db.indexFile.Read(indexKey); err == io.EOF {
+	offset := db.dataStart()
+	for offset < db.nextOffset {
+		record, err := db.readRecordHeader(offset)
+		if err != nil {
+			// Anything after the last complete record is a torn write
 			break
-		} else if err != nil {
-			return nil, err
 		}
 
-		// Compare keys
-		if bytes.Equal(indexKey, key) {
-			// Read offset from the index file
-			var offset int64
-			if err := binary.Read(db.indexFile, binary.LittleEndian, &offset); err != nil {
-				return nil, err
-			}
+		db.setIndexEntry(offset, record)
 
-			// Seek to the corresponding offset in the data file
-			_, err := db.dataFile.Seek(offset, io.SeekStart)
-			if err != nil {
-				return nil, err
-			}
+		offset += record.size
+	}
 
-			// Read the key length
-			var keyLength uint32
-			if err := binary.Read(db.dataFile, binary.LittleEndian, &keyLength); err != nil {
-				return nil, err
-			}
+	db.nextOffset = offset
 
-			// Read the value length
-			var valueLength uint32
-			if err := binary.Read(db.dataFile, binary.LittleEndian, &valueLength); err != nil {
-				return nil, err
-			}
+	return db.writeIndex()
+}
 
-			// Read the key
-			keyData := make([]byte, keyLength)
-			if _, err := db.dataFile.Read(keyData); err != nil {
-				return nil, err
-			}
+// checkIndex makes sure every index entry points at a data record of the same key and
+// records the size, version, expiry and value type of each live record.  An index that does not match the data file is rebuilt
+func (db *DataStructure) checkIndex() error {
+	db.liveBytes = 0
+	db.expiring = newExpiryQueue()
 
-			// Read the value
-			valueData := make([]byte, valueLength)
-			if _, err := db.dataFile.Read(valueData); err != nil {
-				return nil, err
-			}
+	for key, entry := range db.index {
+		record, err := db.readRecordHeader(entry.offset)
+		if err != nil || record.tombstone || !bytes.Equal(record.key, []byte(key)) {
+			return db.rebuildIndex()
+		}
+
+		db.index[key] = indexEntry{offset: entry.offset, size: record.size, version: record.version, expiresAt: record.expiresAt, valueType: record.valueType}
+		db.liveBytes += record.size
 
-			return valueData, nil
+		if record.expiresAt != 0 {
+			db.expiring.set(key, record.expiresAt)
 		}
 
-		// Read and discard the offset (we don't need it for lookup)
-		if _, err := db.indexFile.Seek(int64(binary.Size(int64(0))), io.SeekCurrent); err != nil {
-			return nil, err
+		if record.version > db.sequence {
+			db.sequence = record.version
 		}
 	}
 
-	// Key not found
-	return nil, fmt.Errorf("key not found")
+	return nil
+}
+
+// readLastVersion raises the sequence to the version of the last record in the data file.
+// The trailer of the last record holds its offset.  A torn last record is left to the next rebuild
+func (db *DataStructure) readLastVersion() {
+	if db.nextOffset-recordTrailerSize < db.dataStart() {
+		return
+	}
+
+	var trailer [recordTrailerSize]byte
+	if _, err := db.dataFile.ReadAt(trailer[:], db.nextOffset-recordTrailerSize); err != nil {
+		return
+	}
+
+	record, err := db.readRecordHeader(int64(binary.LittleEndian.Uint64(trailer[:])))
+	if err != nil {
+		return
+	}
+
+	if record.version > db.sequence {
+		db.sequence = record.version
+	}
 }
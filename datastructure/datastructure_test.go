@@ -20,8 +20,19 @@
 package datastructure
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDataStructure_PutAndGet(t *testing.T) {
@@ -95,3 +106,2414 @@ func TestDataStructure_PutAndDeleteAndGet(t *testing.T) {
 		t.Errorf("Expected result to be nil after deletion, got %s", string(result))
 	}
 }
+
+func TestDataStructure_ReopenLoadsIndex(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys of different lengths
+	pairs := map[string]string{
+		"a":          "1",
+		"longer_key": "2",
+		"mid_key":    "3",
+	}
+
+	for k, v := range pairs {
+		if err := db.Put([]byte(k), []byte(v)); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	if err := db.Delete([]byte("mid_key")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	db.Close()
+
+	// Reopen and verify the index was loaded from disk
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "longer_key"} {
+		result, err := db.Get([]byte(k))
+		if err != nil {
+			t.Fatalf("Error getting value for key %s: %v", k, err)
+		}
+
+		if string(result) != pairs[k] {
+			t.Errorf("Expected value %s, got %s", pairs[k], string(result))
+		}
+	}
+
+	if _, err := db.Get([]byte("mid_key")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for deleted key, got %v", err)
+	}
+}
+
+func TestDataStructure_MigrateLegacyIndex(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Build a data file and a legacy index file (raw key followed by offset)
+	var dataFile, indexFile bytes.Buffer
+	for _, pair := range [][2]string{{"k", "short"}, {"some_longer_key", "long"}} {
+		offset := int64(dataFile.Len())
+
+		binary.Write(&dataFile, binary.LittleEndian, uint32(len(pair[0])))
+		binary.Write(&dataFile, binary.LittleEndian, uint32(len(pair[1])))
+		dataFile.WriteString(pair[0])
+		dataFile.WriteString(pair[1])
+		binary.Write(&dataFile, binary.LittleEndian, offset)
+
+		indexFile.WriteString(pair[0])
+		binary.Write(&indexFile, binary.LittleEndian, offset)
+	}
+
+	if err := os.WriteFile(tempDir+"/chromo.db", dataFile.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tempDir+"/chromo.idx", indexFile.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for key, expected := range map[string]string{"k": "short", "some_longer_key": "long"} {
+		result, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Error getting value for key %s: %v", key, err)
+		}
+
+		if string(result) != expected {
+			t.Errorf("Expected value %s, got %s", expected, string(result))
+		}
+	}
+
+	// The index file should have been upgraded
+	upgraded, err := os.ReadFile(tempDir + "/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(upgraded, []byte(indexMagic)) {
+		t.Errorf("Expected index file to be upgraded to the versioned format")
+	}
+
+	// So should the data file
+	upgraded, err = os.ReadFile(tempDir + "/chromo.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(upgraded, []byte(dataMagic)) {
+		t.Errorf("Expected data file to be upgraded to the versioned format")
+	}
+
+	// Upgraded records are given versions
+	if db.Version([]byte("k")) == 0 || db.Version([]byte("k")) == db.Version([]byte("some_longer_key")) {
+		t.Errorf("Expected upgraded keys to have distinct versions, got %d and %d", db.Version([]byte("k")), db.Version([]byte("some_longer_key")))
+	}
+}
+
+func TestDataStructure_UpdateDoesNotClobberNeighbours(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put([]byte("first"), []byte("a")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Put([]byte("second"), []byte("b")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	// Update the first key with a much longer value
+	longValue := bytes.Repeat([]byte("x"), 1024)
+	if err := db.Put([]byte("first"), longValue); err != nil {
+		t.Fatalf("Error updating key-value pair: %v", err)
+	}
+
+	if err := db.Delete([]byte("second")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	if err := db.Put([]byte("second"), []byte("c")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	db.Close()
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	result, err := db.Get([]byte("first"))
+	if err != nil {
+		t.Fatalf("Error getting value for key: %v", err)
+	}
+
+	if !bytes.Equal(result, longValue) {
+		t.Errorf("Expected updated value of %d bytes, got %d bytes", len(longValue), len(result))
+	}
+
+	result, err = db.Get([]byte("second"))
+	if err != nil {
+		t.Fatalf("Error getting value for key: %v", err)
+	}
+
+	if string(result) != "c" {
+		t.Errorf("Expected value c, got %s", string(result))
+	}
+}
+
+func TestDataStructure_Compact(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Churn a few keys so the data file has dead space
+	for i := 0; i < 10; i++ {
+		if err := db.Put([]byte("churn"), bytes.Repeat([]byte{byte('a' + i)}, 64)); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	if err := db.Put([]byte("keep"), []byte("value")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Put([]byte("gone"), []byte("value")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Delete([]byte("gone")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	if db.DeadSpaceRatio() <= 0.5 {
+		t.Fatalf("Expected dead space ratio above 0.5, got %f", db.DeadSpaceRatio())
+	}
+
+	reclaimed, err := db.Compact()
+	if err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	if reclaimed <= 0 {
+		t.Errorf("Expected compaction to reclaim space, reclaimed %d bytes", reclaimed)
+	}
+
+	if db.DeadSpaceRatio() != 0 {
+		t.Errorf("Expected no dead space after compaction, got %f", db.DeadSpaceRatio())
+	}
+
+	db.Close()
+
+	// Reopen to make sure the swapped data file and rebuilt index agree
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := map[string][]byte{
+		"churn": bytes.Repeat([]byte{'j'}, 64),
+		"keep":  []byte("value"),
+	}
+
+	for key, value := range expected {
+		result, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Error getting value for key %s: %v", key, err)
+		}
+
+		if !bytes.Equal(result, value) {
+			t.Errorf("Expected value %s, got %s", string(value), string(result))
+		}
+	}
+
+	if _, err := db.Get([]byte("gone")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for deleted key, got %v", err)
+	}
+}
+
+func TestDataStructure_WALRecovery(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDBWithOptions(tempDir+"/chromo.db", tempDir+"/chromo.idx", Options{SyncPolicy: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put([]byte("survivor"), []byte("value")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Put([]byte("deleted"), []byte("value")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Delete([]byte("deleted")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	// Simulate a crash that lost the data and index writes but not the write-ahead log
+	close(db.stopSync)
+	db.closeFiles()
+
+	if err := os.Truncate(tempDir+"/chromo.db", dataHeaderSize+3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Truncate(tempDir+"/chromo.idx", indexHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	result, err := db.Get([]byte("survivor"))
+	if err != nil {
+		t.Fatalf("Error getting value for key: %v", err)
+	}
+
+	if string(result) != "value" {
+		t.Errorf("Expected value value, got %s", string(result))
+	}
+
+	if _, err := db.Get([]byte("deleted")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for deleted key, got %v", err)
+	}
+}
+
+func TestDataStructure_VerifyDetectsCorruption(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"first", "second", "third"} {
+		if err := db.Put([]byte(key), []byte(key+"_value")); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	damagedOffset := db.index["second"].offset
+	db.Close()
+
+	// Flip a bit in the value of the second record
+	data, err := os.ReadFile(tempDir + "/chromo.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[damagedOffset+recordHeaderSize(dataVersion)+int64(len("second"))] ^= 0x01
+
+	if err := os.WriteFile(tempDir+"/chromo.db", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get([]byte("second")); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Expected ErrCorrupted, got %v", err)
+	}
+
+	if _, err := db.Get([]byte("third")); err != nil {
+		t.Errorf("Error getting value for intact key: %v", err)
+	}
+
+	damaged, err := db.Verify()
+	if err != nil {
+		t.Fatalf("Error verifying data file: %v", err)
+	}
+
+	if len(damaged) != 1 || damaged[0] != damagedOffset {
+		t.Errorf("Expected damaged offsets [%d], got %v", damagedOffset, damaged)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"first", "second", "third", "deleted"} {
+		if err := db.Put([]byte(key), []byte(key+"_value")); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	if err := db.Put([]byte("first"), []byte("first_updated")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Delete([]byte("deleted")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	damagedOffset := db.index["second"].offset
+	db.Close()
+
+	// Lose the index and damage the second record
+	if err := os.Remove(tempDir + "/chromo.idx"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(tempDir + "/chromo.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data[damagedOffset+2] ^= 0xFF
+
+	if err := os.WriteFile(tempDir+"/chromo.db", data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Repair(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatalf("Error repairing: %v", err)
+	}
+
+	if report.Damaged != 1 || report.Keys != 2 {
+		t.Errorf("Expected 1 damaged region and 2 keys, got %+v", report)
+	}
+
+	if _, err := os.Stat(tempDir + "/chromo.db.quarantine"); err != nil {
+		t.Errorf("Expected quarantine file: %v", err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := map[string]string{"first": "first_updated", "third": "third_value"}
+	for key, value := range expected {
+		result, err := db.Get([]byte(key))
+		if err != nil {
+			t.Fatalf("Error getting value for key %s: %v", key, err)
+		}
+
+		if string(result) != value {
+			t.Errorf("Expected value %s, got %s", value, string(result))
+		}
+	}
+
+	for _, key := range []string{"second", "deleted"} {
+		if _, err := db.Get([]byte(key)); err != ErrKeyNotFound {
+			t.Errorf("Expected ErrKeyNotFound for %s, got %v", key, err)
+		}
+	}
+
+	damaged, err := db.Verify()
+	if err != nil || len(damaged) != 0 {
+		t.Errorf("Expected no damaged records after repair, got %v %v", damaged, err)
+	}
+}
+
+func TestDataStructure_Iterator(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"delta", "alpha", "echo", "charlie", "bravo"} {
+		if err := db.Put([]byte(key), []byte(key+"_value")); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	if err := db.Delete([]byte("charlie")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	// Full iteration in key order
+	var keys []string
+	it := db.NewIterator()
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+
+		if string(it.Value()) != string(it.Key())+"_value" {
+			t.Errorf("Expected value %s_value, got %s", it.Key(), it.Value())
+		}
+	}
+	it.Close()
+
+	expected := []string{"alpha", "bravo", "delta", "echo"}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected keys %v, got %v", expected, keys)
+	}
+	for i := range expected {
+		if keys[i] != expected[i] {
+			t.Fatalf("Expected keys %v, got %v", expected, keys)
+		}
+	}
+
+	// Seek to a key that does not exist and delete ahead of the iterator
+	it = db.NewIterator()
+	defer it.Close()
+
+	if !it.Seek([]byte("c")) || string(it.Key()) != "delta" {
+		t.Fatalf("Expected Seek to land on delta, got %s", it.Key())
+	}
+
+	if err := db.Delete([]byte("echo")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	if it.Next() {
+		t.Errorf("Expected iterator to be exhausted, got %s", it.Key())
+	}
+}
+
+func TestDataStructure_Versions(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Put([]byte("a"), []byte("2")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	value, version, err := db.GetWithVersion([]byte("a"))
+	if err != nil || string(value) != "2" || version != 2 {
+		t.Fatalf("Expected value 2 at version 2, got %s at %d: %v", value, version, err)
+	}
+
+	// A stale version is rejected
+	if _, err := db.CompareAndSwap([]byte("a"), 1, []byte("3")); err != ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	version, err = db.CompareAndSwap([]byte("a"), 2, []byte("3"))
+	if err != nil || version != 3 {
+		t.Errorf("Expected version 3, got %d: %v", version, err)
+	}
+
+	// Version 0 only creates keys
+	if _, err := db.CompareAndSwap([]byte("b"), 0, []byte("1")); err != nil {
+		t.Errorf("Error creating key with CompareAndSwap: %v", err)
+	}
+
+	if _, err := db.CompareAndSwap([]byte("b"), 0, []byte("2")); err != ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	// The tombstone takes version 5, compaction drops it but its version must not be reused
+	if err := db.Delete([]byte("b")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	if _, err := db.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.Version([]byte("a")) != 3 {
+		t.Errorf("Expected version 3 after reopen, got %d", db.Version([]byte("a")))
+	}
+
+	if err := db.Put([]byte("b"), []byte("again")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if db.Version([]byte("b")) != 6 {
+		t.Errorf("Expected version 6 after reopen, got %d", db.Version([]byte("b")))
+	}
+}
+
+func TestDataStructure_Snapshot(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"a", "b"} {
+		if err := db.Put([]byte(key), []byte("old")); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	snapshot := db.Snapshot()
+
+	// Writes after the snapshot
+	if err := db.Put([]byte("a"), []byte("new")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Delete([]byte("b")); err != nil {
+		t.Fatalf("Error deleting key: %v", err)
+	}
+
+	if err := db.Put([]byte("c"), []byte("new")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	expectSnapshot := func() {
+		for key, expected := range map[string]string{"a": "old", "b": "old"} {
+			value, err := snapshot.Get([]byte(key))
+			if err != nil || string(value) != expected {
+				t.Errorf("Expected snapshot value %s for key %s, got %s: %v", expected, key, value, err)
+			}
+		}
+
+		if _, err := snapshot.Get([]byte("c")); err != ErrKeyNotFound {
+			t.Errorf("Expected key c to be missing from the snapshot, got %v", err)
+		}
+
+		var keys []string
+		it := snapshot.NewIterator()
+		for ok := it.Next(); ok; ok = it.Next() {
+			keys = append(keys, string(it.Key())+"="+string(it.Value()))
+		}
+		it.Close()
+
+		if strings.Join(keys, ",") != "a=old,b=old" {
+			t.Errorf("Expected snapshot iterator to return a=old,b=old, got %v", keys)
+		}
+	}
+
+	expectSnapshot()
+
+	// The latest state is unaffected by the snapshot
+	keys, _ := db.ScanKeys(nil, nil, nil, 10)
+	if len(keys) != 2 || string(keys[0]) != "a" || string(keys[1]) != "c" {
+		t.Errorf("Expected keys a and c, got %q", keys)
+	}
+
+	// Compaction keeps what the snapshot sees
+	if _, err := db.Compact(); err != nil {
+		t.Fatalf("Error compacting: %v", err)
+	}
+
+	expectSnapshot()
+
+	// Rebuilding from the compacted data file must not bring the deleted key back
+	if err := db.rebuildIndex(); err != nil {
+		t.Fatalf("Error rebuilding index: %v", err)
+	}
+
+	if _, err := db.Get([]byte("b")); err != ErrKeyNotFound {
+		t.Errorf("Expected key b to stay deleted, got %v", err)
+	}
+
+	snapshot.Release()
+
+	if len(db.history) != 0 {
+		t.Errorf("Expected no history once the snapshot is released, got %d keys", len(db.history))
+	}
+
+	value, err := db.Get([]byte("a"))
+	if err != nil || string(value) != "new" {
+		t.Errorf("Expected value new, got %s: %v", value, err)
+	}
+}
+
+func TestDataStructure_SnapshotMaxAge(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDBWithOptions(tempDir+"/chromo.db", tempDir+"/chromo.idx", Options{SnapshotMaxAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("a"), []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := db.Snapshot()
+	defer snapshot.Release()
+
+	// The snapshot pins the version it sees while it is young
+	if err := db.Put([]byte("a"), []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := snapshot.Get([]byte("a")); err != nil || string(value) != "old" {
+		t.Errorf("Expected old, got %s: %v", value, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The next write forgets the snapshot and the versions it pinned
+	if err := db.Put([]byte("a"), []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+
+	db.mu.RLock()
+	history, snapshots := len(db.history), len(db.snapshots)
+	db.mu.RUnlock()
+	if history != 0 || snapshots != 0 {
+		t.Errorf("Expected no history and no snapshots, got %d and %d", history, snapshots)
+	}
+
+	if _, err := snapshot.Get([]byte("a")); err != ErrSnapshotExpired {
+		t.Errorf("Expected ErrSnapshotExpired, got %v", err)
+	}
+
+	it := snapshot.NewIterator()
+	if it.Next() || it.Err() != ErrSnapshotExpired {
+		t.Errorf("Expected ErrSnapshotExpired from the iterator, got %v", it.Err())
+	}
+}
+
+func TestDataStructure_ConcurrentReadsAndWrites(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put([]byte("key"), []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers never see a torn value while a writer keeps updating the key
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(reader bool) {
+			defer wg.Done()
+
+			for j := 0; j < 200; j++ {
+				if reader {
+					value, err := db.Get([]byte("key"))
+					if err != nil {
+						t.Errorf("Error getting value: %v", err)
+						return
+					}
+
+					if _, err := strconv.Atoi(string(value)); err != nil {
+						t.Errorf("Unexpected value %q", value)
+						return
+					}
+				} else if err := db.Put([]byte("key"), []byte(strconv.Itoa(j))); err != nil {
+					t.Errorf("Error putting value: %v", err)
+					return
+				}
+			}
+		}(i > 0)
+	}
+
+	wg.Wait()
+}
+
+func TestDataStructure_Expiry(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.PutWithExpiry([]byte("session"), []byte("data"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	if err := db.Put([]byte("forever"), []byte("data")); err != nil {
+		t.Fatalf("Error putting key-value pair: %v", err)
+	}
+
+	// Already expired keys read as missing
+	for _, key := range []string{"gone1", "gone2", "gone3"} {
+		if err := db.PutWithExpiry([]byte(key), []byte("data"), time.Now().Add(-time.Second)); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	if _, err := db.Get([]byte("gone1")); err != ErrKeyNotFound {
+		t.Errorf("Expected expired key to be missing, got %v", err)
+	}
+
+	keys, _ := db.ScanKeys(nil, []byte("gone"), nil, 10)
+	if len(keys) != 0 {
+		t.Errorf("Expected expired keys to be skipped, got %q", keys)
+	}
+
+	// gone1 was deleted when read, the reaper takes care of the rest
+	deleted, err := db.DeleteExpired(10)
+	if err != nil || deleted != 2 {
+		t.Errorf("Expected 2 expired keys to be deleted, got %d: %v", deleted, err)
+	}
+
+	if ttl, err := db.TTL([]byte("forever")); err != nil || ttl != NoExpiry {
+		t.Errorf("Expected NoExpiry, got %v: %v", ttl, err)
+	}
+
+	// The expiry survives a reopen
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ttl, err := db.TTL([]byte("session"))
+	if err != nil || ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected a TTL of about an hour, got %v: %v", ttl, err)
+	}
+
+	if err := db.Persist([]byte("session")); err != nil {
+		t.Fatalf("Error persisting key: %v", err)
+	}
+
+	if ttl, err := db.TTL([]byte("session")); err != nil || ttl != NoExpiry {
+		t.Errorf("Expected NoExpiry after Persist, got %v: %v", ttl, err)
+	}
+
+	// Expiring in the past deletes the key
+	if err := db.Expire([]byte("session"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("Error expiring key: %v", err)
+	}
+
+	if _, err := db.Get([]byte("session")); err != ErrKeyNotFound {
+		t.Errorf("Expected expired key to be missing, got %v", err)
+	}
+
+	if err := db.Expire([]byte("missing"), time.Now()); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDataStructure_DeleteExpiredOrder(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Many keys that have not expired and a few that have
+	later := time.Now().Add(time.Hour)
+	for i := 0; i < 1000; i++ {
+		if err := db.PutWithExpiry([]byte(fmt.Sprintf("later%d", i)), []byte("value"), later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	soon := time.Now().Add(50 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if err := db.PutWithExpiry([]byte(fmt.Sprintf("soon%d", i)), []byte("value"), soon.Add(time.Duration(i)*time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Moving the expiry of a key moves it in the queue, deleting or persisting it takes it out
+	if err := db.Expire([]byte("later0"), soon); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Persist([]byte("soon3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("soon4")); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.expiring.Len() != 1003 {
+		t.Errorf("Expected 1003 expiring keys, got %d", db.expiring.Len())
+	}
+
+	if deleted, err := db.DeleteExpired(10); err != nil || deleted != 0 {
+		t.Errorf("Expected nothing to have expired yet, got %d: %v", deleted, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Soonest expired first, only the expired keys are taken from the queue
+	for _, expected := range []int{2, 2, 0} {
+		if deleted, err := db.DeleteExpired(2); err != nil || deleted != expected {
+			t.Errorf("Expected %d expired keys to be deleted, got %d: %v", expected, deleted, err)
+		}
+	}
+
+	for _, key := range []string{"later0", "soon0", "soon1", "soon2"} {
+		if _, ok := db.index[key]; ok {
+			t.Errorf("Expected %s to be deleted", key)
+		}
+	}
+
+	if _, err := db.Get([]byte("soon3")); err != nil {
+		t.Errorf("Expected the persisted key to be kept, got %v", err)
+	}
+
+	if db.expiring.Len() != 999 {
+		t.Errorf("Expected 999 expiring keys left, got %d", db.expiring.Len())
+	}
+}
+
+func TestDataStructure_Counters(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Missing keys start at 0
+	if result, err := db.IncrBy([]byte("counter"), 5); err != nil || result != 5 {
+		t.Errorf("Expected 5, got %d: %v", result, err)
+	}
+
+	if result, err := db.IncrBy([]byte("counter"), -7); err != nil || result != -2 {
+		t.Errorf("Expected -2, got %d: %v", result, err)
+	}
+
+	if result, err := db.IncrByFloat([]byte("counter"), 0.5); err != nil || result != -1.5 {
+		t.Errorf("Expected -1.5, got %f: %v", result, err)
+	}
+
+	// -1.5 is no longer an integer
+	_, err = db.IncrBy([]byte("counter"), 1)
+	var numberErr *NumberError
+	if !errors.Is(err, ErrNotInteger) || !errors.As(err, &numberErr) || string(numberErr.Value) != "-1.5" {
+		t.Errorf("Expected a NumberError matching ErrNotInteger, got %v", err)
+	}
+
+	if err := db.Put([]byte("text"), []byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.IncrByFloat([]byte("text"), 1); !errors.Is(err, ErrNotFloat) {
+		t.Errorf("Expected ErrNotFloat, got %v", err)
+	}
+
+	if err := db.Put([]byte("max"), []byte("9223372036854775807")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.IncrBy([]byte("max"), 1); err != ErrOverflow {
+		t.Errorf("Expected ErrOverflow, got %v", err)
+	}
+
+	// Increments from many goroutines are never lost
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := db.IncrBy([]byte("hits"), 1); err != nil {
+					t.Errorf("Error incrementing: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Get([]byte("hits"))
+	if err != nil || string(value) != "500" {
+		t.Errorf("Expected 500, got %s: %v", value, err)
+	}
+}
+
+func TestDataStructure_MultiGet(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch := NewBatch()
+	batch.Put([]byte("a"), []byte("1"))
+	batch.Put([]byte("b"), []byte("2"))
+	batch.Put([]byte("empty"), []byte(""))
+	batch.PutWithExpiry([]byte("gone"), []byte("3"), time.Now().Add(-time.Second))
+	if err := db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	batch.Reset()
+	batch.Delete([]byte("b"))
+	batch.Delete([]byte("missing"))
+	if err := db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batches survive a reopen
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	values, err := db.MultiGet([][]byte{[]byte("a"), []byte("b"), []byte("empty"), []byte("gone"), []byte("missing")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(values[0]) != "1" || values[1] != nil || values[2] == nil || len(values[2]) != 0 || values[3] != nil || values[4] != nil {
+		t.Errorf("Unexpected values %q", values)
+	}
+}
+
+func TestDataStructure_Collections(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if length, err := db.LPush([]byte("list"), []byte("a"), []byte("b")); err != nil || length != 2 {
+		t.Errorf("Expected length 2, got %d: %v", length, err)
+	}
+	if length, err := db.LPush([]byte("list"), []byte("c")); err != nil || length != 3 {
+		t.Errorf("Expected length 3, got %d: %v", length, err)
+	}
+
+	if added, err := db.SAdd([]byte("set"), []byte("y"), []byte("x"), []byte("y")); err != nil || added != 2 {
+		t.Errorf("Expected 2 members added, got %d: %v", added, err)
+	}
+	if removed, err := db.SRem([]byte("set"), []byte("y"), []byte("z")); err != nil || removed != 1 {
+		t.Errorf("Expected 1 member removed, got %d: %v", removed, err)
+	}
+
+	if created, err := db.HSet([]byte("hash"), []byte("name"), []byte("chromo")); err != nil || !created {
+		t.Errorf("Expected a new field, got %v: %v", created, err)
+	}
+	if created, err := db.HSet([]byte("hash"), []byte("age"), []byte("1")); err != nil || !created {
+		t.Errorf("Expected a new field, got %v: %v", created, err)
+	}
+	if created, err := db.HSet([]byte("hash"), []byte("name"), []byte("chromodb")); err != nil || created {
+		t.Errorf("Expected an existing field, got %v: %v", created, err)
+	}
+
+	if err := db.Put([]byte("string"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Types survive compaction and a reopen
+	if _, err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for key, expected := range map[string]ValueType{"list": TypeList, "set": TypeSet, "hash": TypeHash, "string": TypeString} {
+		if valueType, err := db.Type([]byte(key)); err != nil || valueType != expected {
+			t.Errorf("Expected %s to be a %s, got %s: %v", key, expected, valueType, err)
+		}
+	}
+	if _, err := db.Type([]byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	elements, err := db.LRange([]byte("list"), 0, -1)
+	if err != nil || fmt.Sprintf("%s", elements) != "[c b a]" {
+		t.Errorf("Expected [c b a], got %s: %v", elements, err)
+	}
+	elements, err = db.LRange([]byte("list"), -2, 10)
+	if err != nil || fmt.Sprintf("%s", elements) != "[b a]" {
+		t.Errorf("Expected [b a], got %s: %v", elements, err)
+	}
+
+	members, err := db.SMembers([]byte("set"))
+	if err != nil || fmt.Sprintf("%s", members) != "[x]" {
+		t.Errorf("Expected [x], got %s: %v", members, err)
+	}
+
+	if value, err := db.HGet([]byte("hash"), []byte("name")); err != nil || string(value) != "chromodb" {
+		t.Errorf("Expected chromodb, got %s: %v", value, err)
+	}
+	if _, err := db.HGet([]byte("hash"), []byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	fields, err := db.HGetAll([]byte("hash"))
+	if err != nil || fmt.Sprintf("%s", fields) != "[{age 1} {name chromodb}]" {
+		t.Errorf("Unexpected fields %s: %v", fields, err)
+	}
+
+	// Keys can only be used as the type they hold
+	if _, err := db.Get([]byte("list")); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if _, err := db.SAdd([]byte("list"), []byte("a")); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if _, err := db.LPush([]byte("string"), []byte("a")); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if _, err := db.IncrBy([]byte("hash"), 1); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+
+	// Expiring a collection keeps its type
+	if err := db.Expire([]byte("set"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if valueType, err := db.Type([]byte("set")); err != nil || valueType != TypeSet {
+		t.Errorf("Expected a set, got %s: %v", valueType, err)
+	}
+
+	// Popping the last element deletes the list
+	for _, expected := range []string{"a", "b", "c"} {
+		if value, err := db.RPop([]byte("list")); err != nil || string(value) != expected {
+			t.Errorf("Expected %s, got %s: %v", expected, value, err)
+		}
+	}
+	if _, err := db.RPop([]byte("list")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := db.Type([]byte("list")); err != ErrKeyNotFound {
+		t.Errorf("Expected the list to be deleted, got %v", err)
+	}
+
+	// Put replaces a collection with a string
+	if err := db.Put([]byte("hash"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get([]byte("hash")); err != nil || string(value) != "value" {
+		t.Errorf("Expected value, got %s: %v", value, err)
+	}
+}
+
+func TestDataStructure_CollectionElements(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if _, err := db.HSet([]byte("hash"), []byte(fmt.Sprintf("field%04d", i)), bytes.Repeat([]byte("v"), 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Setting a field only writes the field and the size of the hash, not the whole hash
+	before := db.nextOffset
+	if _, err := db.HSet([]byte("hash"), []byte("field0500"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if written := db.nextOffset - before; written > 200 {
+		t.Errorf("Expected a small write, got %d bytes", written)
+	}
+	if value, err := db.HGet([]byte("hash"), []byte("field0500")); err != nil || string(value) != "changed" {
+		t.Errorf("Expected changed, got %s: %v", value, err)
+	}
+
+	if _, err := db.LPush([]byte("list"), []byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SAdd([]byte("set"), []byte("x"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Elements are not keys of their own
+	if err := db.Put([]byte("string"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	it := db.NewIterator()
+	for it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	it.Close()
+	if fmt.Sprint(keys) != "[hash list set string]" {
+		t.Errorf("Expected [hash list set string], got %q", keys)
+	}
+	if scanned, _ := db.ScanKeys(nil, nil, nil, 10); fmt.Sprintf("%s", scanned) != "[hash list set string]" {
+		t.Errorf("Expected [hash list set string], got %q", scanned)
+	}
+
+	element := elementKey([]byte("set"), familySetMember, []byte("x"))
+	if _, err := db.Get(element); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if err := db.Put(element, []byte("value")); err != ErrReservedKey {
+		t.Errorf("Expected ErrReservedKey, got %v", err)
+	}
+	if err := db.Delete(element); err != ErrReservedKey {
+		t.Errorf("Expected ErrReservedKey, got %v", err)
+	}
+
+	// Deleting a collection or writing another type over it deletes its elements
+	if err := db.Delete([]byte("hash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("list"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// So does writing over one that expired
+	if err := db.Expire([]byte("set"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.SAdd([]byte("set"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := db.SMembers([]byte("set"))
+	if err != nil || fmt.Sprintf("%s", members) != "[z]" {
+		t.Errorf("Expected [z], got %s: %v", members, err)
+	}
+
+	elements := 0
+	for key := range db.index {
+		if reservedKey(key) {
+			elements++
+		}
+	}
+	if elements != 1 {
+		t.Errorf("Expected only the element of the new set to be left, got %d", elements)
+	}
+
+	// Elements survive compaction and a reopen
+	if _, err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	members, err = db.SMembers([]byte("set"))
+	if err != nil || fmt.Sprintf("%s", members) != "[z]" {
+		t.Errorf("Expected [z] after a reopen, got %s: %v", members, err)
+	}
+}
+
+func TestDataStructure_SortedSets(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := db.ZAdd([]byte("board"),
+		ScoredMember{Member: []byte("alex"), Score: 30},
+		ScoredMember{Member: []byte("bob"), Score: 10},
+		ScoredMember{Member: []byte("carol"), Score: 20},
+		ScoredMember{Member: []byte("dave"), Score: 20},
+	)
+	if err != nil || added != 4 {
+		t.Errorf("Expected 4 members added, got %d: %v", added, err)
+	}
+
+	// Updating a score moves the member
+	if added, err := db.ZAdd([]byte("board"), ScoredMember{Member: []byte("bob"), Score: 40}); err != nil || added != 0 {
+		t.Errorf("Expected no members added, got %d: %v", added, err)
+	}
+
+	if _, err := db.ZAdd([]byte("board"), ScoredMember{Member: []byte("nan"), Score: math.NaN()}); err != ErrNotFloat {
+		t.Errorf("Expected ErrNotFloat, got %v", err)
+	}
+
+	// Sorted sets survive a reopen
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if score, err := db.ZScore([]byte("board"), []byte("bob")); err != nil || score != 40 {
+		t.Errorf("Expected 40, got %f: %v", score, err)
+	}
+	if _, err := db.ZScore([]byte("board"), []byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	for member, expected := range map[string]int{"carol": 0, "dave": 1, "alex": 2, "bob": 3} {
+		if rank, err := db.ZRank([]byte("board"), []byte(member)); err != nil || rank != expected {
+			t.Errorf("Expected rank %d for %s, got %d: %v", expected, member, rank, err)
+		}
+	}
+
+	members, err := db.ZRangeByScore([]byte("board"), 20, 30)
+	if err != nil || len(members) != 3 {
+		t.Fatalf("Expected 3 members, got %v: %v", members, err)
+	}
+	for i, expected := range []string{"carol 20", "dave 20", "alex 30"} {
+		if got := fmt.Sprintf("%s %g", members[i].Member, members[i].Score); got != expected {
+			t.Errorf("Expected %s, got %s", expected, got)
+		}
+	}
+
+	members, err = db.ZRangeByScore([]byte("board"), math.Inf(-1), math.Inf(1))
+	if err != nil || len(members) != 4 {
+		t.Errorf("Expected 4 members, got %v: %v", members, err)
+	}
+
+	if removed, err := db.ZRem([]byte("board"), []byte("carol"), []byte("missing")); err != nil || removed != 1 {
+		t.Errorf("Expected 1 member removed, got %d: %v", removed, err)
+	}
+	if rank, err := db.ZRank([]byte("board"), []byte("dave")); err != nil || rank != 0 {
+		t.Errorf("Expected rank 0, got %d: %v", rank, err)
+	}
+
+	// Readers and writers of the same sorted set can run at once
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if i == 0 {
+					if _, err := db.ZAdd([]byte("board"), ScoredMember{Member: []byte(fmt.Sprintf("player%d", j)), Score: float64(j)}); err != nil {
+						t.Errorf("Error adding: %v", err)
+					}
+				} else if _, err := db.ZRangeByScore([]byte("board"), 0, 100); err != nil {
+					t.Errorf("Error reading: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if members, err := db.ZRangeByScore([]byte("board"), 0, 100); err != nil || len(members) != 53 {
+		t.Errorf("Expected 53 members, got %d: %v", len(members), err)
+	}
+
+	// A put replaces the sorted set
+	if err := db.Put([]byte("board"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ZScore([]byte("board"), []byte("dave")); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	for key := range db.index {
+		if reservedKey(key) {
+			t.Errorf("Expected the members to be deleted with the sorted set, found %q", key)
+		}
+	}
+
+	// Negative scores, both zeros and infinities keep their order as keys
+	scores := []float64{math.Inf(-1), -1e300, -2.5, -1, math.Copysign(0, -1), 0.5, 1, 1e300, math.Inf(1)}
+	for i, score := range scores {
+		if _, err := db.ZAdd([]byte("scores"), ScoredMember{Member: []byte{byte('a' + i)}, Score: score}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members, err = db.ZRangeByScore([]byte("scores"), math.Inf(-1), math.Inf(1))
+	if err != nil || len(members) != len(scores) {
+		t.Fatalf("Expected %d members, got %v: %v", len(scores), members, err)
+	}
+	for i, member := range members {
+		if member.Score != scores[i] || member.Member[0] != byte('a'+i) {
+			t.Errorf("Expected %g at %d, got %s %g", scores[i], i, member.Member, member.Score)
+		}
+	}
+	if members, err := db.ZRangeByScore([]byte("scores"), -2.5, 0); err != nil || len(members) != 3 {
+		t.Errorf("Expected 3 members from -2.5 to 0, got %v: %v", members, err)
+	}
+
+	// Adding to a large sorted set only writes the member
+	for i := 0; i < 1000; i++ {
+		if _, err := db.ZAdd([]byte("large"), ScoredMember{Member: []byte(fmt.Sprintf("member%04d", i)), Score: float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := db.nextOffset
+	if _, err := db.ZAdd([]byte("large"), ScoredMember{Member: []byte("member0500"), Score: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if written := db.nextOffset - before; written > 300 {
+		t.Errorf("Expected a small write, got %d bytes", written)
+	}
+	if rank, err := db.ZRank([]byte("large"), []byte("member0500")); err != nil || rank != 0 {
+		t.Errorf("Expected rank 0, got %d: %v", rank, err)
+	}
+	if rank, err := db.ZRank([]byte("large"), []byte("member0999")); err != nil || rank != 999 {
+		t.Errorf("Expected rank 999, got %d: %v", rank, err)
+	}
+}
+
+func TestDataStructure_JSON(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	key := []byte("user")
+
+	if err := db.JSONSet(key, []byte("$.name"), []byte(`"alex"`)); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	if err := db.JSONSet(key, []byte("$"), []byte(`{"name": "alex", "tags": ["a", "b", "c"], "address": {"city": "x"}, "score": 1.50}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range [][2]string{
+		{"$.address.city", `"y"`},
+		{"$.address.zip", `"12345"`},
+		{"$.tags[-1]", `"z"`},
+		{`$["name"]`, `{"first": "alex"}`},
+	} {
+		if err := db.JSONSet(key, []byte(step[0]), []byte(step[1])); err != nil {
+			t.Errorf("Error setting %s: %v", step[0], err)
+		}
+	}
+
+	for _, step := range [][2]string{
+		{"$.name.first", `"alex"`},
+		{"$.tags", `["a","b","z"]`},
+		{"$.tags[0]", `"a"`},
+		{"$.score", `1.50`},
+		{"$.address", `{"city":"y","zip":"12345"}`},
+	} {
+		if value, err := db.JSONGet(key, []byte(step[0])); err != nil || string(value) != step[1] {
+			t.Errorf("Expected %s at %s, got %s: %v", step[1], step[0], value, err)
+		}
+	}
+
+	// The document is a string value
+	if value, err := db.Get(key); err != nil || string(value) != `{"address":{"city":"y","zip":"12345"},"name":{"first":"alex"},"score":1.50,"tags":["a","b","z"]}` {
+		t.Errorf("Unexpected document %s: %v", value, err)
+	}
+
+	for _, path := range []string{"$.tags[0]", "$.address.city"} {
+		if deleted, err := db.JSONDel(key, []byte(path)); err != nil || !deleted {
+			t.Errorf("Expected %s to be deleted, got %v: %v", path, deleted, err)
+		}
+	}
+	if deleted, err := db.JSONDel(key, []byte("$.missing")); err != nil || deleted {
+		t.Errorf("Expected nothing to be deleted, got %v: %v", deleted, err)
+	}
+
+	if value, err := db.JSONGet(key, []byte("$")); err != nil || string(value) != `{"address":{"zip":"12345"},"name":{"first":"alex"},"score":1.50,"tags":["b","z"]}` {
+		t.Errorf("Unexpected document %s: %v", value, err)
+	}
+
+	if _, err := db.JSONGet(key, []byte("$.tags[5]")); err != ErrPathNotFound {
+		t.Errorf("Expected ErrPathNotFound, got %v", err)
+	}
+	if err := db.JSONSet(key, []byte("$.missing.field"), []byte("1")); err != ErrPathNotFound {
+		t.Errorf("Expected ErrPathNotFound, got %v", err)
+	}
+	if err := db.JSONSet(key, []byte("$.name"), []byte("{bad")); err != ErrNotJSON {
+		t.Errorf("Expected ErrNotJSON, got %v", err)
+	}
+	for _, path := range []string{"name", "$.", "$[abc]", "$[0", "$x"} {
+		if _, err := db.JSONGet(key, []byte(path)); err == nil {
+			t.Errorf("Expected an error for path %s", path)
+		}
+	}
+
+	if err := db.Put([]byte("text"), []byte("not json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.JSONGet([]byte("text"), []byte("$")); err != ErrNotJSON {
+		t.Errorf("Expected ErrNotJSON, got %v", err)
+	}
+
+	// Deleting the root deletes the key
+	if deleted, err := db.JSONDel(key, []byte("$")); err != nil || !deleted {
+		t.Errorf("Expected the document to be deleted, got %v: %v", deleted, err)
+	}
+	if _, err := db.Get(key); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDataStructure_SecondaryIndexes(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Documents stored before the index is created are indexed too
+	if err := db.Put([]byte("user1"), []byte(`{"city": "Toronto", "age": 30}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateIndex("city", []byte("$.city")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("age", []byte("$.age")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateIndex("city", []byte("$.city")); err != ErrIndexExists {
+		t.Errorf("Expected ErrIndexExists, got %v", err)
+	}
+	if err := db.CreateIndex("bad", []byte("city")); err == nil {
+		t.Errorf("Expected an error for a bad path")
+	}
+
+	batch := NewBatch()
+	batch.Put([]byte("user2"), []byte(`{"city": "Paris", "age": 30}`))
+	batch.Put([]byte("user3"), []byte(`{"city": "Toronto"}`))
+	batch.Put([]byte("text"), []byte("Toronto"))
+	if err := db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(name, value string) string {
+		keys, err := db.Find(name, []byte(value))
+		if err != nil {
+			t.Fatalf("Error finding %s in %s: %v", value, name, err)
+		}
+		return fmt.Sprintf("%s", keys)
+	}
+
+	if keys := find("city", "Toronto"); keys != "[user1 user3]" {
+		t.Errorf("Expected [user1 user3], got %s", keys)
+	}
+	if keys := find("age", "30"); keys != "[user1 user2]" {
+		t.Errorf("Expected [user1 user2], got %s", keys)
+	}
+
+	// Updates and deletes keep the index up to date
+	if err := db.JSONSet([]byte("user1"), []byte("$.city"), []byte(`"Paris"`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("user2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := find("city", "Paris"); keys != "[user1]" {
+		t.Errorf("Expected [user1], got %s", keys)
+	}
+	if keys := find("city", "Toronto"); keys != "[user3]" {
+		t.Errorf("Expected [user3], got %s", keys)
+	}
+
+	if _, err := db.Find("missing", []byte("x")); err != ErrIndexNotFound {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+
+	// Indexes survive a reopen
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if keys := find("city", "Paris"); keys != "[user1]" {
+		t.Errorf("Expected [user1], got %s", keys)
+	}
+	if keys := find("age", "30"); keys != "[user1]" {
+		t.Errorf("Expected [user1], got %s", keys)
+	}
+}
+
+func TestDataStructure_Search(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Values stored before the index is created are indexed too
+	if err := db.Put([]byte("product:1"), []byte("Wireless mouse with a quiet click")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateTextIndex("products", []byte("product:")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTextIndex("products", []byte("product:")); err != ErrIndexExists {
+		t.Errorf("Expected ErrIndexExists, got %v", err)
+	}
+
+	batch := NewBatch()
+	batch.Put([]byte("product:2"), []byte("Wired mouse"))
+	batch.Put([]byte("product:3"), []byte("Wireless keyboard, wireless charging, wireless everything"))
+	batch.Put([]byte("product:4"), []byte("Mouse pad for a wireless mouse"))
+	batch.Put([]byte("other:1"), []byte("Wireless mouse"))
+	if err := db.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(query string) string {
+		results, err := db.Search("products", query, 0)
+		if err != nil {
+			t.Fatalf("Error searching %s: %v", query, err)
+		}
+
+		keys := make([]string, len(results))
+		for i, result := range results {
+			keys[i] = string(result.Key)
+		}
+		return strings.Join(keys, " ")
+	}
+
+	for query, expected := range map[string]string{
+		"wireless":                        "product:3 product:1 product:4",
+		"wireless mouse":                  "product:4 product:1",
+		"wireless AND mouse":              "product:4 product:1",
+		"keyboard OR wired":               "product:2 product:3",
+		`"wireless mouse"`:                "product:4 product:1",
+		`"mouse wireless"`:                "",
+		"(keyboard OR pad) wireless":      "product:3 product:4",
+		"MOUSE":                           "product:2 product:4 product:1",
+		"missing":                         "",
+		`wired OR "quiet click" OR track`: "product:1 product:2",
+	} {
+		if keys := search(query); keys != expected {
+			t.Errorf("Expected [%s] for %s, got [%s]", expected, query, keys)
+		}
+	}
+
+	for _, query := range []string{"", "wireless AND", "OR mouse", "(mouse", `"mouse`, "mouse)", "--"} {
+		if _, err := db.Search("products", query, 0); err == nil {
+			t.Errorf("Expected an error for query %q", query)
+		}
+	}
+
+	if results, err := db.Search("products", "mouse", 1); err != nil || len(results) != 1 {
+		t.Errorf("Expected 1 result, got %d: %v", len(results), err)
+	}
+
+	if _, err := db.Search("missing", "mouse", 0); err != ErrIndexNotFound {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+
+	// Updates and deletes keep the index up to date
+	if err := db.Put([]byte("product:2"), []byte("Wired keyboard")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("product:4")); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := search("mouse"); keys != "product:1" {
+		t.Errorf("Expected [product:1], got [%s]", keys)
+	}
+
+	// Indexes survive a reopen
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if keys := search("keyboard"); keys != "product:2 product:3" {
+		t.Errorf("Expected [product:2 product:3], got [%s]", keys)
+	}
+}
+
+func TestDataStructure_IndexContents(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateIndex("city", []byte("$.city")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTextIndex("docs", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("doc%d\xff\x00", i))
+		value := fmt.Sprintf(`{"city": "city%d", "text": "wireless mouse number %d of the mouse pad"}`, i%10, i)
+		if err := db.Put(key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results := func() string {
+		found, err := db.Find("city", []byte("city3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matches, err := db.Search("docs", `"mouse pad" OR number`, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Equal scores may come out in a different order
+		scores := make([]string, len(matches))
+		for i, match := range matches {
+			scores[i] = fmt.Sprintf("%q %.6f", match.Key, match.Score)
+		}
+		sort.Strings(scores)
+
+		return fmt.Sprintf("%q %s", found, scores)
+	}
+
+	expected := results()
+
+	// Closing writes the contents of the indexes, the next open loads them instead of reading every value
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{secondaryContentsExtension, textContentsExtension} {
+		if _, ok, err := db.readIndexContents(ext); err != nil || !ok {
+			t.Errorf("Expected the %s contents to be loaded: %v", ext, err)
+		}
+	}
+
+	if got := results(); got != expected {
+		t.Errorf("Expected the same results after reopening, got %s instead of %s", got, expected)
+	}
+
+	// Contents written before a crash no longer match the data file, the indexes are rebuilt from it
+	if err := db.Put([]byte("doc100"), []byte(`{"city": "city3", "text": "mouse pad"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = results()
+
+	close(db.stopSync)
+	db.closeFiles()
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, ok, _ := db.readIndexContents(secondaryContentsExtension); ok {
+		t.Errorf("Expected the contents to be out of date")
+	}
+
+	if got := results(); got != expected {
+		t.Errorf("Expected the same results after rebuilding, got %s instead of %s", got, expected)
+	}
+}
+
+func TestDataStructure_VectorSearch(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateVectorIndex("embeddings", Cosine); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateVectorIndex("points", L2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateVectorIndex("points", L2); err != ErrIndexExists {
+		t.Errorf("Expected ErrIndexExists, got %v", err)
+	}
+
+	// Random vectors, the search should find most of the true nearest neighbours
+	random := rand.New(rand.NewSource(42))
+	vectors := make([][]float32, 1000)
+	for i := range vectors {
+		vectors[i] = make([]float32, 16)
+		for j := range vectors[i] {
+			vectors[i][j] = random.Float32()*2 - 1
+		}
+
+		// Vectors belong to keys that exist
+		key := []byte(fmt.Sprintf("point%d", i))
+		if err := db.Put(key, []byte("point")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.VectorAdd("points", key, vectors[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recall := func() float64 {
+		found := 0
+		for q := 0; q < 20; q++ {
+			query := vectors[random.Intn(len(vectors))]
+
+			// Brute force nearest neighbours
+			type neighbor struct {
+				key      string
+				distance float64
+			}
+			neighbors := make([]neighbor, len(vectors))
+			for i, vector := range vectors {
+				var sum float64
+				for j := range vector {
+					d := float64(vector[j] - query[j])
+					sum += d * d
+				}
+				neighbors[i] = neighbor{key: fmt.Sprintf("point%d", i), distance: sum}
+			}
+			sort.Slice(neighbors, func(i, j int) bool {
+				return neighbors[i].distance < neighbors[j].distance
+			})
+
+			results, err := db.VectorSearch("points", query, 10)
+			if err != nil || len(results) != 10 {
+				t.Fatalf("Expected 10 results, got %d: %v", len(results), err)
+			}
+
+			expected := make(map[string]bool)
+			for _, neighbor := range neighbors[:10] {
+				expected[neighbor.key] = true
+			}
+			for _, result := range results {
+				if expected[string(result.Key)] {
+					found++
+				}
+			}
+		}
+
+		return float64(found) / 200
+	}
+
+	if r := recall(); r < 0.9 {
+		t.Errorf("Expected a recall of at least 0.9, got %f", r)
+	}
+
+	if _, err := db.VectorSearch("points", []float32{1, 2}, 10); err != ErrDimensionMismatch {
+		t.Errorf("Expected ErrDimensionMismatch, got %v", err)
+	}
+	if err := db.VectorAdd("points", []byte("bad"), []float32{1, 2}); err != ErrDimensionMismatch {
+		t.Errorf("Expected ErrDimensionMismatch, got %v", err)
+	}
+	if _, err := db.VectorSearch("missing", []float32{1}, 10); err != ErrIndexNotFound {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+
+	// Cosine distance ignores the length of vectors
+	for key, vector := range map[string][]float32{"east": {1, 0}, "north": {0, 1}, "northeast": {5, 5}} {
+		if err := db.Put([]byte(key), []byte("direction")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.VectorAdd("embeddings", []byte(key), vector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.VectorAdd("embeddings", []byte("zero"), []float32{0, 0}); err == nil {
+		t.Errorf("Expected an error for a zero vector")
+	}
+	if err := db.VectorAdd("embeddings", []byte("west"), []float32{-1, 0}); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for a missing key, got %v", err)
+	}
+
+	// Replacing a vector moves the key
+	if err := db.VectorAdd("embeddings", []byte("east"), []float32{-1, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		results, err := db.VectorSearch("embeddings", []float32{1, 0.1}, 2)
+		if err != nil || len(results) != 2 || string(results[0].Key) != "northeast" || string(results[1].Key) != "north" {
+			t.Errorf("Unexpected results %v: %v", results, err)
+		}
+
+		results, err = db.VectorSearch("embeddings", []float32{-2, 0}, 1)
+		if err != nil || len(results) != 1 || string(results[0].Key) != "east" || results[0].Distance > 1e-6 {
+			t.Errorf("Unexpected results %v: %v", results, err)
+		}
+	}
+	check()
+
+	// Vector indexes survive a reopen
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	check()
+
+	if r := recall(); r < 0.9 {
+		t.Errorf("Expected a recall of at least 0.9 after reopening, got %f", r)
+	}
+
+	results, err := db.VectorSearch("points", vectors[0], 1)
+	if err != nil || len(results) != 1 || string(results[0].Key) != "point0" || results[0].Distance != 0 {
+		t.Errorf("Expected point0 at distance 0, got %v: %v", results, err)
+	}
+}
+
+func TestDataStructure_VectorKeys(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.CreateVectorIndex("points", L2); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateVectorIndex("other", L2); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("point%d", i))
+		if err := db.Put(key, []byte("point")); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.VectorAdd("points", key, []float32{float32(i), 0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := func(name string, vector []float32, k int) []string {
+		results, err := db.VectorSearch(name, vector, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make([]string, len(results))
+		for i, result := range results {
+			keys[i] = string(result.Key)
+		}
+		return keys
+	}
+
+	// Re-adding a key replaces its vector, it is found once
+	for round := 0; round < 10; round++ {
+		if err := db.VectorAdd("points", []byte("point0"), []float32{0, float32(round)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if found := keys("points", []float32{0, 9}, 100); len(found) != 100 || found[0] != "point0" {
+		t.Errorf("Expected 100 keys starting with point0, got %v", found)
+	}
+
+	// Deleting a key removes its vectors
+	if err := db.VectorAdd("other", []byte("point1"), []float32{1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete([]byte("point1")); err != nil {
+		t.Fatal(err)
+	}
+	if found := keys("points", []float32{1, 0}, 1); len(found) != 1 || found[0] == "point1" {
+		t.Errorf("Expected point1 to be gone, got %v", found)
+	}
+	if found := keys("other", []float32{1, 1}, 1); len(found) != 0 {
+		t.Errorf("Expected no keys in other, got %v", found)
+	}
+
+	// Putting the key again does not bring its vector back
+	if err := db.Put([]byte("point1"), []byte("point")); err != nil {
+		t.Fatal(err)
+	}
+	if found := keys("points", []float32{1, 0}, 1); found[0] == "point1" {
+		t.Errorf("Expected point1 to have no vector, got %v", found)
+	}
+
+	// An expired key is not found even before it is deleted
+	if err := db.Expire([]byte("point2"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if found := keys("points", []float32{2, 0}, 1); found[0] == "point2" {
+		t.Errorf("Expected point2 to be gone, got %v", found)
+	}
+
+	// VectorDelete removes a vector and keeps the key
+	if deleted, err := db.VectorDelete("points", []byte("point3")); err != nil || !deleted {
+		t.Errorf("Expected point3 to be deleted: %v", err)
+	}
+	if deleted, err := db.VectorDelete("points", []byte("point3")); err != nil || deleted {
+		t.Errorf("Expected point3 to have no vector: %v", err)
+	}
+	if _, err := db.VectorDelete("missing", []byte("point3")); err != ErrIndexNotFound {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+	if _, err := db.Get([]byte("point3")); err != nil {
+		t.Errorf("Expected point3 to still exist: %v", err)
+	}
+
+	// Dropping an index drops its vectors
+	if err := db.VectorAdd("other", []byte("point4"), []float32{4, 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropVectorIndex("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DropVectorIndex("other"); err != ErrIndexNotFound {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+	if err := db.CreateVectorIndex("other", Cosine); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		found := keys("points", []float32{0, 0}, 100)
+		if len(found) != 97 {
+			t.Errorf("Expected 97 keys, got %d", len(found))
+		}
+		for _, key := range found {
+			if key == "point1" || key == "point2" || key == "point3" {
+				t.Errorf("Unexpected key %s", key)
+			}
+		}
+
+		if found := keys("other", []float32{1, 1}, 10); len(found) != 0 {
+			t.Errorf("Expected the dropped vectors to be gone, got %v", found)
+		}
+	}
+	check()
+
+	// Compaction leaves only the live vectors in the log
+	if _, err := db.DeleteExpired(100); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(tempDir + "/chromo.vec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := stat.Size()
+
+	if _, err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err = os.Stat(tempDir + "/chromo.vec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() >= before {
+		t.Errorf("Expected the vector log to shrink from %d bytes, got %d", before, stat.Size())
+	}
+	check()
+
+	// Writes after compaction land in the new log
+	if err := db.VectorAdd("points", []byte("point3"), []float32{3, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if found := keys("points", []float32{3, 0}, 1); len(found) != 1 || found[0] != "point3" {
+		t.Errorf("Expected point3, got %v", found)
+	}
+	if found := keys("points", []float32{0, 0}, 100); len(found) != 98 {
+		t.Errorf("Expected 98 keys after reopening, got %d", len(found))
+	}
+	if found := keys("other", []float32{1, 1}, 10); len(found) != 0 {
+		t.Errorf("Expected no keys in other after reopening, got %v", found)
+	}
+}
+
+func TestDataStructure_Geo(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	added, err := db.GeoAdd([]byte("sicily"),
+		GeoMember{Member: []byte("palermo"), Longitude: 13.361389, Latitude: 38.115556},
+		GeoMember{Member: []byte("catania"), Longitude: 15.087269, Latitude: 37.502669},
+	)
+	if err != nil || added != 2 {
+		t.Errorf("Expected 2 members added, got %d: %v", added, err)
+	}
+
+	if _, err := db.GeoAdd([]byte("sicily"), GeoMember{Member: []byte("pole"), Longitude: 0, Latitude: 90}); err != ErrBadCoordinates {
+		t.Errorf("Expected ErrBadCoordinates, got %v", err)
+	}
+
+	// Positions are stored to within a meter or so
+	distance, err := db.GeoDist([]byte("sicily"), []byte("palermo"), []byte("catania"))
+	if err != nil || math.Abs(distance-166274.15) > 1 {
+		t.Errorf("Expected about 166274.15, got %f: %v", distance, err)
+	}
+	if _, err := db.GeoDist([]byte("sicily"), []byte("palermo"), []byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	results, err := db.GeoRadius([]byte("sicily"), 15, 37, 200000)
+	if err != nil || len(results) != 2 || string(results[0].Member) != "catania" || string(results[1].Member) != "palermo" {
+		t.Fatalf("Expected catania and palermo, got %v: %v", results, err)
+	}
+	if math.Abs(results[0].Distance-56441) > 10 || math.Abs(results[1].Distance-190443) > 10 {
+		t.Errorf("Expected distances of about 56441 and 190443, got %f and %f", results[0].Distance, results[1].Distance)
+	}
+
+	if results, err := db.GeoRadius([]byte("sicily"), 15, 37, 100000); err != nil || len(results) != 1 {
+		t.Errorf("Expected only catania, got %v: %v", results, err)
+	}
+
+	// Radius queries find the same members as checking every member, across the antimeridian too
+	random := rand.New(rand.NewSource(1))
+
+	var members []GeoMember
+	for i := 0; i < 2000; i++ {
+		members = append(members, GeoMember{
+			Member:    []byte(fmt.Sprintf("point%d", i)),
+			Longitude: random.Float64()*360 - 180,
+			Latitude:  random.Float64()*160 - 80,
+		})
+	}
+	if _, err := db.GeoAdd([]byte("points"), members...); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range [][3]float64{{0, 0, 1000000}, {179.9, 10, 800000}, {-120, 75, 500000}, {30, -40, 50000}, {10, 10, 20000000}} {
+		expected := 0
+		for _, member := range members {
+			longitude, latitude := geohashDecode(geohashEncode(member.Longitude, member.Latitude, geoStep))
+			if geoDistance(query[0], query[1], longitude, latitude) <= query[2] {
+				expected++
+			}
+		}
+
+		results, err := db.GeoRadius([]byte("points"), query[0], query[1], query[2])
+		if err != nil || len(results) != expected {
+			t.Errorf("Expected %d members within %g of %g,%g, got %d: %v", expected, query[2], query[0], query[1], len(results), err)
+		}
+
+		for i := 1; i < len(results); i++ {
+			if results[i].Distance < results[i-1].Distance {
+				t.Errorf("Expected members nearest first")
+				break
+			}
+		}
+	}
+}
+
+func TestDataStructure_TimeSeries(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sample every second for 1000 seconds, spread over several chunks
+	for i := int64(0); i < 1000; i++ {
+		if err := db.TSAdd([]byte("cpu"), 1000*i, float64(i%10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.TSAdd([]byte("cpu"), 5000, 1); err != ErrOldTimestamp {
+		t.Errorf("Expected ErrOldTimestamp, got %v", err)
+	}
+	if err := db.TSAdd([]byte("cpu"), 1000000, math.NaN()); err != ErrNotFloat {
+		t.Errorf("Expected ErrNotFloat, got %v", err)
+	}
+
+	// A sample at the last timestamp replaces it
+	if err := db.TSAdd([]byte("cpu"), 999000, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	// Time series survive a reopen
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if valueType, err := db.Type([]byte("cpu")); err != nil || valueType != TypeTimeSeries {
+		t.Errorf("Expected timeseries, got %v: %v", valueType, err)
+	}
+	if _, err := db.Get([]byte("cpu")); err != ErrWrongType {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+
+	samples, err := db.TSRange([]byte("cpu"), 0, math.MaxInt64)
+	if err != nil || len(samples) != 1000 {
+		t.Fatalf("Expected 1000 samples, got %d: %v", len(samples), err)
+	}
+	for i, sample := range samples[:999] {
+		if sample.Timestamp != 1000*int64(i) || sample.Value != float64(i%10) {
+			t.Fatalf("Expected %d at %d, got %v", i%10, 1000*i, sample)
+		}
+	}
+	if samples[999].Value != 42 {
+		t.Errorf("Expected the last sample replaced, got %v", samples[999])
+	}
+
+	samples, err = db.TSRange([]byte("cpu"), 2500, 5000)
+	if err != nil || len(samples) != 3 || samples[0].Timestamp != 3000 || samples[2].Timestamp != 5000 {
+		t.Errorf("Expected samples 3000 to 5000, got %v: %v", samples, err)
+	}
+
+	for aggregation, expected := range map[Aggregation]float64{
+		AggregationAvg:   4.5,
+		AggregationMin:   0,
+		AggregationMax:   9,
+		AggregationSum:   45,
+		AggregationCount: 10,
+	} {
+		buckets, err := db.TSRangeAggregated([]byte("cpu"), 0, 99999, aggregation, 10*time.Second)
+		if err != nil || len(buckets) != 10 {
+			t.Fatalf("Expected 10 buckets for %s, got %v: %v", aggregation, buckets, err)
+		}
+
+		for i, bucket := range buckets {
+			if bucket.Timestamp != 10000*int64(i) || bucket.Value != expected {
+				t.Errorf("Expected %g at %d for %s, got %v", expected, 10000*i, aggregation, bucket)
+			}
+		}
+	}
+
+	if _, err := db.TSRangeAggregated([]byte("cpu"), 0, 1000, AggregationAvg, 0); err == nil {
+		t.Errorf("Expected an error for an empty bucket")
+	}
+
+	// Regular samples compress far below the 16 bytes they take raw, sealed chunks included
+	size := db.index["cpu"].size
+	for key, entry := range db.index {
+		if strings.HasPrefix(key, string(elementPrefix([]byte("cpu"), familyTSChunk))) {
+			size += entry.size
+		}
+	}
+	if size > 4000 {
+		t.Errorf("Expected 1000 samples in at most 4000 bytes, got %d", size)
+	}
+
+	// Adding a sample only rewrites the head chunk
+	before := db.nextOffset
+	if err := db.TSAdd([]byte("cpu"), 999000, 9); err != nil {
+		t.Fatal(err)
+	}
+	if written := db.nextOffset - before; written > 500 {
+		t.Errorf("Expected only the head chunk written, got %d bytes", written)
+	}
+
+	// Retention drops old samples
+	if err := db.TSCreate([]byte("cpu"), 100*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err = db.TSRange([]byte("cpu"), 0, math.MaxInt64)
+	if err != nil || len(samples) != 101 || samples[0].Timestamp != 899000 {
+		t.Errorf("Expected 101 samples from 899000, got %d: %v", len(samples), err)
+	}
+
+	if err := db.TSAdd([]byte("cpu"), 2000000, 1); err != nil {
+		t.Fatal(err)
+	}
+	if samples, err := db.TSRange([]byte("cpu"), 0, math.MaxInt64); err != nil || len(samples) != 1 {
+		t.Errorf("Expected only the newest sample, got %v: %v", samples, err)
+	}
+	for key := range db.index {
+		if strings.HasPrefix(key, string(elementPrefix([]byte("cpu"), familyTSChunk))) {
+			t.Errorf("Expected the sealed chunks past the retention to be dropped, found %q", key)
+		}
+	}
+
+	// Irregular timestamps and values survive compression
+	random := rand.New(rand.NewSource(1))
+
+	expected := make([]Sample, 0, 500)
+	timestamp := int64(-1000000)
+	for i := 0; i < 500; i++ {
+		switch random.Intn(4) {
+		case 0:
+			timestamp += random.Int63n(10)
+		case 1:
+			timestamp += random.Int63n(100000)
+		case 2:
+			timestamp += random.Int63n(1 << 40)
+		default:
+			timestamp += 1000
+		}
+
+		value := []float64{random.NormFloat64(), float64(random.Intn(3)), math.Inf(1), -0.5, 1e300}[random.Intn(5)]
+		expected = append(expected, Sample{Timestamp: timestamp, Value: value})
+
+		if err := db.TSAdd([]byte("irregular"), timestamp, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Samples at the same timestamp replace each other
+	var deduplicated []Sample
+	for _, sample := range expected {
+		if n := len(deduplicated); n > 0 && deduplicated[n-1].Timestamp == sample.Timestamp {
+			deduplicated[n-1] = sample
+			continue
+		}
+		deduplicated = append(deduplicated, sample)
+	}
+
+	samples, err = db.TSRange([]byte("irregular"), math.MinInt64, math.MaxInt64)
+	if err != nil || len(samples) != len(deduplicated) {
+		t.Fatalf("Expected %d samples, got %d: %v", len(deduplicated), len(samples), err)
+	}
+	for i := range samples {
+		if samples[i] != deduplicated[i] {
+			t.Fatalf("Expected %v, got %v", deduplicated[i], samples[i])
+		}
+	}
+}
+
+// benchmarkDB opens a DB holding 1000 keys
+func benchmarkDB(b *testing.B) *DataStructure {
+	tempDir := b.TempDir()
+
+	db, err := OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), bytes.Repeat([]byte("v"), 128)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return db
+}
+
+func BenchmarkDataStructure_Get(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key%d", i%1000))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compare with BenchmarkDataStructure_GetParallelSerialized, readers share the lock so GETs run in parallel
+func BenchmarkDataStructure_GetParallel(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := db.Get([]byte(fmt.Sprintf("key%d", i%1000))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// The same parallel read load as BenchmarkDataStructure_GetParallel, serialized by one global mutex the way every
+// command used to be, so the difference between the two is the gain from sharing the read lock
+func BenchmarkDataStructure_GetParallelSerialized(b *testing.B) {
+	db := benchmarkDB(b)
+	defer db.Close()
+
+	var mu sync.Mutex
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			mu.Lock()
+			_, err := db.Get([]byte(fmt.Sprintf("key%d", i%1000)))
+			mu.Unlock()
+
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,218 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"container/heap"
+	"time"
+)
+
+// NoExpiry is the TTL of a key that never expires
+const NoExpiry time.Duration = -1
+
+// PutWithExpiry is like Put but the key expires at expiresAt.  Expired keys read as missing and are deleted
+// when read or by DeleteExpired, whichever comes first
+func (db *DataStructure) PutWithExpiry(key, value []byte, expiresAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.writeBatch(&Batch{ops: []batchOp{{key: key, value: value, expiresAt: expiresAt.UnixMilli()}}})
+}
+
+// Expire sets the time a key expires at.  A time in the past deletes the key
+func (db *DataStructure) Expire(key []byte, expiresAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.setExpiry(key, expiresAt.UnixMilli())
+}
+
+// Persist removes the expiry of a key so it never expires
+func (db *DataStructure) Persist(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.setExpiry(key, 0)
+}
+
+// TTL returns how long until a key expires, or NoExpiry if it never does
+func (db *DataStructure) TTL(key []byte) (time.Duration, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now().UnixMilli()
+
+	entry, ok := db.liveEntry(string(key), now)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+
+	if entry.expiresAt == 0 {
+		return NoExpiry, nil
+	}
+
+	return time.Duration(entry.expiresAt-now) * time.Millisecond, nil
+}
+
+// DeleteExpired deletes up to limit expired keys, soonest expired first, and returns how many it deleted.
+// Deleting fewer than limit means no expired keys are left.  Only the expired keys are looked at
+func (db *DataStructure) DeleteExpired(limit int) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+
+	// The queue is ordered by expiry so the expired keys are at its front
+	var popped []expiryItem
+	batch := &Batch{}
+	for batch.Len() < limit && db.expiring.Len() > 0 && expired(db.expiring.items[0].expiresAt, now) {
+		item := heap.Pop(db.expiring).(expiryItem)
+		popped = append(popped, item)
+
+		batch.Delete([]byte(item.key))
+	}
+
+	if err := db.writeBatch(batch); err != nil {
+		// Keys that were not deleted are still expiring
+		for _, item := range popped {
+			if _, ok := db.index[item.key]; ok {
+				db.expiring.set(item.key, item.expiresAt)
+			}
+		}
+		return 0, err
+	}
+
+	return batch.Len(), nil
+}
+
+// setExpiry rewrites the record of key with a new expiry, the caller must hold the lock
+func (db *DataStructure) setExpiry(key []byte, expiresAt int64) error {
+	now := time.Now().UnixMilli()
+
+	entry, ok := db.liveEntry(string(key), now)
+	if !ok {
+		return ErrKeyNotFound
+	}
+
+	if entry.expiresAt == expiresAt {
+		return nil // nothing changes
+	}
+
+	if expired(expiresAt, now) {
+		return db.writeBatch(&Batch{ops: []batchOp{{key: key, delete: true}}})
+	}
+
+	_, value, err := db.readDataRecord(entry.offset)
+	if err != nil {
+		return err
+	}
+
+	return db.writeBatch(&Batch{ops: []batchOp{{key: key, value: value, expiresAt: expiresAt, valueType: entry.valueType}}})
+}
+
+// expireKey deletes key if it has expired and returns ErrKeyNotFound
+func (db *DataStructure) expireKey(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Someone else may have written the key since it was found expired
+	if entry, ok := db.index[string(key)]; ok && expired(entry.expiresAt, time.Now().UnixMilli()) {
+		if err := db.writeBatch(&Batch{ops: []batchOp{{key: key, delete: true}}}); err != nil {
+			return err
+		}
+	}
+
+	return ErrKeyNotFound
+}
+
+// liveEntry returns the index entry of key unless the key is missing, expired by now or an element of a
+// collection, the caller must hold the lock
+func (db *DataStructure) liveEntry(key string, now int64) (indexEntry, bool) {
+	entry, ok := db.index[key]
+	if !ok || expired(entry.expiresAt, now) || reservedKey(key) {
+		return indexEntry{}, false
+	}
+
+	return entry, true
+}
+
+// expiryQueue is a min-heap of the keys with an expiry, soonest first, so expired keys are found without walking
+// every key that has an expiry
+type expiryQueue struct {
+	items     []expiryItem
+	positions map[string]int // Position of each key in items
+}
+
+// expiryItem is a key in the expiry queue and the time it expires at
+type expiryItem struct {
+	key       string
+	expiresAt int64
+}
+
+// newExpiryQueue creates an empty expiry queue
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{positions: make(map[string]int)}
+}
+
+// set adds key to the queue, or moves it if it is already queued
+func (q *expiryQueue) set(key string, expiresAt int64) {
+	if i, ok := q.positions[key]; ok {
+		q.items[i].expiresAt = expiresAt
+		heap.Fix(q, i)
+		return
+	}
+
+	heap.Push(q, expiryItem{key: key, expiresAt: expiresAt})
+}
+
+// remove takes key out of the queue if it is queued
+func (q *expiryQueue) remove(key string) {
+	if i, ok := q.positions[key]; ok {
+		heap.Remove(q, i)
+	}
+}
+
+// Len returns the number of queued keys
+func (q *expiryQueue) Len() int { return len(q.items) }
+
+// Less orders the keys soonest expiry first
+func (q *expiryQueue) Less(i, j int) bool { return q.items[i].expiresAt < q.items[j].expiresAt }
+
+// Swap swaps two keys and their positions
+func (q *expiryQueue) Swap(i, j int) {
+	q.items[i], q.items[j] = q.items[j], q.items[i]
+	q.positions[q.items[i].key] = i
+	q.positions[q.items[j].key] = j
+}
+
+// Push adds a key, use heap.Push
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(expiryItem)
+	q.positions[item.key] = len(q.items)
+	q.items = append(q.items, item)
+}
+
+// Pop removes the last key, use heap.Pop
+func (q *expiryQueue) Pop() interface{} {
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	delete(q.positions, item.key)
+	return item
+}
@@ -0,0 +1,537 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Full-text indexes are inverted indexes over the string values of the keys with a prefix.  Like secondary
+// indexes their definitions are stored in a file next to the data file and the indexes are loaded from the index
+// contents file when the DB is opened, or built from the data file if it is out of date.  Results are ranked
+// with BM25
+const (
+	textIndexExtension = ".ftx" // Extension of the full-text index definitions file next to the data file
+
+	bm25K1 = 1.2  // BM25 term frequency saturation
+	bm25B  = 0.75 // BM25 document length normalization
+)
+
+// SearchResult is a key matching a full-text query and its BM25 score
+type SearchResult struct {
+	Key   []byte
+	Score float64
+}
+
+// textIndex is a full-text index over the values of the keys with a prefix
+type textIndex struct {
+	Name        string                      // Name of the index
+	Prefix      string                      // Prefix of the indexed keys
+	postings    map[string]map[string][]int // Positions of each term by key
+	terms       map[string][]string         // Distinct terms by key
+	lengths     map[string]int              // Number of terms by key
+	totalLength int                         // Number of terms of every indexed value
+}
+
+// queryNode is a node of a parsed full-text query
+type queryNode struct {
+	op       string      // term, phrase, and or or
+	terms    []string    // Terms of a term or phrase
+	children []queryNode // Operands of and and or
+}
+
+// CreateTextIndex creates a full-text index over the string values of the keys with prefix and indexes the values
+// already stored.  The index is kept up to date on every write
+func (db *DataStructure) CreateTextIndex(name string, prefix []byte) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("bad index name %q", name)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.textIndexes[name]; ok {
+		return ErrIndexExists
+	}
+
+	index := &textIndex{Name: name, Prefix: string(prefix)}
+	if err := db.buildTextIndex(index); err != nil {
+		return err
+	}
+
+	db.textIndexes[name] = index
+
+	if err := db.writeTextIndexes(); err != nil {
+		delete(db.textIndexes, name)
+		return err
+	}
+
+	return nil
+}
+
+// Search returns up to limit keys of the full-text index name matching query, best match first.  A limit of 0
+// returns every match.  Terms separated by spaces must all match, OR matches either side, AND may be written out,
+// quotes match a phrase and parentheses group, e.g. wireless AND (mouse OR "track pad")
+func (db *DataStructure) Search(name, query string, limit int) ([]SearchResult, error) {
+	root, err := parseTextQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	index, ok := db.textIndexes[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+
+	now := time.Now().UnixMilli()
+
+	// Every term of the query counts towards the score of a match
+	terms := make(map[string]struct{})
+	root.collectTerms(terms)
+
+	results := make([]SearchResult, 0)
+	for key := range index.match(root) {
+		// Expired keys stay indexed until they are deleted
+		if _, ok := db.liveEntry(key, now); !ok {
+			continue
+		}
+
+		results = append(results, SearchResult{Key: []byte(key), Score: index.score(key, terms)})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return bytes.Compare(results[i].Key, results[j].Key) < 0
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// indexText updates every full-text index for a record written to the data file, the caller must hold the lock
+func (db *DataStructure) indexText(record dataRecord) {
+	for _, index := range db.textIndexes {
+		if !strings.HasPrefix(string(record.key), index.Prefix) {
+			continue
+		}
+
+		index.remove(string(record.key))
+
+		if !record.tombstone && record.valueType == TypeString {
+			index.add(string(record.key), record.value)
+		}
+	}
+}
+
+// loadTextIndexes reads the full-text index definitions and builds the indexes
+func (db *DataStructure) loadTextIndexes() error {
+	data, err := os.ReadFile(siblingFilename(db.dataFilename, textIndexExtension))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var indexes []*textIndex
+	if err := json.Unmarshal(data, &indexes); err != nil {
+		return fmt.Errorf("corrupted full-text index definitions: %w", err)
+	}
+
+	// Contents written for the data file as it is now save reading and tokenizing every value
+	var contents map[string]*textIndex
+	payload, ok, err := db.readIndexContents(textContentsExtension)
+	if err != nil {
+		return err
+	}
+	if ok {
+		contents, _ = decodeTextContents(payload) // malformed contents are rebuilt
+	}
+
+	for _, index := range indexes {
+		if restored, ok := contents[index.Name]; ok {
+			index.postings, index.terms, index.lengths, index.totalLength = restored.postings, restored.terms, restored.lengths, restored.totalLength
+		} else if err := db.buildTextIndex(index); err != nil {
+			return err
+		}
+
+		db.textIndexes[index.Name] = index
+	}
+
+	return nil
+}
+
+// writeTextIndexes replaces the full-text index definitions and contents files, the caller must hold the lock
+func (db *DataStructure) writeTextIndexes() error {
+	indexes := make([]*textIndex, 0, len(db.textIndexes))
+	for _, index := range db.textIndexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].Name < indexes[j].Name
+	})
+
+	data, err := json.Marshal(indexes)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(siblingFilename(db.dataFilename, textIndexExtension), data); err != nil {
+		return err
+	}
+
+	return db.writeIndexContents(textContentsExtension, db.encodeTextContents())
+}
+
+// buildTextIndex indexes the value of every key with the prefix of the index, the caller must hold the lock
+func (db *DataStructure) buildTextIndex(index *textIndex) error {
+	index.reset()
+
+	for key, entry := range db.index {
+		if entry.valueType != TypeString || !strings.HasPrefix(key, index.Prefix) {
+			continue
+		}
+
+		_, value, err := db.readDataRecord(entry.offset)
+		if err != nil {
+			return err
+		}
+
+		index.add(key, value)
+	}
+
+	return nil
+}
+
+// tokenize splits text into lowercase terms of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// reset empties the index
+func (index *textIndex) reset() {
+	index.postings = make(map[string]map[string][]int)
+	index.terms = make(map[string][]string)
+	index.lengths = make(map[string]int)
+	index.totalLength = 0
+}
+
+// add indexes the value of key
+func (index *textIndex) add(key string, value []byte) {
+	tokens := tokenize(string(value))
+	if len(tokens) == 0 {
+		return
+	}
+
+	for position, term := range tokens {
+		if index.postings[term] == nil {
+			index.postings[term] = make(map[string][]int)
+		}
+
+		if len(index.postings[term][key]) == 0 {
+			index.terms[key] = append(index.terms[key], term)
+		}
+
+		index.postings[term][key] = append(index.postings[term][key], position)
+	}
+
+	index.lengths[key] = len(tokens)
+	index.totalLength += len(tokens)
+}
+
+// remove removes key from the index
+func (index *textIndex) remove(key string) {
+	for _, term := range index.terms[key] {
+		delete(index.postings[term], key)
+		if len(index.postings[term]) == 0 {
+			delete(index.postings, term)
+		}
+	}
+
+	index.totalLength -= index.lengths[key]
+	delete(index.terms, key)
+	delete(index.lengths, key)
+}
+
+// match returns the keys matching node
+func (index *textIndex) match(node queryNode) map[string]struct{} {
+	keys := make(map[string]struct{})
+
+	switch node.op {
+	case "term":
+		for key := range index.postings[node.terms[0]] {
+			keys[key] = struct{}{}
+		}
+	case "phrase":
+		// Keys with the first term whose other terms follow it somewhere
+		for key, positions := range index.postings[node.terms[0]] {
+			for _, position := range positions {
+				if index.phraseAt(key, node.terms, position) {
+					keys[key] = struct{}{}
+					break
+				}
+			}
+		}
+	case "and":
+		keys = index.match(node.children[0])
+		for _, child := range node.children[1:] {
+			matches := index.match(child)
+			for key := range keys {
+				if _, ok := matches[key]; !ok {
+					delete(keys, key)
+				}
+			}
+		}
+	case "or":
+		for _, child := range node.children {
+			for key := range index.match(child) {
+				keys[key] = struct{}{}
+			}
+		}
+	}
+
+	return keys
+}
+
+// phraseAt reports whether the value of key has the terms one after another starting at position
+func (index *textIndex) phraseAt(key string, terms []string, position int) bool {
+	for i, term := range terms[1:] {
+		positions := index.postings[term][key]
+
+		// Positions are in ascending order
+		j := sort.SearchInts(positions, position+i+1)
+		if j == len(positions) || positions[j] != position+i+1 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// score returns the BM25 score of the value of key for terms
+func (index *textIndex) score(key string, terms map[string]struct{}) float64 {
+	documents := float64(len(index.lengths))
+	averageLength := float64(index.totalLength) / documents
+	length := float64(index.lengths[key])
+
+	var score float64
+	for term := range terms {
+		frequency := float64(len(index.postings[term][key]))
+		if frequency == 0 {
+			continue
+		}
+
+		matching := float64(len(index.postings[term]))
+		idf := math.Log(1 + (documents-matching+0.5)/(matching+0.5))
+
+		score += idf * frequency * (bm25K1 + 1) / (frequency + bm25K1*(1-bm25B+bm25B*length/averageLength))
+	}
+
+	return score
+}
+
+// collectTerms adds every term of the query to terms
+func (node queryNode) collectTerms(terms map[string]struct{}) {
+	for _, term := range node.terms {
+		terms[term] = struct{}{}
+	}
+
+	for _, child := range node.children {
+		child.collectTerms(terms)
+	}
+}
+
+// parseTextQuery parses a full-text query.
+//
+//	query  = and { "OR" and }
+//	and    = operand { [ "AND" ] operand }
+//	operand = word | "\"" phrase "\"" | "(" query ")"
+func parseTextQuery(query string) (queryNode, error) {
+	tokens, err := lexTextQuery(query)
+	if err != nil {
+		return queryNode{}, err
+	}
+
+	if len(tokens) == 0 {
+		return queryNode{}, fmt.Errorf("bad query %q: empty", query)
+	}
+
+	parser := &textQueryParser{query: query, tokens: tokens}
+
+	node, err := parser.parseOr()
+	if err != nil {
+		return queryNode{}, err
+	}
+
+	if parser.pos < len(tokens) {
+		return queryNode{}, fmt.Errorf("bad query %q: unexpected %s", query, tokens[parser.pos])
+	}
+
+	return node, nil
+}
+
+// lexTextQuery splits a full-text query into words, quoted phrases and parentheses.  Phrases keep their quotes
+func lexTextQuery(query string) ([]string, error) {
+	var tokens []string
+
+	for pos := 0; pos < len(query); {
+		switch c := query[pos]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			pos++
+		case c == '(' || c == ')':
+			tokens = append(tokens, query[pos:pos+1])
+			pos++
+		case c == '"':
+			end := strings.IndexByte(query[pos+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("bad query %q: unclosed quote at %d", query, pos)
+			}
+
+			tokens = append(tokens, query[pos:pos+end+2])
+			pos += end + 2
+		default:
+			end := pos
+			for end < len(query) && !strings.ContainsRune(" \t\r\n()\"", rune(query[end])) {
+				end++
+			}
+
+			tokens = append(tokens, query[pos:end])
+			pos = end
+		}
+	}
+
+	return tokens, nil
+}
+
+// textQueryParser is a recursive descent parser of full-text queries
+type textQueryParser struct {
+	query  string
+	tokens []string
+	pos    int
+}
+
+// parseOr parses operands joined by OR
+func (p *textQueryParser) parseOr() (queryNode, error) {
+	node, err := p.parseAnd()
+	if err != nil {
+		return queryNode{}, err
+	}
+
+	children := []queryNode{node}
+	for p.pos < len(p.tokens) && p.tokens[p.pos] == "OR" {
+		p.pos++
+
+		node, err := p.parseAnd()
+		if err != nil {
+			return queryNode{}, err
+		}
+
+		children = append(children, node)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+
+	return queryNode{op: "or", children: children}, nil
+}
+
+// parseAnd parses operands joined by AND or nothing
+func (p *textQueryParser) parseAnd() (queryNode, error) {
+	node, err := p.parseOperand()
+	if err != nil {
+		return queryNode{}, err
+	}
+
+	children := []queryNode{node}
+	for p.pos < len(p.tokens) && p.tokens[p.pos] != "OR" && p.tokens[p.pos] != ")" {
+		if p.tokens[p.pos] == "AND" {
+			p.pos++
+		}
+
+		node, err := p.parseOperand()
+		if err != nil {
+			return queryNode{}, err
+		}
+
+		children = append(children, node)
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+
+	return queryNode{op: "and", children: children}, nil
+}
+
+// parseOperand parses a word, phrase or parenthesized query
+func (p *textQueryParser) parseOperand() (queryNode, error) {
+	if p.pos >= len(p.tokens) {
+		return queryNode{}, fmt.Errorf("bad query %q: unexpected end", p.query)
+	}
+
+	token := p.tokens[p.pos]
+	p.pos++
+
+	switch {
+	case token == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return queryNode{}, err
+		}
+
+		if p.pos >= len(p.tokens) || p.tokens[p.pos] != ")" {
+			return queryNode{}, fmt.Errorf("bad query %q: unclosed (", p.query)
+		}
+		p.pos++
+
+		return node, nil
+	case token == ")" || token == "AND" || token == "OR":
+		return queryNode{}, fmt.Errorf("bad query %q: unexpected %s", p.query, token)
+	}
+
+	// Words are tokenized like values, a word that splits into several terms is a phrase
+	terms := tokenize(strings.Trim(token, `"`))
+	switch {
+	case len(terms) == 0:
+		return queryNode{}, fmt.Errorf("bad query %q: %s has no terms", p.query, token)
+	case len(terms) == 1:
+		return queryNode{op: "term", terms: terms}, nil
+	}
+
+	return queryNode{op: "phrase", terms: terms}, nil
+}
@@ -0,0 +1,260 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"sort"
+)
+
+// Geo sets are sorted sets whose scores are 52 bit geohashes of the position of each member, 26 bits of longitude
+// interleaved with 26 bits of latitude.  Nearby positions mostly share a prefix, so a radius query reads the score
+// ranges of the few geohash cells around the center instead of the whole set
+const (
+	geoStep         = 26           // Bits of each coordinate in a geohash
+	geoMinLatitude  = -85.05112878 // Latitudes are limited like web mercator maps, the poles are left out
+	geoMaxLatitude  = 85.05112878
+	geoMinLongitude = -180.0
+	geoMaxLongitude = 180.0
+
+	earthRadius = 6372797.560856 // Meters, as used for haversine distances
+)
+
+// ErrBadCoordinates is returned for a longitude or latitude outside of the range geo sets can hold
+var ErrBadCoordinates = errors.New("coordinates out of range")
+
+// GeoMember is a member of a geo set and its position
+type GeoMember struct {
+	Member    []byte
+	Longitude float64
+	Latitude  float64
+}
+
+// GeoResult is a member found by a radius query, its position and its distance from the center in meters
+type GeoResult struct {
+	GeoMember
+	Distance float64
+}
+
+// GeoAdd adds members to the geo set at key, or moves them if they are already in it, and returns how many members
+// were added.  Longitudes range from -180 to 180 and latitudes from -85.05112878 to 85.05112878
+func (db *DataStructure) GeoAdd(key []byte, members ...GeoMember) (int, error) {
+	scored := make([]ScoredMember, len(members))
+	for i, member := range members {
+		if !validCoordinates(member.Longitude, member.Latitude) {
+			return 0, ErrBadCoordinates
+		}
+
+		scored[i] = ScoredMember{Member: member.Member, Score: float64(geohashEncode(member.Longitude, member.Latitude, geoStep))}
+	}
+
+	return db.ZAdd(key, scored...)
+}
+
+// GeoDist returns the distance in meters between two members of the geo set at key
+func (db *DataStructure) GeoDist(key, member1, member2 []byte) (float64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	score1, ok1, err := db.zsetScore(key, member1)
+	if err != nil {
+		return 0, err
+	}
+
+	score2, ok2, err := db.zsetScore(key, member2)
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok1 || !ok2 {
+		return 0, ErrKeyNotFound
+	}
+
+	longitude1, latitude1 := geohashDecode(uint64(score1))
+	longitude2, latitude2 := geohashDecode(uint64(score2))
+
+	return geoDistance(longitude1, latitude1, longitude2, latitude2), nil
+}
+
+// GeoRadius returns the members of the geo set at key within radius meters of the position, nearest first
+func (db *DataStructure) GeoRadius(key []byte, longitude, latitude, radius float64) ([]GeoResult, error) {
+	if !validCoordinates(longitude, latitude) || math.IsNaN(radius) || radius < 0 {
+		return nil, ErrBadCoordinates
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, _, exists, err := db.openCollection(key, TypeZSet)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var results []GeoResult
+	for _, cell := range geohashCells(longitude, latitude, radius) {
+		members, err := db.rangeByScore(key, float64(cell[0]), float64(cell[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, member := range members {
+			memberLongitude, memberLatitude := geohashDecode(uint64(member.Score))
+
+			distance := geoDistance(longitude, latitude, memberLongitude, memberLatitude)
+			if distance > radius {
+				continue
+			}
+
+			results = append(results, GeoResult{
+				GeoMember: GeoMember{Member: append([]byte(nil), member.Member...), Longitude: memberLongitude, Latitude: memberLatitude},
+				Distance:  distance,
+			})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance != results[j].Distance {
+			return results[i].Distance < results[j].Distance
+		}
+		return bytes.Compare(results[i].Member, results[j].Member) < 0
+	})
+
+	return results, nil
+}
+
+// validCoordinates reports whether a position can be stored in a geo set
+func validCoordinates(longitude, latitude float64) bool {
+	return longitude >= geoMinLongitude && longitude <= geoMaxLongitude && latitude >= geoMinLatitude && latitude <= geoMaxLatitude
+}
+
+// geohashCell returns the cell a coordinate falls in when its range is split into 2^step cells
+func geohashCell(value, min, max float64, step uint) uint64 {
+	cells := uint64(1) << step
+
+	cell := uint64((value - min) / (max - min) * float64(cells))
+	if cell >= cells {
+		cell = cells - 1 // the maximum belongs to the last cell
+	}
+
+	return cell
+}
+
+// geohashEncode returns the geohash of a position with step bits for each coordinate
+func geohashEncode(longitude, latitude float64, step uint) uint64 {
+	return interleave(
+		geohashCell(longitude, geoMinLongitude, geoMaxLongitude, step),
+		geohashCell(latitude, geoMinLatitude, geoMaxLatitude, step),
+		step,
+	)
+}
+
+// geohashDecode returns the center of the cell of a geohash with geoStep bits for each coordinate
+func geohashDecode(hash uint64) (float64, float64) {
+	lonCell, latCell := deinterleave(hash, geoStep)
+
+	cells := float64(uint64(1) << geoStep)
+	longitude := geoMinLongitude + (float64(lonCell)+0.5)/cells*(geoMaxLongitude-geoMinLongitude)
+	latitude := geoMinLatitude + (float64(latCell)+0.5)/cells*(geoMaxLatitude-geoMinLatitude)
+
+	return longitude, latitude
+}
+
+// interleave interleaves the step bits of the longitude and latitude cells, longitude taking the higher bit of each pair
+func interleave(lonCell, latCell uint64, step uint) uint64 {
+	var hash uint64
+	for i := int(step) - 1; i >= 0; i-- {
+		hash = hash<<2 | (lonCell>>uint(i)&1)<<1 | latCell>>uint(i)&1
+	}
+
+	return hash
+}
+
+// deinterleave splits a geohash with step bits for each coordinate into its longitude and latitude cells
+func deinterleave(hash uint64, step uint) (uint64, uint64) {
+	var lonCell, latCell uint64
+	for i := int(step) - 1; i >= 0; i-- {
+		lonCell = lonCell<<1 | hash>>uint(2*i+1)&1
+		latCell = latCell<<1 | hash>>uint(2*i)&1
+	}
+
+	return lonCell, latCell
+}
+
+// geohashCells returns the score ranges, both inclusive, of the geohash cells that cover the circle of radius meters
+// around the position.  Cells are picked as small as possible while still at least radius wide and high, so the cell
+// of the center and its eight neighbours cover the circle
+func geohashCells(longitude, latitude, radius float64) [][2]uint64 {
+	// Cells are narrowest at the latitude of the circle farthest from the equator
+	edgeLatitude := math.Min(math.Abs(latitude)+radius/earthRadius*180/math.Pi, 90)
+
+	step := uint(geoStep)
+	for ; step > 1; step-- {
+		cells := float64(uint64(1) << step)
+		height := (geoMaxLatitude - geoMinLatitude) / cells * math.Pi / 180 * earthRadius
+		width := (geoMaxLongitude - geoMinLongitude) / cells * math.Pi / 180 * earthRadius * math.Cos(edgeLatitude*math.Pi/180)
+
+		if height >= radius && width >= radius {
+			break
+		}
+	}
+
+	lonCell := int64(geohashCell(longitude, geoMinLongitude, geoMaxLongitude, step))
+	latCell := int64(geohashCell(latitude, geoMinLatitude, geoMaxLatitude, step))
+	cells := int64(1) << step
+
+	// Scores of a cell at step span every geohash of its cells at geoStep
+	shift := 2 * (geoStep - step)
+
+	var ranges [][2]uint64
+	seen := make(map[uint64]bool)
+	for dLat := int64(-1); dLat <= 1; dLat++ {
+		for dLon := int64(-1); dLon <= 1; dLon++ {
+			lat := latCell + dLat
+			if lat < 0 || lat >= cells {
+				continue
+			}
+
+			// Longitudes wrap around
+			lon := (lonCell + dLon + cells) % cells
+
+			hash := interleave(uint64(lon), uint64(lat), step)
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+
+			ranges = append(ranges, [2]uint64{hash << shift, (hash+1)<<shift - 1})
+		}
+	}
+
+	return ranges
+}
+
+// geoDistance returns the haversine distance in meters between two positions
+func geoDistance(longitude1, latitude1, longitude2, latitude2 float64) float64 {
+	lat1 := latitude1 * math.Pi / 180
+	lat2 := latitude2 * math.Pi / 180
+	u := math.Sin((lat2 - lat1) / 2)
+	v := math.Sin((longitude2 - longitude1) * math.Pi / 180 / 2)
+
+	return 2 * earthRadius * math.Asin(math.Sqrt(u*u+math.Cos(lat1)*math.Cos(lat2)*v*v))
+}
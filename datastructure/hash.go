@@ -0,0 +1,111 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+// HashField is a field of a hash and its value
+type HashField struct {
+	Field []byte
+	Value []byte
+}
+
+// HSet sets field of the hash at key to value and reports whether the field is new.
+// A missing key is created as an empty hash first.  Only the field and the size of the hash are written
+func (db *DataStructure) HSet(key, field, value []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, meta, exists, err := db.openCollection(key, TypeHash)
+	if err != nil {
+		return false, err
+	}
+
+	var count int
+	if exists {
+		if count, err = decodeCount(meta); err != nil {
+			return false, err
+		}
+	}
+
+	// A field of a hash that expired is gone along with the hash
+	_, found := db.index[string(elementKey(key, familyHashField, field))]
+	created := !exists || !found
+	if created {
+		count++
+	}
+
+	if err := db.writeCollection(key, TypeHash, entry, encodeCount(count), []batchOp{putElement(key, TypeHash, familyHashField, field, value)}); err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
+
+// HGet retrieves the value of field of the hash at key
+func (db *DataStructure) HGet(key, field []byte) ([]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, _, exists, err := db.openCollection(key, TypeHash)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	value, found, err := db.element(elementKey(key, familyHashField, field))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrKeyNotFound
+	}
+
+	return value, nil
+}
+
+// HGetAll returns every field of the hash at key with its value, in ascending order of field
+func (db *DataStructure) HGetAll(key []byte) ([]HashField, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, _, exists, err := db.openCollection(key, TypeHash)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var fields []HashField
+
+	prefix := elementPrefix(key, familyHashField)
+	err = db.walkElements(prefix, prefix, func(field []byte, entry indexEntry) (bool, error) {
+		_, value, err := db.readDataRecord(entry.offset)
+		if err != nil {
+			return false, err
+		}
+
+		fields = append(fields, HashField{Field: field, Value: value})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,246 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Index file format
+//
+// Header
+// - `Magic` 4 bytes - "CHIX"
+// - `Version` 2 bytes (uint16)
+//
+// Entries, appended one after another.  The last entry for a key wins.
+// - `Key Length` 4 bytes (uint32)
+// - `Offset` 8 bytes (int64) - Offset of the data record in the data file
+// - `Flags` 1 byte - See indexFlag* constants
+// - `Key` Variable-length byte array
+const (
+	indexMagic           = "CHIX"    // Index file magic
+	indexVersion         = 1         // Current index file format version
+	indexHeaderSize      = 4 + 2     // Magic and version
+	indexEntryHeaderSize = 4 + 8 + 1 // Key length, offset and flags
+
+	indexFlagDeleted uint8 = 1 << 0 // Entry removes the key from the index
+)
+
+// loadIndex reads every entry of the index file into the in-memory index.
+// Index files written before the versioned format existed are migrated
+func (db *DataStructure) loadIndex() error {
+	indexData, err := io.ReadAll(io.NewSectionReader(db.indexFile, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+
+	// A new index file only needs a header
+	if len(indexData) == 0 {
+		return db.writeIndex()
+	}
+
+	// No magic means this is a legacy index file
+	if !bytes.HasPrefix(indexData, []byte(indexMagic)) {
+		// A legacy index next to an upgraded data file means the upgrade was interrupted
+		if db.formatVersion > 0 {
+			return db.rebuildIndex()
+		}
+
+		if err := db.loadLegacyIndex(indexData); err != nil {
+			return err
+		}
+
+		// Rewrite the index in the current format
+		if err := db.writeIndex(); err != nil {
+			return err
+		}
+
+		return db.checkIndex()
+	}
+
+	if len(indexData) < indexHeaderSize {
+		return fmt.Errorf("corrupted index header")
+	}
+
+	version := binary.LittleEndian.Uint16(indexData[len(indexMagic):])
+	if version != indexVersion {
+		return fmt.Errorf("unsupported index version %d", version)
+	}
+
+	pos := indexHeaderSize
+	for pos < len(indexData) {
+		// A partially written entry at the tail is dropped
+		if pos+indexEntryHeaderSize > len(indexData) {
+			break
+		}
+
+		keyLength := int(binary.LittleEndian.Uint32(indexData[pos:]))
+		offset := int64(binary.LittleEndian.Uint64(indexData[pos+4:]))
+		flags := indexData[pos+12]
+
+		if pos+indexEntryHeaderSize+keyLength > len(indexData) {
+			break
+		}
+
+		key := indexData[pos+indexEntryHeaderSize : pos+indexEntryHeaderSize+keyLength]
+
+		// Record sizes and versions are filled in by checkIndex
+		db.setIndexEntry(offset, dataRecord{key: key, tombstone: flags&indexFlagDeleted != 0})
+
+		pos += indexEntryHeaderSize + keyLength
+	}
+
+	// Cut off a torn entry so new entries are appended after the last complete one
+	if pos < len(indexData) {
+		if err := db.indexFile.Truncate(int64(pos)); err != nil {
+			return err
+		}
+	}
+	db.indexSize = int64(pos)
+
+	return db.checkIndex()
+}
+
+// loadLegacyIndex loads an index file that has no header.
+// Legacy entries are the raw key followed by the int64 offset of its data record.  The key length
+// is not stored, so for each entry we find the length whose offset points at a data record holding the same key
+func (db *DataStructure) loadLegacyIndex(indexData []byte) error {
+	offsetSize := binary.Size(int64(0))
+
+	for pos := 0; pos < len(indexData); {
+		found := false
+
+		for keyLength := 0; pos+keyLength+offsetSize <= len(indexData); keyLength++ {
+			key := indexData[pos : pos+keyLength]
+			offset := int64(binary.LittleEndian.Uint64(indexData[pos+keyLength:]))
+
+			// Offset must point inside the data file
+			if offset < 0 || offset >= db.nextOffset {
+				continue
+			}
+
+			record, err := db.readRecordHeader(offset)
+			if err != nil || !bytes.Equal(record.key, key) {
+				continue
+			}
+
+			db.setIndexEntry(offset, dataRecord{key: key, valueType: record.valueType, version: record.version, expiresAt: record.expiresAt})
+			pos += keyLength + offsetSize
+			found = true
+			break
+		}
+
+		if !found {
+			return fmt.Errorf("corrupted index entry at offset %d", pos)
+		}
+	}
+
+	return nil
+}
+
+// encodeIndexEntry appends an encoded index entry to buf
+func encodeIndexEntry(buf []byte, key []byte, offset int64, flags uint8) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(key)))
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(offset))
+	buf = append(buf, flags)
+	return append(buf, key...)
+}
+
+// appendIndexEntry appends an entry to the end of the index file
+func (db *DataStructure) appendIndexEntry(key []byte, offset int64, flags uint8) error {
+	entry := encodeIndexEntry(nil, key, offset, flags)
+
+	if _, err := db.indexFile.WriteAt(entry, db.indexSize); err != nil {
+		return err
+	}
+
+	db.indexSize += int64(len(entry))
+
+	return nil
+}
+
+// writeIndex rewrites the index file with the contents of the in-memory index.
+// The new index is written to a temporary file which then replaces the index file
+func (db *DataStructure) writeIndex() error {
+	// Initialize a buffer to store the updated index data
+	updatedIndex := append([]byte(indexMagic), 0, 0)
+	binary.LittleEndian.PutUint16(updatedIndex[len(indexMagic):], indexVersion)
+
+	for key, entry := range db.index {
+		updatedIndex = encodeIndexEntry(updatedIndex, []byte(key), entry.offset, 0)
+	}
+
+	tmpFilename := db.indexFilename + ".tmp"
+	if err := writeFileSync(tmpFilename, updatedIndex); err != nil {
+		return err
+	}
+
+	// Swap the temporary file in
+	if err := db.indexFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFilename, db.indexFilename); err != nil {
+		return err
+	}
+
+	indexFile, err := os.OpenFile(db.indexFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	db.indexFile = indexFile
+	db.indexSize = int64(len(updatedIndex))
+	return nil
+}
+
+// writeFileSync writes data to the named file and flushes it to stable storage
+func writeFileSync(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// writeFileAtomic replaces the contents of filename with data.  The data is written to a temporary file with
+// writeFileSync and renamed over the old one so a crash never leaves it half written
+func writeFileAtomic(filename string, data []byte) error {
+	if err := writeFileSync(filename+".tmp", data); err != nil {
+		return err
+	}
+
+	return os.Rename(filename+".tmp", filename)
+}
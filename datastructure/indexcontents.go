@@ -0,0 +1,302 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"sort"
+)
+
+// Index contents file format
+//
+// Secondary and full-text indexes are kept in memory.  Their contents are written next to the data file when the
+// DB is closed or an index is created, so opening the DB can load them instead of reading and decoding every
+// value in the data file.  The file is only used while the data file is exactly as it was when the file was
+// written, every write moves the sequence and the end of the data file so anything else rebuilds the indexes.
+//
+// Header
+// - `Magic` 4 bytes - "CHIC"
+// - `Version` 2 bytes (uint16)
+// - `Sequence` 8 bytes (uint64) - Sequence of the DB when the file was written
+// - `Offset` 8 bytes (int64) - End of the data file when the file was written
+// - `Checksum` 4 bytes (uint32) - CRC32C of the payload
+//
+// Payload, for every index
+// - `Name` uvarint length and bytes
+// - `Keys` uvarint count, then for each key its uvarint length and bytes followed by what the index holds for it
+const (
+	indexContentsMagic      = "CHIC" // Index contents magic
+	indexContentsVersion    = 1      // Current index contents format version
+	indexContentsHeaderSize = 4 + 2 + 8 + 8 + 4
+
+	secondaryContentsExtension = ".sidc" // Extension of the secondary index contents next to the data file
+	textContentsExtension      = ".ftc"  // Extension of the full-text index contents next to the data file
+)
+
+// errBadIndexContents is returned when decoding an index contents payload that is cut short
+var errBadIndexContents = errors.New("malformed index contents")
+
+// writeIndexContents writes the index contents file with extension ext, the caller must hold the lock
+func (db *DataStructure) writeIndexContents(ext string, payload []byte) error {
+	data := append([]byte(indexContentsMagic), make([]byte, indexContentsHeaderSize-len(indexContentsMagic))...)
+	binary.LittleEndian.PutUint16(data[4:], indexContentsVersion)
+	binary.LittleEndian.PutUint64(data[6:], db.sequence)
+	binary.LittleEndian.PutUint64(data[14:], uint64(db.nextOffset))
+	binary.LittleEndian.PutUint32(data[22:], crc32.Checksum(payload, crcTable))
+
+	return writeFileAtomic(siblingFilename(db.dataFilename, ext), append(data, payload...))
+}
+
+// readIndexContents returns the payload of the index contents file with extension ext.  It returns false if the
+// file is missing, damaged or was written for another state of the data file
+func (db *DataStructure) readIndexContents(ext string) ([]byte, bool, error) {
+	data, err := os.ReadFile(siblingFilename(db.dataFilename, ext))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if len(data) < indexContentsHeaderSize || string(data[:4]) != indexContentsMagic {
+		return nil, false, nil
+	}
+
+	if binary.LittleEndian.Uint16(data[4:]) != indexContentsVersion ||
+		binary.LittleEndian.Uint64(data[6:]) != db.sequence ||
+		int64(binary.LittleEndian.Uint64(data[14:])) != db.nextOffset {
+		return nil, false, nil
+	}
+
+	payload := data[indexContentsHeaderSize:]
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(data[22:]) {
+		return nil, false, nil
+	}
+
+	return payload, true, nil
+}
+
+// writeIndexesContents writes the contents of the secondary and full-text indexes, the caller must hold the lock
+func (db *DataStructure) writeIndexesContents() error {
+	if len(db.secondaryIndexes) > 0 {
+		if err := db.writeIndexContents(secondaryContentsExtension, db.encodeSecondaryContents()); err != nil {
+			return err
+		}
+	}
+
+	if len(db.textIndexes) > 0 {
+		return db.writeIndexContents(textContentsExtension, db.encodeTextContents())
+	}
+
+	return nil
+}
+
+// encodeSecondaryContents encodes the indexed value of every key of every secondary index
+func (db *DataStructure) encodeSecondaryContents() []byte {
+	var payload []byte
+
+	for _, name := range sortedNames(db.secondaryIndexes) {
+		index := db.secondaryIndexes[name]
+
+		payload = appendContentsBytes(payload, []byte(name))
+		payload = binary.AppendUvarint(payload, uint64(len(index.value)))
+		for key, value := range index.value {
+			payload = appendContentsBytes(payload, []byte(key))
+			payload = appendContentsBytes(payload, []byte(value))
+		}
+	}
+
+	return payload
+}
+
+// decodeSecondaryContents decodes the secondary index contents by index name
+func decodeSecondaryContents(payload []byte) (map[string]map[string]string, error) {
+	contents := make(map[string]map[string]string)
+
+	for len(payload) > 0 {
+		name, count, rest, err := readContentsIndex(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = rest
+
+		values := make(map[string]string, count)
+		for i := uint64(0); i < count; i++ {
+			var key, value []byte
+			if key, payload, err = readContentsBytes(payload); err != nil {
+				return nil, err
+			}
+			if value, payload, err = readContentsBytes(payload); err != nil {
+				return nil, err
+			}
+
+			values[string(key)] = string(value)
+		}
+
+		contents[name] = values
+	}
+
+	return contents, nil
+}
+
+// encodeTextContents encodes the positions of the terms of every key of every full-text index
+func (db *DataStructure) encodeTextContents() []byte {
+	var payload []byte
+
+	for _, name := range sortedNames(db.textIndexes) {
+		index := db.textIndexes[name]
+
+		payload = appendContentsBytes(payload, []byte(name))
+		payload = binary.AppendUvarint(payload, uint64(len(index.terms)))
+		for key, terms := range index.terms {
+			payload = appendContentsBytes(payload, []byte(key))
+			payload = binary.AppendUvarint(payload, uint64(len(terms)))
+
+			for _, term := range terms {
+				payload = appendContentsBytes(payload, []byte(term))
+
+				positions := index.postings[term][key]
+				payload = binary.AppendUvarint(payload, uint64(len(positions)))
+				for _, position := range positions {
+					payload = binary.AppendUvarint(payload, uint64(position))
+				}
+			}
+		}
+	}
+
+	return payload
+}
+
+// decodeTextContents decodes the full-text index contents into empty indexes by index name
+func decodeTextContents(payload []byte) (map[string]*textIndex, error) {
+	contents := make(map[string]*textIndex)
+
+	for len(payload) > 0 {
+		name, count, rest, err := readContentsIndex(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = rest
+
+		index := &textIndex{}
+		index.reset()
+
+		for i := uint64(0); i < count; i++ {
+			var key []byte
+			var terms uint64
+			if key, payload, err = readContentsBytes(payload); err != nil {
+				return nil, err
+			}
+			if terms, payload, err = readContentsUvarint(payload); err != nil {
+				return nil, err
+			}
+
+			for j := uint64(0); j < terms; j++ {
+				var term []byte
+				var count uint64
+				if term, payload, err = readContentsBytes(payload); err != nil {
+					return nil, err
+				}
+				if count, payload, err = readContentsUvarint(payload); err != nil {
+					return nil, err
+				}
+
+				positions := make([]int, count)
+				for p := range positions {
+					var position uint64
+					if position, payload, err = readContentsUvarint(payload); err != nil {
+						return nil, err
+					}
+					positions[p] = int(position)
+				}
+
+				if index.postings[string(term)] == nil {
+					index.postings[string(term)] = make(map[string][]int)
+				}
+				index.postings[string(term)][string(key)] = positions
+				index.terms[string(key)] = append(index.terms[string(key)], string(term))
+				index.lengths[string(key)] += len(positions)
+				index.totalLength += len(positions)
+			}
+		}
+
+		contents[name] = index
+	}
+
+	return contents, nil
+}
+
+// sortedNames returns the names of indexes in ascending order
+func sortedNames[T any](indexes map[string]T) []string {
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// appendContentsBytes appends b with its uvarint length
+func appendContentsBytes(payload, b []byte) []byte {
+	payload = binary.AppendUvarint(payload, uint64(len(b)))
+	return append(payload, b...)
+}
+
+// readContentsIndex reads the name and key count that start the contents of an index
+func readContentsIndex(payload []byte) (string, uint64, []byte, error) {
+	name, payload, err := readContentsBytes(payload)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	count, payload, err := readContentsUvarint(payload)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	return string(name), count, payload, nil
+}
+
+// readContentsUvarint reads a uvarint and returns the rest of payload
+func readContentsUvarint(payload []byte) (uint64, []byte, error) {
+	value, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return 0, nil, errBadIndexContents
+	}
+
+	return value, payload[n:], nil
+}
+
+// readContentsBytes reads bytes written with appendContentsBytes and returns the rest of payload
+func readContentsBytes(payload []byte) ([]byte, []byte, error) {
+	length, payload, err := readContentsUvarint(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if uint64(len(payload)) < length {
+		return nil, nil, errBadIndexContents
+	}
+
+	return payload[:length], payload[length:], nil
+}
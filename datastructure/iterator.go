@@ -0,0 +1,220 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bytes"
+	"time"
+)
+
+// scanKeysBudget is how many keys ScanKeys examines per key it may return
+const scanKeysBudget = 10
+
+// Iterator walks the keys of the DB in ascending order.
+// Each step looks the next key up in the ordered index so writes made while iterating are safe.
+// An iterator created by Snapshot.NewIterator sees the keys as of the snapshot
+//
+//	it := db.NewIterator()
+//	defer it.Close()
+//	for ok := it.Seek([]byte("a")); ok; ok = it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+type Iterator struct {
+	db        *DataStructure
+	sequence  uint64    // Latest version the iterator sees
+	snapshot  *Snapshot // Snapshot the iterator reads from, nil for the latest state
+	key       []byte
+	value     []byte
+	valueType ValueType
+	valid     bool
+	started   bool // Whether the iterator has been positioned
+	err       error
+}
+
+// NewIterator creates an iterator over the DB.  Call Seek to position it or Next to start at the first key
+func (db *DataStructure) NewIterator() *Iterator {
+	return &Iterator{db: db, sequence: latestSequence}
+}
+
+// Seek positions the iterator at the first key greater than or equal to key and reports whether there is one
+func (it *Iterator) Seek(key []byte) bool {
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+
+	it.started = true
+	return it.load(it.db.keys.seek(string(key)))
+}
+
+// Next moves the iterator to the next key and reports whether there is one
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+
+	if !it.started {
+		it.started = true
+		return it.load(it.db.keys.first())
+	}
+
+	if !it.valid {
+		return false
+	}
+
+	// Find the first key after the current one
+	node := it.db.keys.seek(string(it.key))
+	if node != nil && node.key == string(it.key) {
+		node = node.next()
+	}
+
+	return it.load(node)
+}
+
+// load reads the record of the first key from node the iterator can see, the caller must hold the lock
+func (it *Iterator) load(node *skiplistNode) bool {
+	it.key, it.value, it.valueType, it.valid = nil, nil, TypeString, false
+
+	if it.snapshot != nil && it.snapshot.expired {
+		it.err = ErrSnapshotExpired
+		return false
+	}
+
+	// Skip keys created after the iterator's sequence, deleted before it or expired
+	now := time.Now().UnixMilli()
+
+	var offset int64
+	for node != nil {
+		// The elements of collections are not keys of their own, they are skipped all at once
+		if reservedKey(node.key) {
+			node = it.db.keys.seek(internalEnd)
+			continue
+		}
+
+		var ok bool
+		if offset, ok = it.db.lookup(node.key, it.sequence, now); ok {
+			break
+		}
+
+		node = node.next()
+	}
+
+	if node == nil {
+		return false
+	}
+
+	record, err := it.db.readRecord(offset)
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	it.key, it.value, it.valueType, it.valid = []byte(node.key), record.value, record.valueType, true
+	return true
+}
+
+// Valid reports whether the iterator is positioned at a key
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+// Key returns the key the iterator is positioned at
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the value of the key the iterator is positioned at.  Collections hold their elements in records
+// of their own, their value is only their metadata, see Type
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Type returns the type of the value of the key the iterator is positioned at
+func (it *Iterator) Type() ValueType {
+	return it.valueType
+}
+
+// Err returns the error that stopped the iterator, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator
+func (it *Iterator) Close() error {
+	it.key, it.value, it.valid = nil, nil, false
+	return it.err
+}
+
+// ScanKeys walks the keys in ascending order starting after cursor, or at prefix for an empty cursor, and returns
+// up to limit keys with the provided prefix for which match returns true.  match may be nil to match every key.
+// At most limit*scanKeysBudget keys are examined per call so the lock is never held for long.  The returned cursor
+// continues the scan and is empty once there are no more keys
+func (db *DataStructure) ScanKeys(cursor, prefix []byte, match func(key []byte) bool, limit int) ([][]byte, []byte) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var node *skiplistNode
+	if len(cursor) == 0 {
+		node = db.keys.seek(string(prefix))
+	} else {
+		node = db.keys.seek(string(cursor))
+		if node != nil && node.key == string(cursor) {
+			node = node.next()
+		}
+	}
+
+	now := time.Now().UnixMilli()
+
+	var keys [][]byte
+	for examined := 0; node != nil; node = node.next() {
+		// The elements of collections are not keys of their own, they are skipped all at once
+		if reservedKey(node.key) {
+			if node = db.keys.seek(internalEnd); node == nil {
+				break
+			}
+		}
+
+		key := []byte(node.key)
+
+		if !bytes.HasPrefix(key, prefix) {
+			// Keys are sorted so nothing after this has the prefix either
+			return keys, nil
+		}
+
+		// Deleted keys stay in the ordered index while snapshots can see them, expired ones until they are deleted
+		_, live := db.liveEntry(node.key, now)
+
+		if live && (match == nil || match(key)) {
+			keys = append(keys, key)
+		}
+
+		examined++
+		if len(keys) >= limit || examined >= limit*scanKeysBudget {
+			// Only hand out a cursor if there is something left
+			if next := node.next(); next != nil && bytes.HasPrefix([]byte(next.key), prefix) {
+				return keys, key
+			}
+			return keys, nil
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,356 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var (
+	// ErrNotJSON is returned when a value that should be a JSON document is not valid JSON
+	ErrNotJSON = errors.New("value is not JSON")
+
+	// ErrPathNotFound is returned when a JSON path does not lead to a value of the document
+	ErrPathNotFound = errors.New("path not found")
+)
+
+// JSON documents are stored as string values, so GET and PUT work on them as they are.  Paths start at the root $
+// and select object members with .name or ["name"] and array elements with [index], negative indexes counting
+// from the end of the array, e.g. $.users[0].name
+
+// pathStep is a step of a JSON path, an object member or an array element
+type pathStep struct {
+	member  string
+	index   int
+	isIndex bool
+}
+
+// JSONSet sets the value at path of the JSON document at key, creating the last object member of the path if it
+// does not exist.  A missing key is created when path is the root.  The expiry of the key is kept
+func (db *DataStructure) JSONSet(key, path, value []byte) error {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+
+	newValue, err := decodeJSON(value)
+	if err != nil {
+		return err
+	}
+
+	return db.update(key, TypeString, func(current []byte, exists bool) ([]byte, error) {
+		if !exists {
+			if len(steps) > 0 {
+				return nil, ErrKeyNotFound
+			}
+
+			return encodeJSON(newValue)
+		}
+
+		document, err := decodeJSON(current)
+		if err != nil {
+			return nil, err
+		}
+
+		document, err = setJSONPath(document, steps, newValue)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeJSON(document)
+	})
+}
+
+// JSONGet retrieves the value at path of the JSON document at key, encoded as JSON
+func (db *DataStructure) JSONGet(key, path []byte) ([]byte, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	document, err := decodeJSON(value)
+	if err != nil {
+		return nil, err
+	}
+
+	result, ok := getJSONPath(document, steps)
+	if !ok {
+		return nil, ErrPathNotFound
+	}
+
+	return encodeJSON(result)
+}
+
+// JSONDel deletes the value at path of the JSON document at key and reports whether there was one.
+// Deleting the root deletes the key
+func (db *DataStructure) JSONDel(key, path []byte) (bool, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return false, err
+	}
+
+	deleted := false
+
+	err = db.update(key, TypeString, func(current []byte, exists bool) ([]byte, error) {
+		if !exists {
+			return nil, errUnchanged
+		}
+
+		document, err := decodeJSON(current)
+		if err != nil {
+			return nil, err
+		}
+
+		// Deleting the root deletes the key
+		if len(steps) == 0 {
+			deleted = true
+			return nil, nil
+		}
+
+		document, deleted = deleteJSONPath(document, steps)
+		if !deleted {
+			return nil, errUnchanged
+		}
+
+		return encodeJSON(document)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+// parseJSONPath parses a JSON path into its steps, the root $ has none
+func parseJSONPath(path []byte) ([]pathStep, error) {
+	if len(path) == 0 || path[0] != '$' {
+		return nil, fmt.Errorf("bad JSON path %q: must start with $", path)
+	}
+
+	var steps []pathStep
+
+	for pos := 1; pos < len(path); {
+		switch path[pos] {
+		case '.':
+			// Member name, up to the next step
+			end := pos + 1
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+
+			if end == pos+1 {
+				return nil, fmt.Errorf("bad JSON path %q: empty member name at %d", path, pos)
+			}
+
+			steps = append(steps, pathStep{member: string(path[pos+1 : end])})
+			pos = end
+		case '[':
+			end := bytes.IndexByte(path[pos:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("bad JSON path %q: unclosed [ at %d", path, pos)
+			}
+			end += pos
+
+			inner := path[pos+1 : end]
+
+			// Quoted member name or array index
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, pathStep{member: string(inner[1 : len(inner)-1])})
+			} else {
+				index, err := strconv.Atoi(string(inner))
+				if err != nil {
+					return nil, fmt.Errorf("bad JSON path %q: bad index at %d", path, pos)
+				}
+
+				steps = append(steps, pathStep{index: index, isIndex: true})
+			}
+
+			pos = end + 1
+		default:
+			return nil, fmt.Errorf("bad JSON path %q: unexpected %q at %d", path, path[pos], pos)
+		}
+	}
+
+	return steps, nil
+}
+
+// decodeJSON decodes a single JSON value, numbers are kept as they are written
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, ErrNotJSON
+	}
+
+	// Nothing may follow the value
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, ErrNotJSON
+	}
+
+	return value, nil
+}
+
+// encodeJSON encodes a decoded JSON value.  Object members are written in ascending order of name
+func encodeJSON(value interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// getJSONPath returns the value at the path of steps from value
+func getJSONPath(value interface{}, steps []pathStep) (interface{}, bool) {
+	for _, step := range steps {
+		var ok bool
+		if value, ok = jsonChild(value, step); !ok {
+			return nil, false
+		}
+	}
+
+	return value, true
+}
+
+// setJSONPath sets the value at the path of steps from document to newValue and returns the updated document.
+// The last step may name an object member that does not exist yet
+func setJSONPath(document interface{}, steps []pathStep, newValue interface{}) (interface{}, error) {
+	if len(steps) == 0 {
+		return newValue, nil
+	}
+
+	parent, ok := getJSONPath(document, steps[:len(steps)-1])
+	if !ok {
+		return nil, ErrPathNotFound
+	}
+
+	last := steps[len(steps)-1]
+
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		if last.isIndex {
+			return nil, ErrPathNotFound
+		}
+
+		container[last.member] = newValue
+	case []interface{}:
+		i, ok := arrayIndex(container, last)
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+
+		container[i] = newValue
+	default:
+		return nil, ErrPathNotFound
+	}
+
+	return document, nil
+}
+
+// deleteJSONPath deletes the value at the path of steps from document, which must not be the root, and returns
+// the updated document and whether there was a value
+func deleteJSONPath(document interface{}, steps []pathStep) (interface{}, bool) {
+	parentSteps := steps[:len(steps)-1]
+
+	parent, ok := getJSONPath(document, parentSteps)
+	if !ok {
+		return document, false
+	}
+
+	last := steps[len(steps)-1]
+
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := container[last.member]; last.isIndex || !ok {
+			return document, false
+		}
+
+		delete(container, last.member)
+	case []interface{}:
+		i, ok := arrayIndex(container, last)
+		if !ok {
+			return document, false
+		}
+
+		// Removing an element makes a shorter array that replaces the old one in its parent
+		shorter := append(container[:i:i], container[i+1:]...)
+
+		var err error
+		if document, err = setJSONPath(document, parentSteps, shorter); err != nil {
+			return document, false
+		}
+	default:
+		return document, false
+	}
+
+	return document, true
+}
+
+// jsonChild returns the object member or array element step selects from value
+func jsonChild(value interface{}, step pathStep) (interface{}, bool) {
+	switch container := value.(type) {
+	case map[string]interface{}:
+		if step.isIndex {
+			return nil, false
+		}
+
+		child, ok := container[step.member]
+		return child, ok
+	case []interface{}:
+		i, ok := arrayIndex(container, step)
+		if !ok {
+			return nil, false
+		}
+
+		return container[i], true
+	}
+
+	return nil, false
+}
+
+// arrayIndex resolves the index of step into array, negative indexes count from the end
+func arrayIndex(array []interface{}, step pathStep) (int, bool) {
+	if !step.isIndex {
+		return 0, false
+	}
+
+	i := step.index
+	if i < 0 {
+		i += len(array)
+	}
+
+	return i, i >= 0 && i < len(array)
+}
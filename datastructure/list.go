@@ -0,0 +1,165 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A list spans a range of positions, from the position of its first element up to the one after its last.
+// Its metadata holds both ends so pushing and popping only write the element and the ends
+
+// decodeListBounds decodes the metadata of a list, the position of its first element and the one after its last
+func decodeListBounds(meta []byte) (int64, int64, error) {
+	head, n := binary.Varint(meta)
+	if n <= 0 {
+		return 0, 0, errors.New("malformed list metadata")
+	}
+
+	tail, m := binary.Varint(meta[n:])
+	if m <= 0 {
+		return 0, 0, errors.New("malformed list metadata")
+	}
+
+	return head, tail, nil
+}
+
+// encodeListBounds encodes the metadata of a list
+func encodeListBounds(head, tail int64) []byte {
+	return binary.AppendVarint(binary.AppendVarint(nil, head), tail)
+}
+
+// LPush inserts values at the head of the list at key, one after another, and returns the length of the list.
+// A missing key is created as an empty list first.  Only the pushed values and the ends of the list are written
+func (db *DataStructure) LPush(key []byte, values ...[]byte) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, meta, exists, err := db.openCollection(key, TypeList)
+	if err != nil {
+		return 0, err
+	}
+
+	var head, tail int64
+	if exists {
+		if head, tail, err = decodeListBounds(meta); err != nil {
+			return 0, err
+		}
+	}
+
+	// The last value pushed ends up first
+	ops := make([]batchOp, 0, len(values))
+	for _, value := range values {
+		head--
+		ops = append(ops, putElement(key, TypeList, familyListItem, sortableInt(head), value))
+	}
+
+	if err := db.writeCollection(key, TypeList, entry, encodeListBounds(head, tail), ops); err != nil {
+		return 0, err
+	}
+
+	return int(tail - head), nil
+}
+
+// RPop removes and returns the last element of the list at key.  The key is deleted along with its last element
+func (db *DataStructure) RPop(key []byte) ([]byte, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, meta, exists, err := db.openCollection(key, TypeList)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrKeyNotFound
+	}
+
+	head, tail, err := decodeListBounds(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	tail--
+	value, _, err := db.element(elementKey(key, familyListItem, sortableInt(tail)))
+	if err != nil {
+		return nil, err
+	}
+
+	// The last element takes the list with it
+	meta = nil
+	if head < tail {
+		meta = encodeListBounds(head, tail)
+	}
+
+	if err := db.writeCollection(key, TypeList, entry, meta, []batchOp{deleteElement(key, familyListItem, sortableInt(tail))}); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// LRange returns the elements of the list at key from start to stop, both inclusive.
+// Negative indexes count from the end of the list, -1 being the last element.  Only the elements in the range are read
+func (db *DataStructure) LRange(key []byte, start, stop int) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, meta, exists, err := db.openCollection(key, TypeList)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	head, tail, err := decodeListBounds(meta)
+	if err != nil {
+		return nil, err
+	}
+	length := int(tail - head)
+
+	// Resolve negative indexes and clamp to the list
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+
+	if start > stop {
+		return nil, nil
+	}
+
+	elements := make([][]byte, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		value, _, err := db.element(elementKey(key, familyListItem, sortableInt(head+int64(i))))
+		if err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, value)
+	}
+
+	return elements, nil
+}
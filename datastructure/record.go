@@ -0,0 +1,391 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+)
+
+// Data file format
+//
+// Header
+// - `Magic` 4 bytes - "CHDB"
+// - `Version` 2 bytes (uint16)
+// - `Sequence` 8 bytes (uint64) - Highest key version written before the file was created or compacted
+//
+// Records, appended one after another
+// - `Checksum` 4 bytes (uint32) - CRC32C of everything in the record after the checksum
+// - `Flags` 1 byte - See recordFlag* constants, the value type is stored in the bits of recordTypeMask
+// - `Version` 8 bytes (uint64) - Version of the key, taken from a sequence shared by all keys
+// - `Expires At` 8 bytes (int64) - Unix time in milliseconds the key expires at, 0 if it never does
+// - `Key Length` 4 bytes (uint32)
+// - `Value Length` 4 bytes (uint32)
+// - `Key` Variable-length byte array
+// - `Value` Variable-length byte array
+// - `Offset` 8 bytes (int64) - Offset of the record in the data file
+//
+// Data files written before the header existed (version 0) have no checksum or flags and mark
+// tombstones with a value length of legacyTombstoneValueLength.  Version 1 files have neither the
+// header sequence nor record versions, version 2 records have no expiry and version 3 records have no value type.
+// Older versions are upgraded when opened
+const (
+	dataMagic            = "CHDB"    // Data file magic
+	dataVersion          = 4         // Current data file format version
+	dataHeaderSize       = 4 + 2 + 8 // Magic, version and sequence
+	legacyDataHeaderSize = 4 + 2     // Magic and version of a version 1 header
+
+	recordFlagTombstone uint8 = 1 << 0    // Record marks the key as deleted
+	recordTypeMask      uint8 = 0x0f << 1 // Bits of the flags holding the ValueType of the record
+	recordTypeShift           = 1         // Position of the value type in the flags
+
+	legacyTombstoneValueLength = math.MaxUint32 // Value length of a version 0 tombstone
+	recordTrailerSize          = 8              // Offset at the end of every record
+)
+
+// ErrCorrupted is returned when a data record fails verification
+var ErrCorrupted = errors.New("data record corrupted")
+
+// CorruptionError describes a damaged data record.  It matches ErrCorrupted with errors.Is
+type CorruptionError struct {
+	Offset int64  // Offset of the damaged record in the data file
+	Reason string // What failed to verify
+}
+
+// Error returns the error message
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("data record at offset %d corrupted: %s", e.Offset, e.Reason)
+}
+
+// Unwrap returns ErrCorrupted
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorrupted
+}
+
+// dataRecord is a decoded data record
+type dataRecord struct {
+	key       []byte
+	value     []byte
+	tombstone bool
+	valueType ValueType // Type of the value, TypeString for records written before types existed
+	version   uint64    // Version of the key, 0 for records written before versions existed
+	expiresAt int64     // Unix time in milliseconds the key expires at, 0 if it never does
+	size      int64     // Encoded size of the record
+}
+
+// expired reports whether a key expiring at expiresAt has expired by now, both Unix times in milliseconds
+func expired(expiresAt, now int64) bool {
+	return expiresAt != 0 && expiresAt <= now
+}
+
+// recordHeaderSize returns the size of the fixed part at the start of a record of the provided format version
+func recordHeaderSize(formatVersion uint16) int64 {
+	switch formatVersion {
+	case 0:
+		return 4 + 4 // Key length and value length
+	case 1:
+		return 4 + 1 + 4 + 4 // Checksum, flags, key length and value length
+	case 2:
+		return 4 + 1 + 8 + 4 + 4 // Checksum, flags, version, key length and value length
+	}
+
+	return 4 + 1 + 8 + 8 + 4 + 4 // Checksum, flags, version, expiry, key length and value length
+}
+
+// decodeRecordLengths decodes the key length and value length from a record header.  The returned record
+// has the tombstone flag, value type, key version and expiry
+func decodeRecordLengths(header []byte, formatVersion uint16) (int64, int64, dataRecord, error) {
+	if formatVersion == 0 {
+		keyLength := int64(binary.LittleEndian.Uint32(header[0:4]))
+		valueLength := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		if valueLength == legacyTombstoneValueLength {
+			return keyLength, 0, dataRecord{tombstone: true}, nil
+		}
+
+		return keyLength, valueLength, dataRecord{}, nil
+	}
+
+	// Value types were added in version 4
+	flags := header[4]
+	known := recordFlagTombstone
+	if formatVersion > 3 {
+		known |= recordTypeMask
+	}
+	if flags&^known != 0 {
+		return 0, 0, dataRecord{}, errors.New("unknown record flags")
+	}
+
+	record := dataRecord{
+		tombstone: flags&recordFlagTombstone != 0,
+		valueType: ValueType((flags & recordTypeMask) >> recordTypeShift),
+	}
+
+	if record.valueType > maxValueType {
+		return 0, 0, dataRecord{}, errors.New("unknown value type")
+	}
+
+	// Version 1 records have no key version, version 2 records no expiry
+	lengths := header[5:]
+	if formatVersion > 1 {
+		record.version = binary.LittleEndian.Uint64(header[5:13])
+		lengths = header[13:]
+	}
+	if formatVersion > 2 {
+		record.expiresAt = int64(binary.LittleEndian.Uint64(header[13:21]))
+		lengths = header[21:]
+	}
+
+	keyLength := int64(binary.LittleEndian.Uint32(lengths[0:4]))
+	valueLength := int64(binary.LittleEndian.Uint32(lengths[4:8]))
+
+	if record.tombstone && valueLength != 0 {
+		return 0, 0, dataRecord{}, errors.New("tombstone with a value")
+	}
+
+	return keyLength, valueLength, record, nil
+}
+
+// encodeDataRecord appends record, to be stored at the specified offset, to buf.  The size of record is ignored.
+// Tombstones carry no value
+func encodeDataRecord(buf []byte, offset int64, record dataRecord) []byte {
+	start := len(buf)
+
+	// Checksum, filled in once the record is encoded
+	buf = append(buf, 0, 0, 0, 0)
+
+	// Flags
+	var flags uint8
+	value := record.value
+	if record.tombstone {
+		flags |= recordFlagTombstone
+		value = nil
+	} else {
+		flags |= uint8(record.valueType) << recordTypeShift
+	}
+	buf = append(buf, flags)
+
+	// Key version
+	buf = binary.LittleEndian.AppendUint64(buf, record.version)
+
+	// Expiry
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(record.expiresAt))
+
+	// Key length
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(record.key)))
+
+	// Value length
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+
+	// Key
+	buf = append(buf, record.key...)
+
+	// Value
+	buf = append(buf, value...)
+
+	// Offset of the record in the data file
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(offset))
+
+	binary.LittleEndian.PutUint32(buf[start:], crc32.Checksum(buf[start+4:], crcTable))
+
+	return buf
+}
+
+// decodeRecordHeader decodes the key, size, tombstone flag, key version and expiry of the encoded record at the
+// start of buf.  The returned record has no value
+func decodeRecordHeader(buf []byte, formatVersion uint16) (dataRecord, error) {
+	headerSize := recordHeaderSize(formatVersion)
+	if int64(len(buf)) < headerSize {
+		return dataRecord{}, errors.New("truncated record")
+	}
+
+	keyLength, valueLength, record, err := decodeRecordLengths(buf, formatVersion)
+	if err != nil {
+		return dataRecord{}, err
+	}
+
+	record.size = headerSize + keyLength + valueLength + recordTrailerSize
+	if int64(len(buf)) < record.size {
+		return dataRecord{}, errors.New("truncated record")
+	}
+
+	record.key = buf[headerSize : headerSize+keyLength]
+
+	return record, nil
+}
+
+// dataStart returns the offset of the first record in the data file
+func (db *DataStructure) dataStart() int64 {
+	switch db.formatVersion {
+	case 0:
+		return 0
+	case 1:
+		return legacyDataHeaderSize
+	}
+
+	return dataHeaderSize
+}
+
+// readRecordSize reads the header of the record at offset.  The returned record has the tombstone flag,
+// key version, expiry and size but neither key nor value, the key length is returned next to it
+func (db *DataStructure) readRecordSize(offset int64) (dataRecord, int64, error) {
+	headerSize := recordHeaderSize(db.formatVersion)
+	if offset < db.dataStart() || offset+headerSize > db.nextOffset {
+		return dataRecord{}, 0, &CorruptionError{Offset: offset, Reason: "record outside of the data file"}
+	}
+
+	header := make([]byte, headerSize)
+	if _, err := db.dataFile.ReadAt(header, offset); err != nil {
+		return dataRecord{}, 0, err
+	}
+
+	keyLength, valueLength, record, err := decodeRecordLengths(header, db.formatVersion)
+	if err != nil {
+		return dataRecord{}, 0, &CorruptionError{Offset: offset, Reason: err.Error()}
+	}
+
+	// Make sure the record fits in the data file
+	record.size = headerSize + keyLength + valueLength + recordTrailerSize
+	if offset+record.size > db.nextOffset {
+		return dataRecord{}, 0, &CorruptionError{Offset: offset, Reason: "record runs past the end of the data file"}
+	}
+
+	return record, keyLength, nil
+}
+
+// readRecordHeader reads the key, size, tombstone flag, key version and expiry of the data record at the provided offset.
+// The returned record has no value.  Only the record trailer is verified, use readRecord to verify the checksum
+func (db *DataStructure) readRecordHeader(offset int64) (dataRecord, error) {
+	record, keyLength, err := db.readRecordSize(offset)
+	if err != nil {
+		return dataRecord{}, err
+	}
+
+	// Read the trailing record offset
+	var trailer [recordTrailerSize]byte
+	if _, err := db.dataFile.ReadAt(trailer[:], offset+record.size-recordTrailerSize); err != nil {
+		return dataRecord{}, err
+	}
+
+	if int64(binary.LittleEndian.Uint64(trailer[:])) != offset {
+		return dataRecord{}, &CorruptionError{Offset: offset, Reason: "record offset mismatch"}
+	}
+
+	// Read the key
+	record.key = make([]byte, keyLength)
+	if _, err := db.dataFile.ReadAt(record.key, offset+recordHeaderSize(db.formatVersion)); err != nil {
+		return dataRecord{}, err
+	}
+
+	return record, nil
+}
+
+// readRecord reads and verifies the data record at the provided offset
+func (db *DataStructure) readRecord(offset int64) (dataRecord, error) {
+	record, keyLength, err := db.readRecordSize(offset)
+	if err != nil {
+		return dataRecord{}, err
+	}
+	size := record.size
+
+	data := make([]byte, size)
+	if _, err := db.dataFile.ReadAt(data, offset); err != nil {
+		return dataRecord{}, err
+	}
+
+	if db.formatVersion > 0 && crc32.Checksum(data[4:], crcTable) != binary.LittleEndian.Uint32(data[0:4]) {
+		return dataRecord{}, &CorruptionError{Offset: offset, Reason: "checksum mismatch"}
+	}
+
+	if int64(binary.LittleEndian.Uint64(data[size-recordTrailerSize:])) != offset {
+		return dataRecord{}, &CorruptionError{Offset: offset, Reason: "record offset mismatch"}
+	}
+
+	headerSize := recordHeaderSize(db.formatVersion)
+	record.key = data[headerSize : headerSize+keyLength]
+	record.value = data[headerSize+keyLength : size-recordTrailerSize]
+
+	return record, nil
+}
+
+// readDataRecord reads the key-value record at the provided offset in the data file
+func (db *DataStructure) readDataRecord(offset int64) ([]byte, []byte, error) {
+	record, err := db.readRecord(offset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Tombstones have no value
+	if record.tombstone {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	return record.key, record.value, nil
+}
+
+// readDataHeader reads the data file header and returns the format version and the header sequence.
+// Files without a header are version 0
+func readDataHeader(dataFile *os.File, size int64) (uint16, uint64, error) {
+	if size < legacyDataHeaderSize {
+		return 0, 0, nil
+	}
+
+	header := make([]byte, legacyDataHeaderSize)
+	if _, err := dataFile.ReadAt(header, 0); err != nil {
+		return 0, 0, err
+	}
+
+	if !bytes.HasPrefix(header, []byte(dataMagic)) {
+		return 0, 0, nil
+	}
+
+	version := binary.LittleEndian.Uint16(header[len(dataMagic):])
+	if version > dataVersion {
+		return 0, 0, fmt.Errorf("unsupported data file version %d", version)
+	}
+
+	if version < 2 {
+		return version, 0, nil
+	}
+
+	// Read the sequence
+	if size < dataHeaderSize {
+		return 0, 0, errors.New("truncated data file header")
+	}
+
+	var sequence [8]byte
+	if _, err := dataFile.ReadAt(sequence[:], legacyDataHeaderSize); err != nil {
+		return 0, 0, err
+	}
+
+	return version, binary.LittleEndian.Uint64(sequence[:]), nil
+}
+
+// encodeDataHeader returns the header of a data file in the current format
+func encodeDataHeader(sequence uint64) []byte {
+	header := append([]byte(dataMagic), 0, 0)
+	binary.LittleEndian.PutUint16(header[len(dataMagic):], dataVersion)
+	return binary.LittleEndian.AppendUint64(header, sequence)
+}
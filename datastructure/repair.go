@@ -0,0 +1,153 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// RepairReport summarizes what Repair found in the data file
+type RepairReport struct {
+	Records     int   // Intact records read from the data file
+	Keys        int   // Live keys in the rebuilt index
+	Damaged     int   // Damaged regions copied to the quarantine file
+	Quarantined int64 // Bytes copied to the quarantine file
+}
+
+// Repair rebuilds the index file by walking the data file record by record.  The latest version of each key wins
+// and tombstones remove the key.  Damaged regions are copied to a quarantine file next to the data file,
+// then the data file is compacted so they are dropped from it.  The DB must not be open while repairing
+//
+// Quarantine file format, one entry per damaged region
+// - `Offset` 8 bytes (int64) - Offset of the region in the data file
+// - `Length` 8 bytes (int64) - Length of the region
+// - `Data` Variable-length byte array - The bytes of the region
+func Repair(dataFilename, indexFilename string) (*RepairReport, error) {
+	dataFile, err := os.OpenFile(dataFilename, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	dataFileInfo, err := dataFile.Stat()
+	if err != nil {
+		dataFile.Close()
+		return nil, err
+	}
+
+	formatVersion, sequence, err := readDataHeader(dataFile, dataFileInfo.Size())
+	if err != nil {
+		dataFile.Close()
+		return nil, err
+	}
+
+	indexFile, err := os.OpenFile(indexFilename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		dataFile.Close()
+		return nil, err
+	}
+
+	db := &DataStructure{
+		dataFile:      dataFile,
+		dataFilename:  dataFilename,
+		indexFile:     indexFile,
+		indexFilename: indexFilename,
+		formatVersion: formatVersion,
+		nextOffset:    dataFileInfo.Size(),
+		sequence:      sequence,
+		index:         make(map[string]indexEntry),
+		keys:          newSkiplist(),
+		expiring:      newExpiryQueue(),
+	}
+
+	report := &RepairReport{}
+	var quarantineFile *os.File
+
+	err = db.scanRecords(func(offset int64, record dataRecord) error {
+		report.Records++
+		db.setIndexEntry(offset, record)
+		return nil
+	}, func(start, end int64) error {
+		// Copy the damaged region out of the data file
+		region := make([]byte, end-start)
+		if _, err := db.dataFile.ReadAt(region, start); err != nil {
+			return err
+		}
+
+		if quarantineFile == nil {
+			quarantineFile, err = os.OpenFile(dataFilename+".quarantine", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		entry := binary.LittleEndian.AppendUint64(nil, uint64(start))
+		entry = binary.LittleEndian.AppendUint64(entry, uint64(len(region)))
+		if _, err := quarantineFile.Write(append(entry, region...)); err != nil {
+			return err
+		}
+
+		report.Damaged++
+		report.Quarantined += int64(len(region))
+		return nil
+	})
+
+	if quarantineFile != nil {
+		if syncErr := quarantineFile.Sync(); err == nil {
+			err = syncErr
+		}
+		quarantineFile.Close()
+	}
+
+	if err != nil {
+		dataFile.Close()
+		indexFile.Close()
+		return nil, err
+	}
+
+	// Write the rebuilt index
+	if err := db.writeIndex(); err != nil {
+		dataFile.Close()
+		return nil, err
+	}
+
+	if err := dataFile.Close(); err != nil {
+		return nil, err
+	}
+
+	if err := db.indexFile.Close(); err != nil {
+		return nil, err
+	}
+
+	// Open the DB normally so the write-ahead log is replayed, then compact the damaged regions away
+	repaired, err := OpenDB(dataFilename, indexFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := repaired.Compact(); err != nil {
+		repaired.Close()
+		return nil, err
+	}
+
+	report.Keys = len(repaired.index)
+
+	return report, repaired.Close()
+}
@@ -0,0 +1,273 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// secondaryIndexExtension is the extension of the secondary index definitions file next to the data file
+const secondaryIndexExtension = ".sidx"
+
+var (
+	// ErrIndexExists is returned when creating a secondary index with the name of an existing one
+	ErrIndexExists = errors.New("index already exists")
+
+	// ErrIndexNotFound is returned when a secondary index does not exist
+	ErrIndexNotFound = errors.New("index not found")
+)
+
+// Secondary indexes map the value at a JSON path of every JSON document to the keys holding it.  The index
+// definitions are stored in a file next to the data file and the indexes themselves live in memory.  When the DB
+// is opened they are loaded from the index contents file, or built from the data file if it is out of date
+
+// secondaryIndex is a secondary index on a JSON path
+type secondaryIndex struct {
+	Name  string                         // Name of the index
+	Path  string                         // JSON path of the indexed field
+	steps []pathStep                     // Parsed path
+	keys  map[string]map[string]struct{} // Keys by indexed value
+	value map[string]string              // Indexed value by key
+}
+
+// CreateIndex creates a secondary index on the JSON path of every JSON document and indexes the documents already
+// stored.  Strings are indexed as they are and other scalars as their JSON, documents without a scalar at path
+// are left out.  The index is kept up to date on every write
+func (db *DataStructure) CreateIndex(name string, path []byte) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("bad index name %q", name)
+	}
+
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.secondaryIndexes[name]; ok {
+		return ErrIndexExists
+	}
+
+	index := &secondaryIndex{Name: name, Path: string(path), steps: steps}
+	if err := db.buildSecondaryIndex(index); err != nil {
+		return err
+	}
+
+	db.secondaryIndexes[name] = index
+
+	if err := db.writeSecondaryIndexes(); err != nil {
+		delete(db.secondaryIndexes, name)
+		return err
+	}
+
+	return nil
+}
+
+// Find returns the keys whose JSON document has value at the path of the secondary index name, in ascending order
+func (db *DataStructure) Find(name string, value []byte) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	index, ok := db.secondaryIndexes[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+
+	now := time.Now().UnixMilli()
+
+	keys := make([]string, 0, len(index.keys[string(value)]))
+	for key := range index.keys[string(value)] {
+		// Expired keys stay indexed until they are deleted
+		if _, ok := db.liveEntry(key, now); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	results := make([][]byte, len(keys))
+	for i, key := range keys {
+		results[i] = []byte(key)
+	}
+
+	return results, nil
+}
+
+// indexRecord updates every secondary index for a record written to the data file, the caller must hold the lock
+func (db *DataStructure) indexRecord(record dataRecord) {
+	for _, index := range db.secondaryIndexes {
+		index.remove(string(record.key))
+
+		if !record.tombstone && record.valueType == TypeString {
+			index.add(string(record.key), record.value)
+		}
+	}
+}
+
+// loadSecondaryIndexes reads the secondary index definitions and builds the indexes
+func (db *DataStructure) loadSecondaryIndexes() error {
+	data, err := os.ReadFile(siblingFilename(db.dataFilename, secondaryIndexExtension))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var indexes []*secondaryIndex
+	if err := json.Unmarshal(data, &indexes); err != nil {
+		return fmt.Errorf("corrupted secondary index definitions: %w", err)
+	}
+
+	// Contents written for the data file as it is now save reading and decoding every document
+	var contents map[string]map[string]string
+	payload, ok, err := db.readIndexContents(secondaryContentsExtension)
+	if err != nil {
+		return err
+	}
+	if ok {
+		contents, _ = decodeSecondaryContents(payload) // malformed contents are rebuilt
+	}
+
+	for _, index := range indexes {
+		if index.steps, err = parseJSONPath([]byte(index.Path)); err != nil {
+			return err
+		}
+
+		if values, ok := contents[index.Name]; ok {
+			index.restore(values)
+		} else if err := db.buildSecondaryIndex(index); err != nil {
+			return err
+		}
+
+		db.secondaryIndexes[index.Name] = index
+	}
+
+	return nil
+}
+
+// writeSecondaryIndexes replaces the secondary index definitions and contents files, the caller must hold the lock
+func (db *DataStructure) writeSecondaryIndexes() error {
+	indexes := make([]*secondaryIndex, 0, len(db.secondaryIndexes))
+	for _, index := range db.secondaryIndexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i].Name < indexes[j].Name
+	})
+
+	data, err := json.Marshal(indexes)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(siblingFilename(db.dataFilename, secondaryIndexExtension), data); err != nil {
+		return err
+	}
+
+	return db.writeIndexContents(secondaryContentsExtension, db.encodeSecondaryContents())
+}
+
+// buildSecondaryIndex indexes every JSON document in the DB, the caller must hold the lock
+func (db *DataStructure) buildSecondaryIndex(index *secondaryIndex) error {
+	index.keys = make(map[string]map[string]struct{})
+	index.value = make(map[string]string)
+
+	for key, entry := range db.index {
+		if entry.valueType != TypeString {
+			continue
+		}
+
+		_, value, err := db.readDataRecord(entry.offset)
+		if err != nil {
+			return err
+		}
+
+		index.add(key, value)
+	}
+
+	return nil
+}
+
+// restore fills the index with the indexed value of each key
+func (index *secondaryIndex) restore(values map[string]string) {
+	index.keys = make(map[string]map[string]struct{})
+	index.value = values
+
+	for key, value := range values {
+		if index.keys[value] == nil {
+			index.keys[value] = make(map[string]struct{})
+		}
+		index.keys[value][key] = struct{}{}
+	}
+}
+
+// add indexes the document of key
+func (index *secondaryIndex) add(key string, document []byte) {
+	decoded, err := decodeJSON(document)
+	if err != nil {
+		return // not a JSON document
+	}
+
+	field, ok := getJSONPath(decoded, index.steps)
+	if !ok {
+		return
+	}
+
+	var value string
+	switch field := field.(type) {
+	case string:
+		value = field
+	case json.Number:
+		value = field.String()
+	case bool:
+		value = fmt.Sprint(field)
+	case nil:
+		value = "null"
+	default:
+		return // objects and arrays are not indexed
+	}
+
+	if index.keys[value] == nil {
+		index.keys[value] = make(map[string]struct{})
+	}
+	index.keys[value][key] = struct{}{}
+	index.value[key] = value
+}
+
+// remove removes key from the index
+func (index *secondaryIndex) remove(key string) {
+	value, ok := index.value[key]
+	if !ok {
+		return
+	}
+
+	delete(index.keys[value], key)
+	if len(index.keys[value]) == 0 {
+		delete(index.keys, value)
+	}
+	delete(index.value, key)
+}
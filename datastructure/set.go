@@ -0,0 +1,141 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+// SAdd adds members to the set at key and returns how many were not already in it.
+// A missing key is created as an empty set first.  Only the added members and the size of the set are written
+func (db *DataStructure) SAdd(key []byte, members ...[]byte) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, meta, exists, err := db.openCollection(key, TypeSet)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	if exists {
+		if count, err = decodeCount(meta); err != nil {
+			return 0, err
+		}
+	}
+
+	// Members of a set that expired are gone along with the set, members can be given more than once
+	added := make(map[string]struct{})
+	var ops []batchOp
+
+	for _, member := range members {
+		element := elementKey(key, familySetMember, member)
+		if _, found := db.index[string(element)]; found && exists {
+			continue
+		}
+		if _, ok := added[string(element)]; ok {
+			continue
+		}
+
+		added[string(element)] = struct{}{}
+		ops = append(ops, putElement(key, TypeSet, familySetMember, member, nil))
+	}
+
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	if err := db.writeCollection(key, TypeSet, entry, encodeCount(count+len(ops)), ops); err != nil {
+		return 0, err
+	}
+
+	return len(ops), nil
+}
+
+// SRem removes members from the set at key and returns how many were in it.
+// The key is deleted along with its last member
+func (db *DataStructure) SRem(key []byte, members ...[]byte) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, meta, exists, err := db.openCollection(key, TypeSet)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	count, err := decodeCount(meta)
+	if err != nil {
+		return 0, err
+	}
+
+	// Members can be given more than once
+	removed := make(map[string]struct{})
+	var ops []batchOp
+
+	for _, member := range members {
+		element := elementKey(key, familySetMember, member)
+		if _, found := db.index[string(element)]; !found {
+			continue
+		}
+		if _, ok := removed[string(element)]; ok {
+			continue
+		}
+
+		removed[string(element)] = struct{}{}
+		ops = append(ops, deleteElement(key, familySetMember, member))
+	}
+
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	// The last member takes the set with it
+	count -= len(ops)
+	meta = nil
+	if count > 0 {
+		meta = encodeCount(count)
+	}
+
+	if err := db.writeCollection(key, TypeSet, entry, meta, ops); err != nil {
+		return 0, err
+	}
+
+	return len(ops), nil
+}
+
+// SMembers returns the members of the set at key in ascending order
+func (db *DataStructure) SMembers(key []byte) ([][]byte, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, _, exists, err := db.openCollection(key, TypeSet)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var members [][]byte
+
+	prefix := elementPrefix(key, familySetMember)
+	err = db.walkElements(prefix, prefix, func(member []byte, _ indexEntry) (bool, error) {
+		members = append(members, member)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
@@ -0,0 +1,134 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"math/rand"
+)
+
+const (
+	skiplistMaxLevel    = 32   // Enough levels for billions of keys
+	skiplistProbability = 0.25 // Probability of a node being promoted to the next level
+)
+
+// skiplist keeps the keys of the index in sorted order for iteration and range scans
+type skiplist struct {
+	head   *skiplistNode
+	level  int // Highest level currently in use
+	length int
+}
+
+// skiplistNode is a key in the skiplist
+type skiplistNode struct {
+	key     string
+	forward []*skiplistNode
+}
+
+// newSkiplist creates an empty skiplist
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &skiplistNode{forward: make([]*skiplistNode, skiplistMaxLevel)},
+		level: 1,
+	}
+}
+
+// randomLevel picks the level of a new node
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistProbability {
+		level++
+	}
+	return level
+}
+
+// findPredecessors fills update with the last node before key on every level
+func (sl *skiplist) findPredecessors(key string, update []*skiplistNode) *skiplistNode {
+	node := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for node.forward[i] != nil && node.forward[i].key < key {
+			node = node.forward[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node
+}
+
+// insert adds key to the skiplist if it is not already there
+func (sl *skiplist) insert(key string) {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+	node := sl.findPredecessors(key, update).forward[0]
+
+	if node != nil && node.key == key {
+		return
+	}
+
+	level := randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			update[i] = sl.head
+		}
+		sl.level = level
+	}
+
+	node = &skiplistNode{key: key, forward: make([]*skiplistNode, level)}
+	for i := 0; i < level; i++ {
+		node.forward[i] = update[i].forward[i]
+		update[i].forward[i] = node
+	}
+
+	sl.length++
+}
+
+// remove removes key from the skiplist
+func (sl *skiplist) remove(key string) {
+	update := make([]*skiplistNode, skiplistMaxLevel)
+	node := sl.findPredecessors(key, update).forward[0]
+
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.forward); i++ {
+		update[i].forward[i] = node.forward[i]
+	}
+
+	for sl.level > 1 && sl.head.forward[sl.level-1] == nil {
+		sl.level--
+	}
+
+	sl.length--
+}
+
+// seek returns the first node with a key greater than or equal to key
+func (sl *skiplist) seek(key string) *skiplistNode {
+	return sl.findPredecessors(key, nil).forward[0]
+}
+
+// first returns the node with the smallest key
+func (sl *skiplist) first() *skiplistNode {
+	return sl.head.forward[0]
+}
+
+// next returns the node after n
+func (n *skiplistNode) next() *skiplistNode {
+	return n.forward[0]
+}
@@ -0,0 +1,235 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// latestSequence looks keys up as of the latest write
+const latestSequence = math.MaxUint64
+
+// ErrSnapshotExpired is returned when reading from a snapshot that was open longer than Options.SnapshotMaxAge
+var ErrSnapshotExpired = errors.New("snapshot expired")
+
+// Snapshot is a point-in-time view of the DB.  It sees every write with a version up to its sequence and
+// none after, no matter what is written while it is open.  Records are never overwritten in place so older
+// versions stay readable; the index keeps track of them for as long as a snapshot may need them, up to
+// Options.SnapshotMaxAge
+//
+//	snapshot := db.Snapshot()
+//	defer snapshot.Release()
+//	value, err := snapshot.Get([]byte("key"))
+type Snapshot struct {
+	db       *DataStructure
+	sequence uint64
+	opened   time.Time
+	released bool
+	expired  bool // Set once the snapshot outlived Options.SnapshotMaxAge, the versions it saw may be gone
+}
+
+// versionEntry is a version of a key replaced while snapshots were open
+type versionEntry struct {
+	offset    int64  // Offset of the data record, unused for tombstones
+	version   uint64 // Version of the key
+	expiresAt int64  // Unix time in milliseconds the version expires at, 0 if it never does
+	tombstone bool   // Whether the key was deleted at this version
+}
+
+// Snapshot opens a snapshot of the DB as of the latest write.  It must be released with Release
+func (db *DataStructure) Snapshot() *Snapshot {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	db.expireSnapshots(now)
+
+	snapshot := &Snapshot{db: db, sequence: db.sequence, opened: now}
+	db.snapshots[snapshot] = struct{}{}
+
+	return snapshot
+}
+
+// Sequence returns the version of the latest write the snapshot sees
+func (s *Snapshot) Sequence() uint64 {
+	return s.sequence
+}
+
+// Get retrieves the value associated with a key as of the snapshot.  ErrWrongType is returned for keys holding
+// a list, set or hash
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	if s.expired {
+		return nil, ErrSnapshotExpired
+	}
+
+	offset, ok := s.db.lookup(string(key), s.sequence, time.Now().UnixMilli())
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+
+	record, err := s.db.readRecord(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.valueType != TypeString {
+		return nil, ErrWrongType
+	}
+
+	return record.value, nil
+}
+
+// NewIterator creates an iterator over the keys as of the snapshot
+func (s *Snapshot) NewIterator() *Iterator {
+	return &Iterator{db: s.db, sequence: s.sequence, snapshot: s}
+}
+
+// Release closes the snapshot so the older versions only it could see can be forgotten
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.released {
+		return
+	}
+	s.released = true
+
+	if s.expired {
+		return // already forgotten
+	}
+
+	delete(s.db.snapshots, s)
+
+	s.db.pruneHistory()
+}
+
+// expireSnapshots forgets the snapshots open longer than Options.SnapshotMaxAge and the versions only they could
+// see, the caller must hold the write lock
+func (db *DataStructure) expireSnapshots(now time.Time) {
+	if db.options.SnapshotMaxAge <= 0 || len(db.snapshots) == 0 {
+		return
+	}
+
+	expired := false
+	for snapshot := range db.snapshots {
+		if now.Sub(snapshot.opened) > db.options.SnapshotMaxAge {
+			snapshot.expired = true
+			delete(db.snapshots, snapshot)
+			expired = true
+		}
+	}
+
+	if expired {
+		db.pruneHistory()
+	}
+}
+
+// lookup returns the offset of the record of key as of sequence, the caller must hold the lock.
+// Keys expired by now are missing no matter the sequence, so are the elements of collections
+func (db *DataStructure) lookup(key string, sequence uint64, now int64) (int64, bool) {
+	if reservedKey(key) {
+		return 0, false
+	}
+
+	if entry, ok := db.index[key]; ok && entry.version <= sequence {
+		return entry.offset, !expired(entry.expiresAt, now)
+	}
+
+	// Newest version written up to the sequence
+	versions := db.history[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].version <= sequence {
+			return versions[i].offset, !versions[i].tombstone && !expired(versions[i].expiresAt, now)
+		}
+	}
+
+	return 0, false
+}
+
+// keepVersion remembers the version of key being replaced for open snapshots, the caller must hold the lock.
+// Deleted keys also remember the tombstone and stay in the ordered index so snapshots can iterate over them
+func (db *DataStructure) keepVersion(key []byte, previous indexEntry, exists bool, version uint64, tombstone bool) {
+	versions := db.history[string(key)]
+
+	if exists {
+		versions = append(versions, versionEntry{offset: previous.offset, version: previous.version, expiresAt: previous.expiresAt})
+	}
+
+	if tombstone {
+		versions = append(versions, versionEntry{version: version, tombstone: true})
+	}
+
+	if len(versions) > 0 {
+		db.history[string(key)] = versions
+	}
+}
+
+// pruneHistory forgets the versions no open snapshot can see anymore, the caller must hold the lock
+func (db *DataStructure) pruneHistory() {
+	if len(db.history) == 0 {
+		return
+	}
+
+	// The oldest snapshot sees the most
+	var oldest uint64 = latestSequence
+	for snapshot := range db.snapshots {
+		if snapshot.sequence < oldest {
+			oldest = snapshot.sequence
+		}
+	}
+
+	for key, versions := range db.history {
+		entry, live := db.index[key]
+
+		if live && entry.version <= oldest {
+			// Every snapshot sees the current version
+			versions = nil
+		} else {
+			// Versions before the one the oldest snapshot sees are hidden from every snapshot
+			start := 0
+			for i, version := range versions {
+				if version.version <= oldest {
+					start = i
+				}
+			}
+			versions = versions[start:]
+
+			// A key deleted before the oldest snapshot is simply missing to all of them
+			if len(versions) > 0 && versions[0].tombstone && versions[0].version <= oldest {
+				versions = versions[1:]
+			}
+		}
+
+		if len(versions) > 0 {
+			db.history[key] = versions
+			continue
+		}
+
+		delete(db.history, key)
+		if !live {
+			db.keys.remove(key)
+		}
+	}
+}
@@ -0,0 +1,680 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// A time series keeps its samples in chunks of up to tsChunkSamples samples, each a bit stream compressed like
+// Gorilla: timestamps as the difference between consecutive deltas and values XORed with the previous value.
+// Regular samples take a couple of bits each.  The record of the key holds the retention and the open head chunk
+// samples are added to.  A full head chunk is sealed into an immutable record of its own, keyed by its first
+// timestamp, so adding a sample only rewrites the head chunk
+const tsChunkSamples = 128 // Samples in a chunk before it is sealed and a new one is started
+
+// familyTSChunk is the family of the sealed chunks of a time series, keyed by their first timestamp
+const familyTSChunk byte = 'c'
+
+// ErrOldTimestamp is returned when a sample is older than the last sample of its time series
+var ErrOldTimestamp = errors.New("timestamp is older than the last sample")
+
+// Sample is a value of a time series at a Unix time in milliseconds
+type Sample struct {
+	Timestamp int64
+	Value     float64
+}
+
+// Aggregation is how the samples of a bucket are downsampled into one
+type Aggregation uint8
+
+const (
+	AggregationAvg   Aggregation = iota // Mean of the values
+	AggregationMin                      // Lowest value
+	AggregationMax                      // Highest value
+	AggregationSum                      // Sum of the values
+	AggregationCount                    // Number of samples
+)
+
+// String returns the name of the aggregation
+func (a Aggregation) String() string {
+	switch a {
+	case AggregationAvg:
+		return "avg"
+	case AggregationMin:
+		return "min"
+	case AggregationMax:
+		return "max"
+	case AggregationSum:
+		return "sum"
+	case AggregationCount:
+		return "count"
+	}
+
+	return "unknown"
+}
+
+// ParseAggregation parses avg, min, max, sum or count into an Aggregation
+func ParseAggregation(aggregation string) (Aggregation, error) {
+	switch strings.ToLower(aggregation) {
+	case "avg":
+		return AggregationAvg, nil
+	case "min":
+		return AggregationMin, nil
+	case "max":
+		return AggregationMax, nil
+	case "sum":
+		return AggregationSum, nil
+	case "count":
+		return AggregationCount, nil
+	}
+
+	return 0, fmt.Errorf("unknown aggregation %q", aggregation)
+}
+
+// timeSeries is the decoded record of the key of a time series
+type timeSeries struct {
+	retention int64   // Milliseconds samples are kept for behind the newest sample, 0 keeps them forever
+	head      tsChunk // Chunk samples are added to, without samples while the time series is empty
+}
+
+// tsChunk is a chunk of consecutive samples of a time series, still compressed
+type tsChunk struct {
+	count int
+	first int64 // Timestamp of the first sample
+	last  int64 // Timestamp of the last sample
+	data  []byte
+}
+
+// sealedChunk is a sealed chunk of a time series, known by its key before it is read
+type sealedChunk struct {
+	first int64      // Timestamp of the first sample
+	entry indexEntry // Index entry of the record of the chunk
+}
+
+// TSCreate creates an empty time series at key that keeps samples for retention behind its newest sample, or changes
+// the retention of the time series already there.  A retention of 0 keeps samples forever
+func (db *DataStructure) TSCreate(key []byte, retention time.Duration) error {
+	if retention < 0 {
+		return errors.New("retention must not be negative")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, series, exists, err := db.openTimeSeries(key)
+	if err != nil {
+		return err
+	}
+
+	series.retention = retention.Milliseconds()
+
+	var ops []batchOp
+	if exists {
+		if ops, err = db.trimTimeSeries(key, series); err != nil {
+			return err
+		}
+	}
+
+	return db.writeCollection(key, TypeTimeSeries, entry, series.encode(), ops)
+}
+
+// TSAdd appends a sample at timestamp, a Unix time in milliseconds, to the time series at key, creating it if it is
+// missing.  A sample at the timestamp of the last sample replaces it, and ErrOldTimestamp is returned for older ones.
+// Only the head chunk is rewritten, once full it is sealed and a new one started.  Chunks that fall out of the
+// retention of the time series are dropped
+func (db *DataStructure) TSAdd(key []byte, timestamp int64, value float64) error {
+	if math.IsNaN(value) {
+		return ErrNotFloat
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, series, _, err := db.openTimeSeries(key)
+	if err != nil {
+		return err
+	}
+
+	sample := Sample{Timestamp: timestamp, Value: value}
+	head := &series.head
+
+	var ops []batchOp
+	switch {
+	case head.count == 0:
+		*head = encodeChunk([]Sample{sample})
+	case timestamp < head.last:
+		return ErrOldTimestamp
+	case timestamp > head.last && head.count >= tsChunkSamples:
+		// The full head chunk is sealed as it is
+		ops = append(ops, putElement(key, TypeTimeSeries, familyTSChunk, sortableInt(head.first), appendChunk(nil, *head)))
+		*head = encodeChunk([]Sample{sample})
+	default:
+		// The head chunk is small, so it is simply decoded and encoded again
+		samples, err := head.decode()
+		if err != nil {
+			return err
+		}
+
+		if timestamp == head.last {
+			samples[len(samples)-1] = sample
+		} else {
+			samples = append(samples, sample)
+		}
+
+		*head = encodeChunk(samples)
+	}
+
+	trimmed, err := db.trimTimeSeries(key, series)
+	if err != nil {
+		return err
+	}
+
+	return db.writeCollection(key, TypeTimeSeries, entry, series.encode(), append(ops, trimmed...))
+}
+
+// TSRange returns the samples of the time series at key from and to the given timestamps, both inclusive, oldest
+// first.  Missing keys are empty time series.  Only the chunks overlapping the range are read
+func (db *DataStructure) TSRange(key []byte, from, to int64) ([]Sample, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, series, exists, err := db.openTimeSeries(key)
+	if err != nil || !exists || series.head.count == 0 {
+		return nil, err
+	}
+
+	// Samples past the retention may still be in the oldest chunk
+	if series.retention > 0 {
+		if cutoff := series.head.last - series.retention; cutoff > from {
+			from = cutoff
+		}
+	}
+
+	// A sealed chunk ends before the next one starts, the last one before the head chunk
+	chunks, err := db.sealedChunks(key, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	appendSamples := func(chunk tsChunk) error {
+		decoded, err := chunk.decode()
+		if err != nil {
+			return err
+		}
+
+		for _, sample := range decoded {
+			if sample.Timestamp >= from && sample.Timestamp <= to {
+				samples = append(samples, sample)
+			}
+		}
+
+		return nil
+	}
+
+	for i, sealed := range chunks {
+		next := series.head.first
+		if i+1 < len(chunks) {
+			next = chunks[i+1].first
+		}
+
+		if sealed.first > to || next <= from {
+			continue
+		}
+
+		_, value, err := db.readDataRecord(sealed.entry.offset)
+		if err != nil {
+			return nil, err
+		}
+
+		chunk, _, err := decodeChunk(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := appendSamples(chunk); err != nil {
+			return nil, err
+		}
+	}
+
+	if series.head.first <= to && series.head.last >= from {
+		if err := appendSamples(series.head); err != nil {
+			return nil, err
+		}
+	}
+
+	return samples, nil
+}
+
+// TSRangeAggregated downsamples the samples TSRange returns into one sample per bucket.  Buckets are aligned to
+// multiples of the bucket duration since the Unix epoch and each sample is at the start of its bucket.  Empty
+// buckets are left out
+func (db *DataStructure) TSRangeAggregated(key []byte, from, to int64, aggregation Aggregation, bucket time.Duration) ([]Sample, error) {
+	size := bucket.Milliseconds()
+	if size <= 0 {
+		return nil, errors.New("bucket must be at least a millisecond")
+	}
+
+	samples, err := db.TSRange(key, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var aggregated []Sample
+	count := 0
+	for _, sample := range samples {
+		// Round down, negative timestamps included
+		start := sample.Timestamp - sample.Timestamp%size
+		if sample.Timestamp%size < 0 {
+			start -= size
+		}
+
+		if len(aggregated) == 0 || aggregated[len(aggregated)-1].Timestamp != start {
+			if len(aggregated) > 0 && aggregation == AggregationAvg {
+				aggregated[len(aggregated)-1].Value /= float64(count)
+			}
+
+			aggregated = append(aggregated, Sample{Timestamp: start, Value: sample.Value})
+			if aggregation == AggregationCount {
+				aggregated[len(aggregated)-1].Value = 1
+			}
+			count = 1
+			continue
+		}
+
+		last := &aggregated[len(aggregated)-1]
+		switch aggregation {
+		case AggregationAvg, AggregationSum:
+			last.Value += sample.Value
+		case AggregationMin:
+			last.Value = math.Min(last.Value, sample.Value)
+		case AggregationMax:
+			last.Value = math.Max(last.Value, sample.Value)
+		case AggregationCount:
+			last.Value++
+		}
+		count++
+	}
+
+	if len(aggregated) > 0 && aggregation == AggregationAvg {
+		aggregated[len(aggregated)-1].Value /= float64(count)
+	}
+
+	return aggregated, nil
+}
+
+// openTimeSeries returns the index entry and decoded record of the time series at key and whether it exists, the
+// caller must hold the lock.  Missing keys are empty time series
+func (db *DataStructure) openTimeSeries(key []byte) (indexEntry, *timeSeries, bool, error) {
+	entry, meta, exists, err := db.openCollection(key, TypeTimeSeries)
+	if err != nil {
+		return indexEntry{}, nil, false, err
+	}
+
+	series, err := decodeTimeSeries(meta)
+	if err != nil {
+		return indexEntry{}, nil, false, err
+	}
+
+	return entry, series, exists, nil
+}
+
+// sealedChunks returns the sealed chunks of the existing time series at key in order, up to the first one starting
+// after to, the caller must hold the lock.  Only their keys are walked
+func (db *DataStructure) sealedChunks(key []byte, to int64) ([]sealedChunk, error) {
+	var chunks []sealedChunk
+
+	prefix := elementPrefix(key, familyTSChunk)
+	err := db.walkElements(prefix, prefix, func(element []byte, entry indexEntry) (bool, error) {
+		if len(element) != 8 {
+			return false, errors.New("malformed time series chunk key")
+		}
+
+		chunk := sealedChunk{first: decodeSortableInt(element), entry: entry}
+		chunks = append(chunks, chunk)
+
+		return chunk.first <= to, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return chunks, nil
+}
+
+// trimTimeSeries returns the ops deleting the sealed chunks of the existing time series at key that are entirely
+// past its retention, the caller must hold the lock.  A chunk is past it once the next chunk starts at or before
+// the cutoff
+func (db *DataStructure) trimTimeSeries(key []byte, series *timeSeries) ([]batchOp, error) {
+	if series.retention == 0 || series.head.count == 0 {
+		return nil, nil
+	}
+
+	cutoff := series.head.last - series.retention
+
+	chunks, err := db.sealedChunks(key, cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []batchOp
+	for i, chunk := range chunks {
+		next := series.head.first
+		if i+1 < len(chunks) {
+			next = chunks[i+1].first
+		}
+
+		if next > cutoff {
+			break
+		}
+
+		ops = append(ops, deleteElement(key, familyTSChunk, sortableInt(chunk.first)))
+	}
+
+	return ops, nil
+}
+
+// encode encodes the record of the key of the time series, its retention followed by its head chunk if it has samples
+func (s *timeSeries) encode() []byte {
+	value := binary.AppendUvarint(nil, uint64(s.retention))
+	if s.head.count == 0 {
+		return value
+	}
+
+	return appendChunk(value, s.head)
+}
+
+// decodeTimeSeries decodes the record of the key of a time series, an empty value being an empty time series
+func decodeTimeSeries(value []byte) (*timeSeries, error) {
+	series := &timeSeries{}
+	if len(value) == 0 {
+		return series, nil
+	}
+
+	retention, n := binary.Uvarint(value)
+	if n <= 0 || retention > math.MaxInt64 {
+		return nil, errors.New("malformed time series value")
+	}
+	series.retention = int64(retention)
+
+	if n == len(value) {
+		return series, nil
+	}
+
+	head, length, err := decodeChunk(value[n:])
+	if err != nil {
+		return nil, err
+	}
+	if n+length != len(value) {
+		return nil, errors.New("malformed time series value")
+	}
+	series.head = head
+
+	return series, nil
+}
+
+// appendChunk appends the encoded chunk to value: its sample count as a uvarint, its first and last timestamps as
+// varints, the length of its data as a uvarint and the data
+func appendChunk(value []byte, chunk tsChunk) []byte {
+	value = binary.AppendUvarint(value, uint64(chunk.count))
+	value = binary.AppendVarint(value, chunk.first)
+	value = binary.AppendVarint(value, chunk.last)
+	value = binary.AppendUvarint(value, uint64(len(chunk.data)))
+
+	return append(value, chunk.data...)
+}
+
+// decodeChunk decodes a chunk encoded by appendChunk at the start of value and returns it with its encoded length
+func decodeChunk(value []byte) (tsChunk, int, error) {
+	var chunk tsChunk
+	errMalformed := errors.New("malformed time series chunk")
+
+	count, n := binary.Uvarint(value)
+	if n <= 0 || count == 0 || count > math.MaxInt32 {
+		return tsChunk{}, 0, errMalformed
+	}
+	chunk.count = int(count)
+	pos := n
+
+	if chunk.first, n = binary.Varint(value[pos:]); n <= 0 {
+		return tsChunk{}, 0, errMalformed
+	}
+	pos += n
+
+	if chunk.last, n = binary.Varint(value[pos:]); n <= 0 {
+		return tsChunk{}, 0, errMalformed
+	}
+	pos += n
+
+	length, n := binary.Uvarint(value[pos:])
+	if n <= 0 || uint64(len(value)-pos-n) < length {
+		return tsChunk{}, 0, errMalformed
+	}
+	pos += n
+
+	chunk.data = value[pos : pos+int(length)]
+
+	return chunk, pos + int(length), nil
+}
+
+// Delta-of-delta buckets, the control bits before a difference and the number of bits it takes.
+// Differences too large for the last bucket take 64 bits after the control bits 1111
+var tsDeltaBuckets = []struct {
+	control     uint64
+	controlBits uint
+	bits        uint
+}{
+	{control: 0b10, controlBits: 2, bits: 7},
+	{control: 0b110, controlBits: 3, bits: 9},
+	{control: 0b1110, controlBits: 4, bits: 12},
+}
+
+// encodeChunk compresses samples, in timestamp order, into a chunk.  The first sample is written in full.
+// After it each timestamp is written as the change in the delta from the previous sample, a single 0 bit when
+// samples are regular.  Each value is XORed with the previous one, a single 0 bit when it did not change, otherwise
+// the meaningful bits of the XOR are written, reusing the window of leading and trailing zeros of the previous XOR
+// when they fit in it
+func encodeChunk(samples []Sample) tsChunk {
+	w := &bitWriter{}
+
+	var prevTimestamp, prevDelta int64
+	var prevBits uint64
+	prevLeading, prevTrailing := -1, -1
+
+	for i, sample := range samples {
+		valueBits := math.Float64bits(sample.Value)
+
+		if i == 0 {
+			w.writeBits(uint64(sample.Timestamp), 64)
+			w.writeBits(valueBits, 64)
+
+			prevTimestamp, prevBits = sample.Timestamp, valueBits
+			continue
+		}
+
+		// Timestamp
+		delta := sample.Timestamp - prevTimestamp
+		dod := delta - prevDelta
+		prevTimestamp, prevDelta = sample.Timestamp, delta
+
+		if dod == 0 {
+			w.writeBits(0, 1)
+		} else {
+			written := false
+			for _, bucket := range tsDeltaBuckets {
+				if dod >= -(1<<(bucket.bits-1)) && dod < 1<<(bucket.bits-1) {
+					w.writeBits(bucket.control, bucket.controlBits)
+					w.writeBits(uint64(dod), bucket.bits)
+					written = true
+					break
+				}
+			}
+
+			if !written {
+				w.writeBits(0b1111, 4)
+				w.writeBits(uint64(dod), 64)
+			}
+		}
+
+		// Value
+		xor := valueBits ^ prevBits
+		prevBits = valueBits
+
+		if xor == 0 {
+			w.writeBits(0, 1)
+			continue
+		}
+
+		leading := bits.LeadingZeros64(xor)
+		if leading > 31 {
+			leading = 31 // the leading zeros are written in 5 bits
+		}
+		trailing := bits.TrailingZeros64(xor)
+
+		if prevLeading >= 0 && leading >= prevLeading && trailing >= prevTrailing {
+			w.writeBits(0b10, 2)
+			w.writeBits(xor>>uint(prevTrailing), uint(64-prevLeading-prevTrailing))
+			continue
+		}
+
+		length := 64 - leading - trailing
+		w.writeBits(0b11, 2)
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(length-1), 6)
+		w.writeBits(xor>>uint(trailing), uint(length))
+
+		prevLeading, prevTrailing = leading, trailing
+	}
+
+	return tsChunk{
+		count: len(samples),
+		first: samples[0].Timestamp,
+		last:  samples[len(samples)-1].Timestamp,
+		data:  w.data,
+	}
+}
+
+// decode decompresses the samples of the chunk
+func (c tsChunk) decode() ([]Sample, error) {
+	r := &bitReader{data: c.data}
+
+	samples := make([]Sample, 0, c.count)
+
+	var prevTimestamp, prevDelta int64
+	var prevBits uint64
+	prevLeading, prevTrailing := 0, 0
+
+	for i := 0; i < c.count; i++ {
+		if i == 0 {
+			prevTimestamp = int64(r.readBits(64))
+			prevBits = r.readBits(64)
+
+			samples = append(samples, Sample{Timestamp: prevTimestamp, Value: math.Float64frombits(prevBits)})
+			continue
+		}
+
+		// Timestamp, the number of leading 1 bits picks the bucket
+		var dod int64
+		if r.readBits(1) == 1 {
+			bucket := 0
+			for bucket < len(tsDeltaBuckets) && r.readBits(1) == 1 {
+				bucket++
+			}
+
+			if bucket == len(tsDeltaBuckets) {
+				dod = int64(r.readBits(64))
+			} else {
+				size := tsDeltaBuckets[bucket].bits
+				dod = int64(r.readBits(size)<<(64-size)) >> (64 - size) // sign extend
+			}
+		}
+
+		prevDelta += dod
+		prevTimestamp += prevDelta
+
+		// Value
+		if r.readBits(1) == 1 {
+			if r.readBits(1) == 1 {
+				prevLeading = int(r.readBits(5))
+				prevTrailing = 64 - prevLeading - int(r.readBits(6)) - 1
+			}
+
+			prevBits ^= r.readBits(uint(64-prevLeading-prevTrailing)) << uint(prevTrailing)
+		}
+
+		samples = append(samples, Sample{Timestamp: prevTimestamp, Value: math.Float64frombits(prevBits)})
+	}
+
+	if r.overrun {
+		return nil, errors.New("malformed time series chunk")
+	}
+
+	return samples, nil
+}
+
+// bitWriter writes a stream of bits, most significant first
+type bitWriter struct {
+	data []byte
+	used uint // Bits used in the last byte
+}
+
+// writeBits writes the n low bits of value
+func (w *bitWriter) writeBits(value uint64, n uint) {
+	for i := n; i > 0; i-- {
+		if w.used == 0 {
+			w.data = append(w.data, 0)
+		}
+
+		w.data[len(w.data)-1] |= byte(value>>(i-1)&1) << (7 - w.used)
+		w.used = (w.used + 1) % 8
+	}
+}
+
+// bitReader reads a stream of bits written by a bitWriter
+type bitReader struct {
+	data    []byte
+	pos     int  // Index of the next bit
+	overrun bool // Set once a read runs past the end, the read returns 0 bits
+}
+
+// readBits reads n bits
+func (r *bitReader) readBits(n uint) uint64 {
+	var value uint64
+	for ; n > 0; n-- {
+		value <<= 1
+
+		if r.pos >= len(r.data)*8 {
+			r.overrun = true
+			continue
+		}
+
+		value |= uint64(r.data[r.pos/8]>>(7-r.pos%8)) & 1
+		r.pos++
+	}
+
+	return value
+}
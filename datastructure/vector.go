@@ -0,0 +1,859 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Vector log file format
+//
+// Vector indexes are kept in memory as HNSW graphs.  Every change is appended to a log next to the data file and
+// the graphs are rebuilt from it when the DB is opened.  Compaction rewrites the log with only the live vectors.
+//
+// Header
+// - `Magic` 4 bytes - "CHVX"
+// - `Version` 2 bytes (uint16)
+//
+// Entries, appended one after another
+// - `Length` 4 bytes (uint32) - Length of the payload
+// - `Checksum` 4 bytes (uint32) - CRC32C of the payload
+// - `Payload` Variable-length byte array
+//
+// Payload
+// - `Op` 1 byte - vectorOpCreate, vectorOpAdd, vectorOpDelete or vectorOpDrop
+// - `Name Length` 2 bytes (uint16)
+// - `Name` Variable-length byte array - Name of the index
+// - For vectorOpCreate, `Metric` 1 byte
+// - For vectorOpAdd, `Key Length` 4 bytes (uint32), `Key`, `Dimension` 4 bytes (uint32) and the vector as float32s
+// - For vectorOpDelete, `Key Length` 4 bytes (uint32) and `Key`
+const (
+	vectorMagic      = "CHVX" // Vector log magic
+	vectorVersion    = 1      // Current vector log format version
+	vectorHeaderSize = 4 + 2  // Magic and version
+	vectorExtension  = ".vec" // Extension of the vector log next to the data file
+
+	vectorOpCreate uint8 = 1 // Creates an index
+	vectorOpAdd    uint8 = 2 // Adds or replaces the vector of a key
+	vectorOpDelete uint8 = 3 // Removes the vector of a key
+	vectorOpDrop   uint8 = 4 // Drops an index
+
+	hnswM              = 16  // Neighbours of a node per layer, twice as many on the bottom layer
+	hnswEfConstruction = 200 // Candidates considered when inserting
+	hnswEfSearch       = 64  // Candidates considered when searching, at least k
+)
+
+// VectorMetric is the distance a vector index compares vectors by
+type VectorMetric uint8
+
+const (
+	Cosine VectorMetric = iota // 1 - cosine similarity
+	L2                         // Euclidean distance
+)
+
+// String returns the name of the metric
+func (m VectorMetric) String() string {
+	switch m {
+	case Cosine:
+		return "cosine"
+	case L2:
+		return "l2"
+	}
+
+	return "unknown"
+}
+
+// ParseVectorMetric parses cosine or l2 into a VectorMetric
+func ParseVectorMetric(metric string) (VectorMetric, error) {
+	switch strings.ToLower(metric) {
+	case "cosine":
+		return Cosine, nil
+	case "l2":
+		return L2, nil
+	}
+
+	return 0, fmt.Errorf("unknown vector metric %q", metric)
+}
+
+// ErrDimensionMismatch is returned when a vector does not have the dimension of the vectors already in its index
+var ErrDimensionMismatch = errors.New("vector dimension mismatch")
+
+// VectorResult is a key found by a vector search and the distance of its vector from the query
+type VectorResult struct {
+	Key      []byte
+	Distance float32
+}
+
+// vectorIndex is an HNSW graph of the vectors of an index.  Replaced and removed vectors stay in the graph, marked
+// deleted, so searches can still pass through them until compaction rebuilds the graph
+type vectorIndex struct {
+	name      string
+	metric    VectorMetric
+	dimension int            // Dimension of every vector, 0 until the first is added
+	nodes     []*hnswNode    // Nodes by id
+	ids       map[string]int // Node id of the current vector of each key
+	entry     int            // Node id searches start at, -1 while the graph is empty
+	maxLevel  int            // Level of the entry node
+	deleted   int            // Number of replaced and removed nodes
+	random    *rand.Rand     // Draws the level of new nodes
+}
+
+// hnswNode is a vector in the graph
+type hnswNode struct {
+	key       string
+	vector    []float32
+	neighbors [][]int // Neighbour node ids by level
+	deleted   bool
+}
+
+// CreateVectorIndex creates an empty vector index comparing vectors by metric
+func (db *DataStructure) CreateVectorIndex(name string, metric VectorMetric) error {
+	if name == "" || len(name) > math.MaxUint16 || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("bad index name %q", name)
+	}
+
+	if metric != Cosine && metric != L2 {
+		return fmt.Errorf("unknown vector metric %d", metric)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.vectorIndexes[name]; ok {
+		return ErrIndexExists
+	}
+
+	payload := encodeVectorOp(vectorOpCreate, name)
+	payload = append(payload, uint8(metric))
+
+	if err := db.appendVectorLog(payload); err != nil {
+		return err
+	}
+
+	db.vectorIndexes[name] = newVectorIndex(name, metric)
+
+	return nil
+}
+
+// VectorAdd adds the vector of key to the vector index name, replacing the vector key had.  Every vector of an
+// index has the dimension of the first one added.  The key must exist, deleting it removes its vectors
+func (db *DataStructure) VectorAdd(name string, key []byte, vector []float32) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	index, ok := db.vectorIndexes[name]
+	if !ok {
+		return ErrIndexNotFound
+	}
+
+	if err := index.check(vector); err != nil {
+		return err
+	}
+
+	if _, ok := db.liveEntry(string(key), time.Now().UnixMilli()); !ok {
+		return ErrKeyNotFound
+	}
+
+	if err := db.appendVectorLog(encodeVectorAdd(name, string(key), vector)); err != nil {
+		return err
+	}
+
+	index.insert(string(key), vector)
+
+	return nil
+}
+
+// VectorDelete removes the vector of key from the vector index name.  It returns false when key had no vector
+func (db *DataStructure) VectorDelete(name string, key []byte) (bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	index, ok := db.vectorIndexes[name]
+	if !ok {
+		return false, ErrIndexNotFound
+	}
+
+	if _, ok := index.ids[string(key)]; !ok {
+		return false, nil
+	}
+
+	if err := db.appendVectorLog(encodeVectorDelete(name, string(key))); err != nil {
+		return false, err
+	}
+
+	index.remove(string(key))
+
+	return true, nil
+}
+
+// DropVectorIndex drops the vector index name and every vector in it
+func (db *DataStructure) DropVectorIndex(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.vectorIndexes[name]; !ok {
+		return ErrIndexNotFound
+	}
+
+	if err := db.appendVectorLog(encodeVectorOp(vectorOpDrop, name)); err != nil {
+		return err
+	}
+
+	delete(db.vectorIndexes, name)
+
+	return nil
+}
+
+// unindexVectors removes the vectors of a deleted key from every vector index, the caller must hold the lock
+func (db *DataStructure) unindexVectors(key string) error {
+	names := make([]string, 0, len(db.vectorIndexes))
+	for name, index := range db.vectorIndexes {
+		if _, ok := index.ids[key]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := db.appendVectorLog(encodeVectorDelete(name, key)); err != nil {
+			return err
+		}
+
+		db.vectorIndexes[name].remove(key)
+	}
+
+	return nil
+}
+
+// VectorSearch returns the k keys of the vector index name whose vectors are nearest to vector, nearest first.
+// The search is approximate, like any HNSW search it may miss a few of the true nearest neighbours
+func (db *DataStructure) VectorSearch(name string, vector []float32, k int) ([]VectorResult, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	index, ok := db.vectorIndexes[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+
+	if k <= 0 || index.entry < 0 {
+		return nil, nil
+	}
+
+	if err := index.check(vector); err != nil {
+		return nil, err
+	}
+
+	// Keys that expired but were not deleted yet still have their vectors
+	now := time.Now().UnixMilli()
+
+	return index.search(vector, k, func(key string) bool {
+		_, ok := db.liveEntry(key, now)
+		return ok
+	}), nil
+}
+
+// openVectorLog opens the vector log, creating it if needed, and rebuilds the vector indexes from it.
+// A torn entry at the end of the log is cut off
+func (db *DataStructure) openVectorLog() error {
+	file, err := os.OpenFile(siblingFilename(db.dataFilename, vectorExtension), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	db.vectorFile = file
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+
+	// A new vector log only needs a header
+	if len(data) == 0 {
+		header := append([]byte(vectorMagic), 0, 0)
+		binary.LittleEndian.PutUint16(header[len(vectorMagic):], vectorVersion)
+
+		if _, err := file.WriteAt(header, 0); err != nil {
+			return err
+		}
+		db.vectorSize = vectorHeaderSize
+
+		return nil
+	}
+
+	if len(data) < vectorHeaderSize || string(data[:len(vectorMagic)]) != vectorMagic {
+		return errors.New("not a vector log")
+	}
+
+	if version := binary.LittleEndian.Uint16(data[len(vectorMagic):]); version > vectorVersion {
+		return fmt.Errorf("unsupported vector log version %d", version)
+	}
+
+	// Only the latest vector of each key is inserted, in the order the keys were first added.  Removed vectors
+	// are left nil
+	type added struct {
+		index  string
+		key    string
+		vector []float32
+	}
+	var adds []added
+	latest := make(map[[2]string]int)
+
+	pos := vectorHeaderSize
+	for pos+8 <= len(data) {
+		// Read the frame header
+		length := int(binary.LittleEndian.Uint32(data[pos:]))
+		checksum := binary.LittleEndian.Uint32(data[pos+4:])
+
+		if pos+8+length > len(data) {
+			break
+		}
+
+		payload := data[pos+8 : pos+8+length]
+		if crc32.Checksum(payload, crcTable) != checksum {
+			break
+		}
+
+		op, name, rest, err := decodeVectorOp(payload)
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case vectorOpCreate:
+			if len(rest) != 1 {
+				return errors.New("malformed vector log entry")
+			}
+
+			db.vectorIndexes[name] = newVectorIndex(name, VectorMetric(rest[0]))
+		case vectorOpAdd:
+			key, vector, err := decodeVectorAdd(rest)
+			if err != nil {
+				return err
+			}
+
+			if i, ok := latest[[2]string{name, key}]; ok {
+				adds[i].vector = vector
+			} else {
+				latest[[2]string{name, key}] = len(adds)
+				adds = append(adds, added{index: name, key: key, vector: vector})
+			}
+		case vectorOpDelete:
+			key, err := decodeVectorKey(rest)
+			if err != nil {
+				return err
+			}
+
+			if i, ok := latest[[2]string{name, key}]; ok {
+				adds[i].vector = nil
+				delete(latest, [2]string{name, key})
+			}
+		case vectorOpDrop:
+			delete(db.vectorIndexes, name)
+
+			for id, i := range latest {
+				if id[0] == name {
+					adds[i].vector = nil
+					delete(latest, id)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown vector log op %d", op)
+		}
+
+		pos += 8 + length
+	}
+
+	// Cut off a torn entry so new entries are appended after the last complete one
+	if pos < len(data) {
+		if err := file.Truncate(int64(pos)); err != nil {
+			return err
+		}
+	}
+	db.vectorSize = int64(pos)
+
+	// A crash can leave the vectors of a deleted key in the log, the key is gone from the index
+	for _, add := range adds {
+		if _, live := db.index[add.key]; add.vector == nil || !live {
+			continue
+		}
+
+		if index, ok := db.vectorIndexes[add.index]; ok {
+			index.insert(add.key, add.vector)
+		}
+	}
+
+	return nil
+}
+
+// compactVectorLog rewrites the vector log with only the indexes and the live vectors in them and rebuilds the
+// graphs without their deleted nodes, the caller must hold the lock
+func (db *DataStructure) compactVectorLog() error {
+	names := make([]string, 0, len(db.vectorIndexes))
+	for name := range db.vectorIndexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := append([]byte(vectorMagic), 0, 0)
+	binary.LittleEndian.PutUint16(data[len(vectorMagic):], vectorVersion)
+
+	frame := func(payload []byte) {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(payload)))
+		data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(payload, crcTable))
+		data = append(data, payload...)
+	}
+
+	rebuilt := make(map[string]*vectorIndex, len(names))
+	for _, name := range names {
+		index := db.vectorIndexes[name]
+		frame(append(encodeVectorOp(vectorOpCreate, name), uint8(index.metric)))
+
+		// Insert in node order so the graph is built the way it was.  Cosine vectors are written normalized,
+		// which compares the same
+		compacted := newVectorIndex(name, index.metric)
+		for _, node := range index.nodes {
+			if node.deleted {
+				continue
+			}
+
+			frame(encodeVectorAdd(name, node.key, node.vector))
+			compacted.insert(node.key, node.vector)
+		}
+
+		rebuilt[name] = compacted
+	}
+
+	filename := db.vectorFile.Name()
+	if err := writeFileAtomic(filename, data); err != nil {
+		return err
+	}
+
+	// Swap the compacted vector log in
+	if err := db.vectorFile.Close(); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	db.vectorFile = file
+	db.vectorSize = int64(len(data))
+	db.vectorIndexes = rebuilt
+
+	return nil
+}
+
+// appendVectorLog appends an entry with payload to the vector log, the caller must hold the lock
+func (db *DataStructure) appendVectorLog(payload []byte) error {
+	frame := binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))
+	frame = binary.LittleEndian.AppendUint32(frame, crc32.Checksum(payload, crcTable))
+	frame = append(frame, payload...)
+
+	if _, err := db.vectorFile.WriteAt(frame, db.vectorSize); err != nil {
+		return err
+	}
+	db.vectorSize += int64(len(frame))
+
+	if db.options.SyncPolicy == SyncAlways {
+		return db.vectorFile.Sync()
+	}
+
+	return nil
+}
+
+// encodeVectorOp encodes the start of a vector log payload
+func encodeVectorOp(op uint8, name string) []byte {
+	payload := []byte{op}
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(len(name)))
+	return append(payload, name...)
+}
+
+// encodeVectorAdd encodes a vectorOpAdd payload
+func encodeVectorAdd(name, key string, vector []float32) []byte {
+	payload := encodeVectorOp(vectorOpAdd, name)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(key)))
+	payload = append(payload, key...)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(vector)))
+	for _, value := range vector {
+		payload = binary.LittleEndian.AppendUint32(payload, math.Float32bits(value))
+	}
+
+	return payload
+}
+
+// encodeVectorDelete encodes a vectorOpDelete payload
+func encodeVectorDelete(name, key string) []byte {
+	payload := encodeVectorOp(vectorOpDelete, name)
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(key)))
+	return append(payload, key...)
+}
+
+// decodeVectorOp decodes the op and index name of a vector log payload and returns the rest of it
+func decodeVectorOp(payload []byte) (uint8, string, []byte, error) {
+	if len(payload) < 3 {
+		return 0, "", nil, errors.New("malformed vector log entry")
+	}
+
+	nameLength := int(binary.LittleEndian.Uint16(payload[1:]))
+	if len(payload) < 3+nameLength {
+		return 0, "", nil, errors.New("malformed vector log entry")
+	}
+
+	return payload[0], string(payload[3 : 3+nameLength]), payload[3+nameLength:], nil
+}
+
+// decodeVectorKey decodes the key of a vectorOpDelete payload
+func decodeVectorKey(rest []byte) (string, error) {
+	if len(rest) < 4 || len(rest) != 4+int(binary.LittleEndian.Uint32(rest)) {
+		return "", errors.New("malformed vector log entry")
+	}
+
+	return string(rest[4:]), nil
+}
+
+// decodeVectorAdd decodes the key and vector of a vectorOpAdd payload
+func decodeVectorAdd(rest []byte) (string, []float32, error) {
+	if len(rest) < 4 {
+		return "", nil, errors.New("malformed vector log entry")
+	}
+
+	keyLength := int(binary.LittleEndian.Uint32(rest))
+	if len(rest) < 4+keyLength+4 {
+		return "", nil, errors.New("malformed vector log entry")
+	}
+
+	key := string(rest[4 : 4+keyLength])
+	rest = rest[4+keyLength:]
+
+	dimension := int(binary.LittleEndian.Uint32(rest))
+	rest = rest[4:]
+	if len(rest) != 4*dimension {
+		return "", nil, errors.New("malformed vector log entry")
+	}
+
+	vector := make([]float32, dimension)
+	for i := range vector {
+		vector[i] = math.Float32frombits(binary.LittleEndian.Uint32(rest[4*i:]))
+	}
+
+	return key, vector, nil
+}
+
+// newVectorIndex creates an empty vector index
+func newVectorIndex(name string, metric VectorMetric) *vectorIndex {
+	return &vectorIndex{
+		name:   name,
+		metric: metric,
+		ids:    make(map[string]int),
+		entry:  -1,
+		random: rand.New(rand.NewSource(1)),
+	}
+}
+
+// check makes sure vector can be added to or searched in the index
+func (index *vectorIndex) check(vector []float32) error {
+	if len(vector) == 0 {
+		return errors.New("empty vector")
+	}
+
+	if index.dimension != 0 && len(vector) != index.dimension {
+		return ErrDimensionMismatch
+	}
+
+	var norm float64
+	for _, value := range vector {
+		if math.IsNaN(float64(value)) || math.IsInf(float64(value), 0) {
+			return errors.New("vector has a value that is not a number")
+		}
+		norm += float64(value) * float64(value)
+	}
+
+	if index.metric == Cosine && norm == 0 {
+		return errors.New("cosine distance of a zero vector")
+	}
+
+	return nil
+}
+
+// prepare returns the vector as it is compared, cosine vectors are normalized so the distance is a dot product
+func (index *vectorIndex) prepare(vector []float32) []float32 {
+	prepared := append([]float32(nil), vector...)
+
+	if index.metric == Cosine {
+		var norm float64
+		for _, value := range prepared {
+			norm += float64(value) * float64(value)
+		}
+		norm = math.Sqrt(norm)
+
+		for i := range prepared {
+			prepared[i] = float32(float64(prepared[i]) / norm)
+		}
+	}
+
+	return prepared
+}
+
+// distance returns the distance between two prepared vectors.  L2 distances are squared, see result
+func (index *vectorIndex) distance(a, b []float32) float32 {
+	var sum float32
+
+	if index.metric == Cosine {
+		for i := range a {
+			sum += a[i] * b[i]
+		}
+		return 1 - sum
+	}
+
+	for i := range a {
+		d := a[i] - b[i]
+		sum += d * d
+	}
+	return sum
+}
+
+// result returns the distance reported for a distance from distance
+func (index *vectorIndex) result(distance float32) float32 {
+	if index.metric == L2 {
+		return float32(math.Sqrt(float64(distance)))
+	}
+
+	return distance
+}
+
+// insert adds the vector of key to the graph, marking the node of its previous vector deleted
+func (index *vectorIndex) insert(key string, vector []float32) {
+	if index.dimension == 0 {
+		index.dimension = len(vector)
+	}
+
+	if id, ok := index.ids[key]; ok {
+		index.nodes[id].deleted = true
+		index.deleted++
+	}
+
+	// Draw the level of the node, each level up holding about 1/hnswM of the nodes below
+	level := int(-math.Log(1-index.random.Float64()) / math.Log(hnswM))
+
+	node := &hnswNode{key: key, vector: index.prepare(vector), neighbors: make([][]int, level+1)}
+	id := len(index.nodes)
+	index.nodes = append(index.nodes, node)
+	index.ids[key] = id
+
+	if index.entry < 0 {
+		index.entry, index.maxLevel = id, level
+		return
+	}
+
+	// Greedily descend to the level of the node
+	entry := index.entry
+	for l := index.maxLevel; l > level; l-- {
+		entry = index.searchLayer(node.vector, entry, 1, l)[0].id
+	}
+
+	// Connect the node to its nearest neighbours on every level it is on
+	for l := min(level, index.maxLevel); l >= 0; l-- {
+		candidates := index.searchLayer(node.vector, entry, hnswEfConstruction, l)
+
+		node.neighbors[l] = index.closest(candidates, maxNeighbors(l))
+
+		for _, neighbor := range node.neighbors[l] {
+			index.connect(neighbor, id, l)
+		}
+
+		entry = candidates[0].id
+	}
+
+	if level > index.maxLevel {
+		index.entry, index.maxLevel = id, level
+	}
+}
+
+// remove marks the node of the vector of key deleted
+func (index *vectorIndex) remove(key string) {
+	id, ok := index.ids[key]
+	if !ok {
+		return
+	}
+
+	index.nodes[id].deleted = true
+	index.deleted++
+	delete(index.ids, key)
+}
+
+// connect adds a link from node id to neighbor on level, keeping only the nearest links once there are too many
+func (index *vectorIndex) connect(id, neighbor, level int) {
+	node := index.nodes[id]
+	node.neighbors[level] = append(node.neighbors[level], neighbor)
+
+	if len(node.neighbors[level]) <= maxNeighbors(level) {
+		return
+	}
+
+	candidates := make([]hnswCandidate, len(node.neighbors[level]))
+	for i, other := range node.neighbors[level] {
+		candidates[i] = hnswCandidate{id: other, distance: index.distance(node.vector, index.nodes[other].vector)}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	node.neighbors[level] = index.closest(candidates, maxNeighbors(level))
+}
+
+// closest returns the ids of the first n of candidates sorted by distance
+func (index *vectorIndex) closest(candidates []hnswCandidate, n int) []int {
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	ids := make([]int, len(candidates))
+	for i, candidate := range candidates {
+		ids[i] = candidate.id
+	}
+
+	return ids
+}
+
+// search returns the k live nodes nearest to vector whose keys pass live
+func (index *vectorIndex) search(vector []float32, k int, live func(key string) bool) []VectorResult {
+	query := index.prepare(vector)
+
+	entry := index.entry
+	for l := index.maxLevel; l > 0; l-- {
+		entry = index.searchLayer(query, entry, 1, l)[0].id
+	}
+
+	// Deleted nodes take up candidates, look at enough to still find k live ones
+	ef := max(hnswEfSearch, k) + min(index.deleted, k)
+
+	var results []VectorResult
+	for _, candidate := range index.searchLayer(query, entry, ef, 0) {
+		node := index.nodes[candidate.id]
+		if node.deleted || !live(node.key) {
+			continue
+		}
+
+		results = append(results, VectorResult{Key: []byte(node.key), Distance: index.result(candidate.distance)})
+		if len(results) == k {
+			break
+		}
+	}
+
+	return results
+}
+
+// searchLayer returns up to ef nodes on level nearest to vector, nearest first, searching from the entry node
+func (index *vectorIndex) searchLayer(vector []float32, entry, ef, level int) []hnswCandidate {
+	visited := map[int]struct{}{entry: {}}
+
+	first := hnswCandidate{id: entry, distance: index.distance(vector, index.nodes[entry].vector)}
+	candidates := &hnswHeap{items: []hnswCandidate{first}}            // Nearest first
+	found := &hnswHeap{items: []hnswCandidate{first}, farthest: true} // Farthest first
+
+	for candidates.Len() > 0 {
+		candidate := heap.Pop(candidates).(hnswCandidate)
+
+		// Every node left is farther than the farthest found
+		if found.Len() >= ef && candidate.distance > found.items[0].distance {
+			break
+		}
+
+		for _, neighbor := range index.nodes[candidate.id].neighbors[level] {
+			if _, ok := visited[neighbor]; ok {
+				continue
+			}
+			visited[neighbor] = struct{}{}
+
+			distance := index.distance(vector, index.nodes[neighbor].vector)
+			if found.Len() < ef || distance < found.items[0].distance {
+				heap.Push(candidates, hnswCandidate{id: neighbor, distance: distance})
+				heap.Push(found, hnswCandidate{id: neighbor, distance: distance})
+
+				if found.Len() > ef {
+					heap.Pop(found)
+				}
+			}
+		}
+	}
+
+	sort.Slice(found.items, func(i, j int) bool {
+		return found.items[i].distance < found.items[j].distance
+	})
+
+	return found.items
+}
+
+// maxNeighbors returns how many neighbours a node keeps on level
+func maxNeighbors(level int) int {
+	if level == 0 {
+		return 2 * hnswM
+	}
+
+	return hnswM
+}
+
+// hnswCandidate is a node and its distance from a vector
+type hnswCandidate struct {
+	id       int
+	distance float32
+}
+
+// hnswHeap is a heap of candidates, nearest first or farthest first
+type hnswHeap struct {
+	items    []hnswCandidate
+	farthest bool
+}
+
+// Len returns the number of candidates
+func (h *hnswHeap) Len() int { return len(h.items) }
+
+// Less orders the candidates nearest or farthest first
+func (h *hnswHeap) Less(i, j int) bool {
+	if h.farthest {
+		return h.items[i].distance > h.items[j].distance
+	}
+	return h.items[i].distance < h.items[j].distance
+}
+
+// Swap swaps two candidates
+func (h *hnswHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+// Push adds a candidate, use heap.Push
+func (h *hnswHeap) Push(x interface{}) { h.items = append(h.items, x.(hnswCandidate)) }
+
+// Pop removes the last candidate, use heap.Pop
+func (h *hnswHeap) Pop() interface{} {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
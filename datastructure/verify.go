@@ -0,0 +1,96 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"errors"
+)
+
+// Verify reads every record in the data file, checking its checksum, and returns the offsets of damaged regions
+func (db *DataStructure) Verify() ([]int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var damaged []int64
+
+	err := db.scanRecords(func(offset int64, record dataRecord) error {
+		return nil
+	}, func(start, end int64) error {
+		damaged = append(damaged, start)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return damaged, nil
+}
+
+// scanRecords walks the data file record by record calling fn for every intact record and corrupted for
+// every damaged region.  After a damaged record the scan resumes at the next offset holding an intact record
+func (db *DataStructure) scanRecords(fn func(offset int64, record dataRecord) error, corrupted func(start, end int64) error) error {
+	offset := db.dataStart()
+
+	for offset < db.nextOffset {
+		record, err := db.readRecord(offset)
+		if err == nil {
+			if err := fn(offset, record); err != nil {
+				return err
+			}
+
+			offset += record.size
+			continue
+		}
+
+		if !errors.Is(err, ErrCorrupted) {
+			return err
+		}
+
+		// Find where the intact records pick up again
+		end, err := db.resyncRecords(offset + 1)
+		if err != nil {
+			return err
+		}
+
+		if err := corrupted(offset, end); err != nil {
+			return err
+		}
+
+		offset = end
+	}
+
+	return nil
+}
+
+// resyncRecords returns the first offset from start holding an intact record, or the end of the data file
+func (db *DataStructure) resyncRecords(start int64) (int64, error) {
+	for offset := start; offset < db.nextOffset; offset++ {
+		_, err := db.readRecord(offset)
+		if err == nil {
+			return offset, nil
+		}
+
+		if !errors.Is(err, ErrCorrupted) {
+			return 0, err
+		}
+	}
+
+	return db.nextOffset, nil
+}
@@ -0,0 +1,75 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrConflict is returned when a key is not at the version a write expected
+var ErrConflict = errors.New("version conflict")
+
+// Version returns the current version of a key.  Keys that do not exist are at version 0
+func (db *DataStructure) Version(key []byte) uint64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entry, _ := db.liveEntry(string(key), time.Now().UnixMilli())
+	return entry.version
+}
+
+// GetWithVersion retrieves the value associated with a key along with the version of the key
+func (db *DataStructure) GetWithVersion(key []byte) ([]byte, uint64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entry, ok := db.liveEntry(string(key), time.Now().UnixMilli())
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+
+	if entry.valueType != TypeString {
+		return nil, 0, ErrWrongType
+	}
+
+	_, value, err := db.readDataRecord(entry.offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return value, entry.version, nil
+}
+
+// CompareAndSwap puts the key-value pair only if the key is at the expected version, returning the new version.
+// An expected version of 0 only puts keys that do not exist.  ErrConflict is returned if the key is at another version
+func (db *DataStructure) CompareAndSwap(key []byte, expected uint64, value []byte) (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	batch := &Batch{ops: []batchOp{{key: key, value: value}}}
+	batch.Expect(key, expected)
+
+	if err := db.writeBatch(batch); err != nil {
+		return 0, err
+	}
+
+	return db.index[string(key)].version, nil
+}
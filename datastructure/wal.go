@@ -0,0 +1,324 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Write-ahead log file format
+//
+// Header
+// - `Magic` 4 bytes - "CHWL"
+// - `Version` 2 bytes (uint16)
+//
+// Frames, one per mutation.  A frame holds the encoded data records exactly as they are written to the data file.
+// - `Length` 4 bytes (uint32) - Length of the payload
+// - `Checksum` 4 bytes (uint32) - CRC32C of the payload
+// - `Offset` 8 bytes (int64) - Offset in the data file the records are written at
+// - `Records` Variable-length byte array - Encoded data records
+const (
+	walMagic           = "CHWL"   // Write-ahead log magic
+	walVersion         = 1        // Current write-ahead log format version
+	walHeaderSize      = 4 + 2    // Magic and version
+	walFrameHeaderSize = 4 + 4    // Length and checksum
+	walCheckpointSize  = 16 << 20 // Write-ahead log size that triggers a checkpoint
+)
+
+// crcTable is the CRC32C (Castagnoli) table used for checksums
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncPolicy controls when the write-ahead log is flushed to stable storage
+type SyncPolicy int
+
+const (
+	SyncAlways   SyncPolicy = iota // Sync after every mutation
+	SyncInterval                   // Sync every Options.SyncInterval
+	SyncNever                      // Leave flushing to the operating system
+)
+
+// ParseSyncPolicy parses always, interval or never into a SyncPolicy
+func ParseSyncPolicy(policy string) (SyncPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+
+	return 0, fmt.Errorf("unknown sync policy %q", policy)
+}
+
+// Options configure how a DataStructure is opened
+type Options struct {
+	WALFilename  string        // Write-ahead log location, defaults to the data filename with a .wal extension
+	SyncPolicy   SyncPolicy    // When the write-ahead log is synced
+	SyncInterval time.Duration // How often the write-ahead log is synced with SyncInterval
+
+	// SnapshotMaxAge is how long a snapshot may stay open.  The versions an older snapshot pins are forgotten
+	// and reading from it returns ErrSnapshotExpired, so a forgotten snapshot cannot grow memory forever.
+	// 0 lets snapshots stay open until they are released
+	SnapshotMaxAge time.Duration
+}
+
+// DefaultOptions are the options used by OpenDB
+var DefaultOptions = Options{
+	SyncPolicy:     SyncInterval,
+	SyncInterval:   time.Second,
+	SnapshotMaxAge: 10 * time.Minute,
+}
+
+// writeAheadLog records every mutation before it is applied to the data and index files
+type writeAheadLog struct {
+	file *os.File
+	size int64
+}
+
+// walFilename derives the write-ahead log filename from the data filename
+func walFilename(dataFilename string) string {
+	return siblingFilename(dataFilename, ".wal")
+}
+
+// siblingFilename derives the filename of a file kept next to the data file by replacing its extension with ext
+func siblingFilename(dataFilename, ext string) string {
+	if dot := strings.LastIndex(dataFilename, "."); dot > strings.LastIndexAny(dataFilename, `/\`) {
+		return dataFilename[:dot] + ext
+	}
+
+	return dataFilename + ext
+}
+
+// openWAL opens or creates a write-ahead log
+func openWAL(filename string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	wal := &writeAheadLog{file: file, size: fileInfo.Size()}
+
+	// A new write-ahead log only needs a header
+	if wal.size == 0 {
+		if err := wal.reset(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return wal, nil
+}
+
+// append writes a frame for records that will be written at offset in the data file
+func (wal *writeAheadLog) append(offset int64, records []byte) error {
+	frame := make([]byte, walFrameHeaderSize, walFrameHeaderSize+8+len(records))
+	frame = binary.LittleEndian.AppendUint64(frame, uint64(offset))
+	frame = append(frame, records...)
+
+	payload := frame[walFrameHeaderSize:]
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, crcTable))
+
+	if _, err := wal.file.WriteAt(frame, wal.size); err != nil {
+		return err
+	}
+
+	wal.size += int64(len(frame))
+
+	return nil
+}
+
+// replay calls fn for every complete frame in the write-ahead log in the order they were written.
+// A torn or corrupted frame ends the log
+func (wal *writeAheadLog) replay(fn func(offset int64, records []byte) error) error {
+	walData, err := io.ReadAll(io.NewSectionReader(wal.file, 0, wal.size))
+	if err != nil {
+		return err
+	}
+
+	if len(walData) < walHeaderSize || !bytes.HasPrefix(walData, []byte(walMagic)) {
+		return errors.New("corrupted write-ahead log header")
+	}
+
+	version := binary.LittleEndian.Uint16(walData[len(walMagic):])
+	if version != walVersion {
+		return fmt.Errorf("unsupported write-ahead log version %d", version)
+	}
+
+	pos := walHeaderSize
+	for pos+walFrameHeaderSize <= len(walData) {
+		length := int(binary.LittleEndian.Uint32(walData[pos:]))
+		checksum := binary.LittleEndian.Uint32(walData[pos+4:])
+
+		if length < 8 || pos+walFrameHeaderSize+length > len(walData) {
+			break
+		}
+
+		payload := walData[pos+walFrameHeaderSize : pos+walFrameHeaderSize+length]
+		if crc32.Checksum(payload, crcTable) != checksum {
+			break
+		}
+
+		if err := fn(int64(binary.LittleEndian.Uint64(payload)), payload[8:]); err != nil {
+			return err
+		}
+
+		pos += walFrameHeaderSize + length
+	}
+
+	return nil
+}
+
+// reset truncates the write-ahead log back to its header.  Only call once the data and index files are synced
+func (wal *writeAheadLog) reset() error {
+	if err := wal.file.Truncate(0); err != nil {
+		return err
+	}
+
+	header := append([]byte(walMagic), 0, 0)
+	binary.LittleEndian.PutUint16(header[len(walMagic):], walVersion)
+
+	if _, err := wal.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	wal.size = int64(len(header))
+
+	return wal.file.Sync()
+}
+
+// sync flushes the write-ahead log to stable storage
+func (wal *writeAheadLog) sync() error {
+	return wal.file.Sync()
+}
+
+// close closes the write-ahead log file
+func (wal *writeAheadLog) close() error {
+	return wal.file.Close()
+}
+
+// writeRecords logs encoded records to the write-ahead log and then writes them at the end of the data file.
+// It returns the offset the records were written at
+func (db *DataStructure) writeRecords(records []byte) (int64, error) {
+	offset := db.nextOffset
+
+	if err := db.wal.append(offset, records); err != nil {
+		return 0, err
+	}
+
+	if db.options.SyncPolicy == SyncAlways {
+		if err := db.wal.sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := db.dataFile.WriteAt(records, offset); err != nil {
+		return 0, err
+	}
+
+	db.nextOffset += int64(len(records))
+
+	return offset, nil
+}
+
+// replayWAL re-applies every mutation in the write-ahead log to the data file and index.
+// Records are written at the same offsets they were logged with so replaying twice is harmless
+func (db *DataStructure) replayWAL() error {
+	err := db.wal.replay(func(offset int64, records []byte) error {
+		if _, err := db.dataFile.WriteAt(records, offset); err != nil {
+			return err
+		}
+
+		if end := offset + int64(len(records)); end > db.nextOffset {
+			db.nextOffset = end
+		}
+
+		// Point the index at every replayed record
+		for pos := int64(0); pos < int64(len(records)); {
+			record, err := decodeRecordHeader(records[pos:], db.formatVersion)
+			if err != nil {
+				return err
+			}
+
+			if err := db.applyRecord(offset+pos, record); err != nil {
+				return err
+			}
+
+			pos += record.size
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.checkpoint()
+}
+
+// checkpoint flushes the data and index files to stable storage and empties the write-ahead log
+func (db *DataStructure) checkpoint() error {
+	if err := db.dataFile.Sync(); err != nil {
+		return err
+	}
+
+	if err := db.indexFile.Sync(); err != nil {
+		return err
+	}
+
+	return db.wal.reset()
+}
+
+// syncWAL syncs the write-ahead log and the vector log every SyncInterval until Close is called
+func (db *DataStructure) syncWAL() {
+	ticker := time.NewTicker(db.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-db.stopSync:
+			return
+		case <-ticker.C:
+			db.mu.Lock()
+			if err := db.wal.sync(); err != nil {
+				fmt.Println("Error syncing write-ahead log:", err)
+			}
+			if err := db.vectorFile.Sync(); err != nil {
+				fmt.Println("Error syncing vector log:", err)
+			}
+			db.mu.Unlock()
+		}
+	}
+}
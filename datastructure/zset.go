@@ -0,0 +1,307 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package datastructure
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// A sorted set keeps two records per member: one keyed by the member holding its score, to look the score up,
+// and one keyed by the score then the member, so the ordered index walks members by score.  Range and rank
+// queries only walk the keys they need and never read the data file
+
+// ScoredMember is a member of a sorted set and its score
+type ScoredMember struct {
+	Member []byte
+	Score  float64
+}
+
+// Families of the elements of a sorted set
+const (
+	familyZSetMember byte = 'z' // Member, the value is its score
+	familyZSetScore  byte = 's' // Score then member, the value is empty
+)
+
+// sortableScore encodes score so scores sort in order as keys.  Positive scores have their sign bit set, negative
+// scores have every bit flipped.  Zero is encoded the same whatever its sign
+func sortableScore(score float64) []byte {
+	if score == 0 {
+		score = 0
+	}
+
+	bits := math.Float64bits(score)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+
+	return binary.BigEndian.AppendUint64(nil, bits)
+}
+
+// decodeSortableScore decodes a score encoded by sortableScore
+func decodeSortableScore(encoded []byte) float64 {
+	bits := binary.BigEndian.Uint64(encoded)
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+
+	return math.Float64frombits(bits)
+}
+
+// scoreElement returns the score then member element of a member of a sorted set
+func scoreElement(member ScoredMember) []byte {
+	return append(sortableScore(member.Score), member.Member...)
+}
+
+// ZAdd adds members to the sorted set at key, or updates their score if they are already in it, and returns
+// how many members were added.  A missing key is created as an empty sorted set first.  ErrNotFloat is returned for
+// a score that is NaN.  Only the members that change and the size of the set are written
+func (db *DataStructure) ZAdd(key []byte, members ...ScoredMember) (int, error) {
+	for _, member := range members {
+		if math.IsNaN(member.Score) {
+			return 0, ErrNotFloat
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, meta, exists, err := db.openCollection(key, TypeZSet)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	if exists {
+		if count, err = decodeCount(meta); err != nil {
+			return 0, err
+		}
+	}
+
+	// Members can be given more than once, the last score wins
+	scores := make(map[string]float64)
+
+	var ops []batchOp
+	added := 0
+
+	for _, member := range members {
+		score, found := scores[string(member.Member)]
+		if !found && exists {
+			if score, found, err = db.memberScore(key, member.Member); err != nil {
+				return 0, err
+			}
+		}
+
+		if found && score == member.Score {
+			continue
+		}
+
+		if found {
+			ops = append(ops, deleteElement(key, familyZSetScore, scoreElement(ScoredMember{Member: member.Member, Score: score})))
+		} else {
+			added++
+		}
+
+		scores[string(member.Member)] = member.Score
+		ops = append(ops,
+			putElement(key, TypeZSet, familyZSetMember, member.Member, binary.BigEndian.AppendUint64(nil, math.Float64bits(member.Score))),
+			putElement(key, TypeZSet, familyZSetScore, scoreElement(member), nil))
+	}
+
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	if err := db.writeCollection(key, TypeZSet, entry, encodeCount(count+added), ops); err != nil {
+		return 0, err
+	}
+
+	return added, nil
+}
+
+// ZRem removes members from the sorted set at key and returns how many were in it.
+// The key is deleted along with its last member
+func (db *DataStructure) ZRem(key []byte, members ...[]byte) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, meta, exists, err := db.openCollection(key, TypeZSet)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	count, err := decodeCount(meta)
+	if err != nil {
+		return 0, err
+	}
+
+	// Members can be given more than once
+	removed := make(map[string]struct{})
+	var ops []batchOp
+
+	for _, member := range members {
+		if _, ok := removed[string(member)]; ok {
+			continue
+		}
+
+		score, found, err := db.memberScore(key, member)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			continue
+		}
+
+		removed[string(member)] = struct{}{}
+		ops = append(ops,
+			deleteElement(key, familyZSetMember, member),
+			deleteElement(key, familyZSetScore, scoreElement(ScoredMember{Member: member, Score: score})))
+	}
+
+	if len(removed) == 0 {
+		return 0, nil
+	}
+
+	// The last member takes the set with it
+	count -= len(removed)
+	meta = nil
+	if count > 0 {
+		meta = encodeCount(count)
+	}
+
+	if err := db.writeCollection(key, TypeZSet, entry, meta, ops); err != nil {
+		return 0, err
+	}
+
+	return len(removed), nil
+}
+
+// ZScore retrieves the score of member in the sorted set at key
+func (db *DataStructure) ZScore(key, member []byte) (float64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	score, found, err := db.zsetScore(key, member)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrKeyNotFound
+	}
+
+	return score, nil
+}
+
+// ZRangeByScore returns the members of the sorted set at key with a score from min to max, both inclusive,
+// in ascending order of score.  Members with the same score are in ascending order of member
+func (db *DataStructure) ZRangeByScore(key []byte, min, max float64) ([]ScoredMember, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	_, _, exists, err := db.openCollection(key, TypeZSet)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	return db.rangeByScore(key, min, max)
+}
+
+// ZRank returns the position of member in the sorted set at key, 0 being the member with the lowest score.
+// The members before it are counted by walking their keys
+func (db *DataStructure) ZRank(key, member []byte) (int, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	score, found, err := db.zsetScore(key, member)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrKeyNotFound
+	}
+
+	prefix := elementPrefix(key, familyZSetScore)
+	end := string(append(prefix, scoreElement(ScoredMember{Member: member, Score: score})...))
+
+	rank := 0
+	for node := db.keys.seek(string(prefix)); node != nil && node.key < end; node = node.next() {
+		// Deleted members stay in the ordered index while snapshots can see them
+		if _, ok := db.index[node.key]; ok {
+			rank++
+		}
+	}
+
+	return rank, nil
+}
+
+// zsetScore returns the score of member in the sorted set at key and whether it is there, the caller must hold the lock
+func (db *DataStructure) zsetScore(key, member []byte) (float64, bool, error) {
+	_, _, exists, err := db.openCollection(key, TypeZSet)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	return db.memberScore(key, member)
+}
+
+// memberScore reads the score of member of the existing sorted set at key, the caller must hold the lock
+func (db *DataStructure) memberScore(key, member []byte) (float64, bool, error) {
+	value, found, err := db.element(elementKey(key, familyZSetMember, member))
+	if err != nil || !found {
+		return 0, false, err
+	}
+
+	if len(value) != 8 {
+		return 0, false, errors.New("malformed sorted set member")
+	}
+
+	return math.Float64frombits(binary.BigEndian.Uint64(value)), true, nil
+}
+
+// rangeByScore returns the members of the existing sorted set at key with a score from min to max, both
+// inclusive, the caller must hold the lock.  Only the keys in the range are walked
+func (db *DataStructure) rangeByScore(key []byte, min, max float64) ([]ScoredMember, error) {
+	var members []ScoredMember
+
+	prefix := elementPrefix(key, familyZSetScore)
+	err := db.walkElements(prefix, append(elementPrefix(key, familyZSetScore), sortableScore(min)...), func(element []byte, _ indexEntry) (bool, error) {
+		if len(element) < 8 {
+			return false, errors.New("malformed sorted set member")
+		}
+
+		score := decodeSortableScore(element)
+		if score > max {
+			return false, nil
+		}
+
+		members = append(members, ScoredMember{Member: element[8:], Score: score})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
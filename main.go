@@ -29,8 +29,8 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"sync"
 	"syscall"
+	"time"
 )
 
 // System starts here
@@ -39,22 +39,23 @@ import (
 // ./chromodb --memory-limit=7500 * 1024 * 1024
 // ./chromodb --shell=false --user=alex --pasword=somepassword
 // ./chromodb --shell=false --user=alex --pasword=somepassword --tls=true --key="key.pem" --cert="cert.pem"
+// ./chromodb repair
 func main() {
+	// Offline repair rebuilds the index from the data file, run it instead of the database
+	if len(os.Args) > 1 && os.Args[1] == "repair" {
+		repair()
+		return
+	}
+
 	var db system.Database // Main system variable
 
 	db.Config.MemoryLimit = 750 * 1024 * 1024 // 750MB
 
 	go db.MonitorMemory() // This is for the MEM/mem command.  We check every 5 seconds
 
-	// Load database and index file
-	ds, err := datastructure.OpenDB("chromo.db", "chromo.idx")
-	if err != nil {
-		return
-	}
-
-	db.DataStructure = ds // Set ds into system variable
 	db.Config.Port = 7676 // Set default port
-	db.Mu = &sync.Mutex{} // Mainly for transaction/concurrency control
+
+	db.Config.CompactionThreshold = 0.5 // Compact once half of the data file is dead space
 
 	shell := true   // Use shell, good for embedded stuff
 	var tls bool    // Upgrade clients to TLS
@@ -65,6 +66,10 @@ func main() {
 	var cert string // tls cert location
 	var key string  // tls key location
 
+	fsync := "interval"                                                            // When the write-ahead log is synced, always, interval or never
+	fsyncInterval := int(datastructure.DefaultOptions.SyncInterval.Milliseconds()) // Write-ahead log sync interval in milliseconds
+	snapshotMaxAge := int(datastructure.DefaultOptions.SnapshotMaxAge.Seconds())   // Seconds a snapshot, such as an open transaction, is kept
+
 	flag.BoolVar(&help, "help", help, "displays flag instructions")
 	flag.BoolVar(&shell, "shell", shell, "true or false to use internal shell")
 	flag.BoolVar(&tls, "tls", tls, "enable tls listener.  you must provide a cert and key using --cert and --key flags.")
@@ -74,6 +79,10 @@ func main() {
 	flag.StringVar(&cert, "key", user, "tls cert location")
 	flag.StringVar(&key, "cert", pass, "tls key location")
 	flag.IntVar(&db.Config.Port, "port", db.Config.Port, "tcp/tls listener port default is 7676")
+	flag.Float64Var(&db.Config.CompactionThreshold, "compaction-threshold", db.Config.CompactionThreshold, "dead space ratio of the data file that triggers compaction.  default is 0.5, 0 disables automatic compaction")
+	flag.StringVar(&fsync, "fsync", fsync, "when the write-ahead log is synced to disk.  always, interval or never.  default is interval")
+	flag.IntVar(&fsyncInterval, "fsync-interval", fsyncInterval, "write-ahead log sync interval in milliseconds when --fsync=interval.  default is 1000")
+	flag.IntVar(&snapshotMaxAge, "snapshot-max-age", snapshotMaxAge, "seconds a snapshot, such as the one of an open transaction, is kept before it expires.  default is 600, 0 keeps snapshots until they are released")
 
 	flag.Parse() // parse flags
 
@@ -82,6 +91,30 @@ func main() {
 		os.Exit(0)
 	}
 
+	syncPolicy, err := datastructure.ParseSyncPolicy(fsync)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Load database and index file, replaying the write-ahead log if needed
+	ds, err := datastructure.OpenDBWithOptions("chromo.db", "chromo.idx", datastructure.Options{
+		SyncPolicy:     syncPolicy,
+		SyncInterval:   time.Duration(fsyncInterval) * time.Millisecond,
+		SnapshotMaxAge: time.Duration(snapshotMaxAge) * time.Second,
+	})
+	if err != nil {
+		fmt.Println("Error opening database:", err)
+		os.Exit(1)
+	}
+	defer ds.Close()
+
+	db.DataStructure = ds // Set ds into system variable
+
+	go db.MonitorCompaction() // Compacts the data file once dead space reaches the threshold
+
+	go db.MonitorExpiry() // Deletes expired keys every second
+
 	if !shell { // if not shell we will start up a networked ChromoDB
 		if user == "" && pass == "" {
 			fmt.Println("Database username and password is required when configuring database to be networked.")
@@ -110,6 +143,8 @@ func main() {
 
 		qChan := make(chan []byte) // Query channel
 
+		session := db.NewSession() // Shell session, for transactions
+
 		go func() {
 			for {
 
@@ -131,7 +166,7 @@ func main() {
 			} // maybe not needed or unnecessary
 
 			// Execute the command
-			output, err := db.ExecuteCommand(query)
+			output, err := db.ExecuteSessionCommand(session, query)
 			if err != nil {
 				fmt.Println("Error executing query:", err)
 				fmt.Print("db>")
@@ -143,3 +178,20 @@ func main() {
 		}
 	}
 }
+
+// repair rebuilds chromo.idx from chromo.db and quarantines damaged regions of chromo.db
+func repair() {
+	fmt.Println("Repairing chromo.db...")
+
+	report, err := datastructure.Repair("chromo.db", "chromo.idx")
+	if err != nil {
+		fmt.Println("Error repairing database:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Read %d records, rebuilt index with %d keys\n", report.Records, report.Keys)
+
+	if report.Damaged > 0 {
+		fmt.Printf("Quarantined %d damaged regions (%d bytes) to chromo.db.quarantine\n", report.Damaged, report.Quarantined)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package system
+
+import (
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "heello", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[!e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{"key[0-9]", "keyx", false},
+		{"*:*:end", "a:b:c:end", true},
+		{`literal\*`, "literal*", true},
+		{`literal\*`, "literalx", false},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		if globMatch([]byte(test.pattern), []byte(test.key)) != test.match {
+			t.Errorf("globMatch(%q, %q) expected %v", test.pattern, test.key, test.match)
+		}
+	}
+
+	if prefix := globPrefix([]byte(`user:\*:*`)); string(prefix) != "user:*:" {
+		t.Errorf("Expected prefix user:*:, got %s", prefix)
+	}
+}
@@ -0,0 +1,466 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package system
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// A query is a command name, optionally followed by words separated by whitespace, then by arguments each after
+// a ->, e.g. PUT->key->value or CREATE INDEX by_city ON $.city.  An argument after a -> runs to the next -> and may
+// contain spaces, surrounding whitespace is trimmed.  Any word or argument can instead be a literal:
+//
+//	"text"     a string with escapes, \\ \" \' \/ \b \f \n \r \t \0 \xHH and \uXXXX
+//	'text'     a raw string, taken as it is
+//	x'4869'    bytes written in hex
+//	b64'SGk='  bytes written in base64
+//
+// A literal must be closed and well formed, or the query is a syntax error.  A literal followed by more text in its
+// word or argument, such as "wireless mouse" OR wired, is read bare, as is a quote in the middle of a word
+
+// Command is a parsed query
+type Command struct {
+	Name string     // Command name, upper cased
+	Args []Argument // Arguments in order, words before the first -> included
+
+	query []byte // The query the command was parsed from
+}
+
+// Argument is an argument of a command
+type Argument struct {
+	Value   []byte
+	Pos     int  // Position of the argument in the query, counted from 1
+	Literal bool // Set when the argument was written as a literal
+
+	raw []byte // The argument as written
+}
+
+// SyntaxError is returned for a query that cannot be parsed
+type SyntaxError struct {
+	Pos int // Position of the problem in the query, counted from 1
+	Msg string
+}
+
+// Error returns the message of the syntax error and its position
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Msg)
+}
+
+// tokenKind is the kind of a token of a query
+type tokenKind uint8
+
+const (
+	tokenWord    tokenKind = iota // Bare word before the first ->
+	tokenText                     // Bare argument after a ->, it may contain whitespace
+	tokenLiteral                  // Quoted string, hex or base64 literal, already decoded
+	tokenArrow                    // The -> separating arguments
+	tokenEnd                      // End of the query
+)
+
+// token is a token of a query and where it starts
+type token struct {
+	kind  tokenKind
+	value []byte
+	raw   []byte // The token as written
+	pos   int    // Index of the first byte of the token in the query
+}
+
+// lexer splits a query into tokens
+type lexer struct {
+	query      []byte
+	pos        int  // Index of the next byte to read
+	afterArrow bool // Set once a -> is read, bare tokens then run to the next ->
+}
+
+// ParseQuery parses a query into a Command, a SyntaxError is returned for a malformed query
+func ParseQuery(query []byte) (*Command, error) {
+	l := &lexer{query: query}
+
+	tok, err := l.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok.kind == tokenEnd {
+		return nil, &SyntaxError{Pos: tok.pos + 1, Msg: "expected a command"}
+	}
+	if tok.kind != tokenWord || !validCommandName(tok.value) {
+		return nil, &SyntaxError{Pos: tok.pos + 1, Msg: "expected a command name"}
+	}
+
+	command := &Command{Name: string(bytes.ToUpper(tok.value)), query: query}
+
+	// Words before the first ->
+	for {
+		tok, err = l.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok.kind == tokenArrow || tok.kind == tokenEnd {
+			break
+		}
+
+		command.Args = append(command.Args, tok.argument())
+	}
+
+	// Arguments after a -> each, an arrow with nothing after it is an empty argument
+	for tok.kind == tokenArrow {
+		arrow := tok
+
+		tok, err = l.next()
+		if err != nil {
+			return nil, err
+		}
+
+		if tok.kind == tokenArrow || tok.kind == tokenEnd {
+			command.Args = append(command.Args, Argument{Value: []byte{}, Pos: arrow.pos + len("->") + 1, raw: []byte{}})
+			continue
+		}
+
+		command.Args = append(command.Args, tok.argument())
+
+		// The lexer only ends an argument at a -> or the end of the query
+		if tok, err = l.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	return command, nil
+}
+
+// argument returns the argument a token is
+func (t token) argument() Argument {
+	return Argument{Value: t.value, Pos: t.pos + 1, Literal: t.kind == tokenLiteral, raw: t.raw}
+}
+
+// parts returns the command name followed by the values of its arguments
+func (c *Command) parts() [][]byte {
+	parts := make([][]byte, 0, len(c.Args)+1)
+	parts = append(parts, []byte(c.Name))
+
+	for _, arg := range c.Args {
+		parts = append(parts, arg.Value)
+	}
+
+	return parts
+}
+
+// rest returns the query as written from argument i to its end, -> included, for commands whose last
+// argument is taken whole
+func (c *Command) rest(i int) []byte {
+	return c.query[c.Args[i].Pos-1:]
+}
+
+// raw returns argument i as written, quotes included, for commands that give quotes their own meaning
+func (c *Command) raw(i int) []byte {
+	return c.Args[i].raw
+}
+
+// validCommandName reports whether name is made of letters, digits, dots and underscores
+func validCommandName(name []byte) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_') {
+			return false
+		}
+	}
+
+	return len(name) > 0
+}
+
+// isSpace reports whether c is whitespace between tokens
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// atArrow reports whether a -> starts at index i of the query
+func (l *lexer) atArrow(i int) bool {
+	return i+1 < len(l.query) && l.query[i] == '-' && l.query[i+1] == '>'
+}
+
+// next reads the next token
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.query) && isSpace(l.query[l.pos]) {
+		l.pos++
+	}
+
+	start := l.pos
+
+	if l.pos >= len(l.query) {
+		return token{kind: tokenEnd, pos: start}, nil
+	}
+
+	if l.atArrow(l.pos) {
+		l.pos += len("->")
+		l.afterArrow = true
+		return token{kind: tokenArrow, pos: start}, nil
+	}
+
+	prefix, escapes := 0, false
+
+	switch rest := l.query[l.pos:]; {
+	case rest[0] == '"':
+		escapes = true
+	case rest[0] == '\'':
+	case len(rest) > 1 && (rest[0] == 'x' || rest[0] == 'X') && isQuote(rest[1]):
+		prefix = len("x")
+	case len(rest) > 3 && bytes.EqualFold(rest[:3], []byte("b64")) && isQuote(rest[3]):
+		prefix = len("b64")
+	default:
+		return l.bare(), nil
+	}
+
+	end := l.closing(l.pos+prefix, escapes)
+	if end < 0 {
+		return token{}, &SyntaxError{Pos: l.pos + prefix + 1, Msg: "unterminated literal"}
+	}
+
+	// A literal followed by more text, as in "wireless mouse" OR wired, is part of a bare word or argument
+	if !l.literalEnds(end) {
+		return l.bare(), nil
+	}
+
+	l.pos += prefix
+
+	var value []byte
+	var err error
+
+	switch {
+	case prefix == len("b64"):
+		value, err = l.base64()
+	case prefix == len("x"):
+		value, err = l.hex()
+	case escapes:
+		value, err = l.quoted()
+	default:
+		value = l.raw()
+	}
+	if err != nil {
+		return token{}, err
+	}
+
+	return token{kind: tokenLiteral, value: value, raw: l.query[start:l.pos], pos: start}, nil
+}
+
+// bare reads a word, or after a -> everything up to the next -> with trailing whitespace trimmed
+func (l *lexer) bare() token {
+	start := l.pos
+
+	for l.pos < len(l.query) && !l.atArrow(l.pos) && (l.afterArrow || !isSpace(l.query[l.pos])) {
+		l.pos++
+	}
+
+	if !l.afterArrow {
+		return token{kind: tokenWord, value: l.query[start:l.pos], raw: l.query[start:l.pos], pos: start}
+	}
+
+	text := bytes.TrimRight(l.query[start:l.pos], " \t\r\n")
+	return token{kind: tokenText, value: text, raw: text, pos: start}
+}
+
+// literalEnds reports whether the literal whose closing quote is at index end is followed by the end of its word
+// or argument
+func (l *lexer) literalEnds(end int) bool {
+	i := end + 1
+	for i < len(l.query) && isSpace(l.query[i]) {
+		i++
+	}
+
+	return i == len(l.query) || l.atArrow(i) || (!l.afterArrow && i > end+1)
+}
+
+// isQuote reports whether c opens a literal
+func isQuote(c byte) bool {
+	return c == '"' || c == '\''
+}
+
+// closing returns the index of the quote closing the literal whose opening quote is at index open, with
+// backslashes escaping the next byte if escapes is set, or -1 if the literal is not closed
+func (l *lexer) closing(open int, escapes bool) int {
+	quote := l.query[open]
+
+	for i := open + 1; i < len(l.query); i++ {
+		switch {
+		case escapes && l.query[i] == '\\':
+			i++
+		case l.query[i] == quote:
+			return i
+		}
+	}
+
+	return -1
+}
+
+// span moves past the literal at the current position, already checked to be closed, and returns where its
+// contents start and end
+func (l *lexer) span(escapes bool) (int, int) {
+	start, end := l.pos+1, l.closing(l.pos, escapes)
+	l.pos = end + 1
+
+	return start, end
+}
+
+// raw reads a single quoted string, taken as it is
+func (l *lexer) raw() []byte {
+	start, end := l.span(false)
+
+	return l.query[start:end]
+}
+
+// quoted reads a double quoted string and resolves its escapes
+func (l *lexer) quoted() ([]byte, error) {
+	start, end := l.span(true)
+
+	value := make([]byte, 0, end-start)
+	for i := start; i < end; i++ {
+		if l.query[i] != '\\' {
+			value = append(value, l.query[i])
+			continue
+		}
+
+		escape := i
+		i++
+
+		switch l.query[i] {
+		case '\\', '"', '\'', '/':
+			value = append(value, l.query[i])
+		case 'b':
+			value = append(value, '\b')
+		case 'f':
+			value = append(value, '\f')
+		case 'n':
+			value = append(value, '\n')
+		case 'r':
+			value = append(value, '\r')
+		case 't':
+			value = append(value, '\t')
+		case '0':
+			value = append(value, 0)
+		case 'x':
+			if i+2 >= end {
+				return nil, &SyntaxError{Pos: escape + 1, Msg: `\x must be followed by two hex digits`}
+			}
+
+			b, err := hex.DecodeString(string(l.query[i+1 : i+3]))
+			if err != nil {
+				return nil, &SyntaxError{Pos: escape + 1, Msg: `\x must be followed by two hex digits`}
+			}
+
+			value = append(value, b...)
+			i += 2
+		case 'u':
+			r, n, err := l.unicodeEscape(escape, end)
+			if err != nil {
+				return nil, err
+			}
+
+			value = utf8.AppendRune(value, r)
+			i = escape + n - 1
+		default:
+			return nil, &SyntaxError{Pos: escape + 1, Msg: fmt.Sprintf(`unknown escape \%c`, l.query[i])}
+		}
+	}
+
+	return value, nil
+}
+
+// unicodeEscape decodes the \uXXXX escape at index escape, along with the low half of a surrogate pair after it,
+// and returns the rune and the number of bytes read
+func (l *lexer) unicodeEscape(escape, end int) (rune, int, error) {
+	errBad := &SyntaxError{Pos: escape + 1, Msg: `\u must be followed by four hex digits`}
+
+	decode := func(i int) (rune, bool) {
+		if i+6 > end || l.query[i] != '\\' || l.query[i+1] != 'u' {
+			return 0, false
+		}
+
+		b, err := hex.DecodeString(string(l.query[i+2 : i+6]))
+		if err != nil {
+			return 0, false
+		}
+
+		return rune(b[0])<<8 | rune(b[1]), true
+	}
+
+	r, ok := decode(escape)
+	if !ok {
+		return 0, 0, errBad
+	}
+
+	if !utf16.IsSurrogate(r) {
+		return r, 6, nil
+	}
+
+	// A high surrogate must be followed by a low one
+	low, ok := decode(escape + 6)
+	if pair := utf16.DecodeRune(r, low); ok && pair != utf8.RuneError {
+		return pair, 12, nil
+	}
+
+	return 0, 0, &SyntaxError{Pos: escape + 1, Msg: "unpaired surrogate in unicode escape"}
+}
+
+// hex reads a hex literal, the x already read
+func (l *lexer) hex() ([]byte, error) {
+	start, end := l.span(false)
+
+	for i := start; i < end; i++ {
+		if c := l.query[i]; !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return nil, &SyntaxError{Pos: i + 1, Msg: fmt.Sprintf("bad hex digit %q", c)}
+		}
+	}
+
+	if (end-start)%2 != 0 {
+		return nil, &SyntaxError{Pos: start - 1, Msg: "hex literal has an odd number of digits"}
+	}
+
+	value := make([]byte, (end-start)/2)
+	if _, err := hex.Decode(value, l.query[start:end]); err != nil {
+		return nil, &SyntaxError{Pos: start - 1, Msg: "bad hex literal"}
+	}
+
+	return value, nil
+}
+
+// base64 reads a standard, padded base64 literal, the b64 already read
+func (l *lexer) base64() ([]byte, error) {
+	start, end := l.span(false)
+
+	value := make([]byte, base64.StdEncoding.DecodedLen(end-start))
+
+	n, err := base64.StdEncoding.Strict().Decode(value, l.query[start:end])
+	if err != nil {
+		pos := start
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			pos += int(corrupt)
+		}
+
+		return nil, &SyntaxError{Pos: pos + 1, Msg: "bad base64 literal"}
+	}
+
+	return value[:n], nil
+}
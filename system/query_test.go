@@ -0,0 +1,129 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package system
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		name  string
+		args  []string
+	}{
+		{"MEM", "MEM", nil},
+		{"get->key\r\n", "GET", []string{"key"}},
+		{"PUT -> my key ->  hello world  ", "PUT", []string{"my key", "hello world"}},
+		{"PUT->key->", "PUT", []string{"key", ""}},
+		{"PUT->->value", "PUT", []string{"", "value"}},
+		{"TS.RANGE->cpu->-->+", "TS.RANGE", []string{"cpu", "-", "+"}},
+		{"CREATE INDEX by_city ON $.city", "CREATE", []string{"INDEX", "by_city", "ON", "$.city"}},
+		{`CREATE INDEX by_name ON '$["first name"]'`, "CREATE", []string{"INDEX", "by_name", "ON", `$["first name"]`}},
+		{`PUT->"a->b"->' padded '`, "PUT", []string{"a->b", " padded "}},
+		{`PUT->key->He said "hi"`, "PUT", []string{"key", `He said "hi"`}},
+		{`PUT->key->"value" trailing`, "PUT", []string{"key", `"value" trailing`}},
+		{`PUT->key->"tab\there\nquote\" \\ \x41é😀\0"`, "PUT", []string{"key", "tab\there\nquote\" \\ Aé\U0001F600\x00"}},
+		{`PUT->key->'raw \n'`, "PUT", []string{"key", `raw \n`}},
+		{`PUT->x'00ff41'->b64'aGk='`, "PUT", []string{"\x00\xffA", "hi"}},
+		{`PUT->X""->B64""`, "PUT", []string{"", ""}},
+		{`PUT->xylophone->b64`, "PUT", []string{"xylophone", "b64"}},
+		{`FTSEARCH->products->"wireless mouse" OR wired`, "FTSEARCH", []string{"products", `"wireless mouse" OR wired`}},
+		{`CREATE INDEX "by"name`, "CREATE", []string{"INDEX", `"by"name`}},
+		{`PUT->it's->rock 'n' roll`, "PUT", []string{"it's", "rock 'n' roll"}},
+		{`PUT->max'->box"`, "PUT", []string{"max'", `box"`}},
+	}
+
+	for _, test := range tests {
+		command, err := ParseQuery([]byte(test.query))
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", test.query, err)
+			continue
+		}
+
+		var args []string
+		for _, arg := range command.Args {
+			args = append(args, string(arg.Value))
+		}
+
+		if command.Name != test.name || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("Expected %s %q for %q, got %s %q", test.name, test.args, test.query, command.Name, args)
+		}
+	}
+
+	// Arguments know where they start
+	command, err := ParseQuery([]byte(`PUT->  key->"value"`))
+	if err != nil || command.Args[0].Pos != 8 || command.Args[1].Pos != 13 {
+		t.Errorf("Expected arguments at 8 and 13, got %v: %v", command, err)
+	}
+
+	// and how they were written
+	if command.Args[0].Literal || !command.Args[1].Literal || string(command.raw(0)) != "key" || string(command.raw(1)) != `"value"` {
+		t.Errorf("Expected a bare key and a literal value, got %v", command.Args)
+	}
+}
+
+func TestParseQuery_SyntaxErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{"", 1, "expected a command"},
+		{"  \r\n", 5, "expected a command"},
+		{"->key", 1, "expected a command name"},
+		{`"GET"->key`, 1, "expected a command name"},
+		{"GE$T->key", 1, "expected a command name"},
+		{`PUT->key->"value`, 11, "unterminated literal"},
+		{`PUT->key->'value`, 11, "unterminated literal"},
+		{`PUT->key->"a\"`, 11, "unterminated literal"},
+		{`PUT->key->x'mas`, 12, "unterminated literal"},
+		{`CREATE INDEX 'by_name`, 14, "unterminated literal"},
+		{`PUT->key->"bad \q escape"`, 16, `unknown escape \q`},
+		{`PUT->key->"\x4"`, 12, `\x must be followed by two hex digits`},
+		{`PUT->key->"\xzz"`, 12, `\x must be followed by two hex digits`},
+		{`PUT->key->"\u12"`, 12, `\u must be followed by four hex digits`},
+		{`PUT->key->"\ud83d"`, 12, "unpaired surrogate in unicode escape"},
+		{`PUT->key->x'0g'`, 14, `bad hex digit 'g'`},
+		{`PUT->key->x'abc'`, 11, "hex literal has an odd number of digits"},
+		{`PUT->key->b64'aGk'`, 15, "bad base64 literal"},
+		{`PUT->key->b64'a!k='`, 16, "bad base64 literal"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseQuery([]byte(test.query))
+
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Expected a syntax error for %q, got %v", test.query, err)
+			continue
+		}
+
+		if syntaxErr.Pos != test.pos || syntaxErr.Msg != test.msg {
+			t.Errorf("Expected %q at %d for %q, got %q at %d", test.msg, test.pos, test.query, syntaxErr.Msg, syntaxErr.Pos)
+		}
+	}
+
+	if _, err := ParseQuery([]byte(`PUT->key->x'abc'`)); err == nil || err.Error() != "syntax error at position 11: hex literal has an odd number of digits" {
+		t.Errorf("Expected the position in the message, got %v", err)
+	}
+}
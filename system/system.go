@@ -20,23 +20,31 @@
 package system
 
 import (
-	"bufio"
 	"bytes"
 	"chromodb/datastructure"
 	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/textproto"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+// DefaultScanLimit is the number of results returned by range scans when no limit is given
+const DefaultScanLimit = 100
+
+// ExpiryBatchSize is how many expired keys MonitorExpiry deletes at a time
+const ExpiryBatchSize = 100
+
 // Database is the ChromoDB main struct
 type Database struct {
 	DataStructure      *datastructure.DataStructure // Database tree
@@ -45,111 +53,1371 @@ type Database struct {
 	Wg                 *sync.WaitGroup              // System waitgroup
 	Config             Config                       // ChromoDB configurations
 	DBUser             DBUser                       // Database user
-	Mu                 *sync.Mutex
 	ConnMu             *sync.Mutex
 	Connections        map[net.Addr]net.Conn
 }
 
-// DBUser is a database user
-type DBUser struct {
-	Username string // database user username
-	Password string // database user password
-}
+// DBUser is a database user
+type DBUser struct {
+	Username string // database user username
+	Password string // database user password
+}
+
+// Config is the ChromoDB configurations struct
+type Config struct {
+	MemoryLimit         int     // default is 750mb
+	Port                int     // Port for listener, default is 7676
+	TLS                 bool    // Whether listener should listen on TLS or not
+	TLSKey              string  // If TLS is set where is the TLS key located?
+	TLSCert             string  // if TLS is set where is TLS cert located?
+	CompactionThreshold float64 // Dead space ratio of the data file that triggers compaction, 0 disables
+}
+
+// MonitorMemory monitors memory usage for database
+func (db *Database) MonitorMemory() {
+	ticker := time.NewTicker(time.Second * 5) // Check memory usage every 5 seconds
+
+	for range ticker.C {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+
+		db.CurrentMemoryUsage = int(m.Alloc)
+		if m.Alloc > uint64(db.Config.MemoryLimit) {
+			fmt.Println("Memory usage exceeds the limit. Exiting...")
+			os.Exit(1)
+		}
+	}
+}
+
+// MonitorCompaction compacts the data file once its dead space ratio reaches the configured threshold
+func (db *Database) MonitorCompaction() {
+	ticker := time.NewTicker(time.Second * 10) // Check dead space every 10 seconds
+
+	for range ticker.C {
+		if db.Config.CompactionThreshold <= 0 {
+			continue
+		}
+
+		if db.DataStructure.DeadSpaceRatio() < db.Config.CompactionThreshold {
+			continue
+		}
+
+		reclaimed, err := db.DataStructure.Compact()
+		if err != nil {
+			fmt.Println("Error compacting data file:", err)
+			continue
+		}
+
+		fmt.Printf("Compacted data file, reclaimed %d bytes\n", reclaimed)
+	}
+}
+
+// MonitorExpiry deletes expired keys in the background.  Expired keys already read as missing,
+// this reclaims the ones nobody reads
+func (db *Database) MonitorExpiry() {
+	ticker := time.NewTicker(time.Second) // Check for expired keys every second
+
+	for range ticker.C {
+		// Keep going while full batches come back, there may be more
+		for {
+			deleted, err := db.DataStructure.DeleteExpired(ExpiryBatchSize)
+			if err != nil {
+				fmt.Println("Error deleting expired keys:", err)
+				break
+			}
+
+			if deleted < ExpiryBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// ExecuteCommand takes a query and executes it
+func (db *Database) ExecuteCommand(query []byte) (interface{}, error) {
+	res, err := db.QueryParser(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ExecuteSessionCommand takes a query from a session and executes it
+func (db *Database) ExecuteSessionCommand(session *Session, query []byte) (interface{}, error) {
+	return db.SessionQueryParser(session, query)
+}
+
+// QueryParser parses incoming query outside of any session
+func (db *Database) QueryParser(query []byte) (interface{}, error) {
+	return db.SessionQueryParser(nil, query)
+}
+
+// SessionQueryParser parses incoming query for a session.  Writes are buffered while the session has a transaction open
+func (db *Database) SessionQueryParser(session *Session, query []byte) (interface{}, error) {
+	command, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	switch command.Name {
+	case "MEM":
+		return []byte(fmt.Sprintf("Current memory usage: %d bytes", db.CurrentMemoryUsage)), nil
+	case "MSET":
+		// MSET->key->value->key->value...
+		opSpl := command.parts()
+
+		if len(opSpl) < 3 || len(opSpl)%2 != 1 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if session != nil && session.Tx != nil {
+			for i := 1; i < len(opSpl); i += 2 {
+				session.Tx.put(opSpl[i], opSpl[i+1], time.Time{})
+			}
+			return []byte("MSET QUEUED"), nil
+		}
+
+		// All pairs are written atomically, with a single write-ahead log entry
+		batch := datastructure.NewBatch()
+		for i := 1; i < len(opSpl); i += 2 {
+			batch.Put(opSpl[i], opSpl[i+1])
+		}
+
+		if err := db.DataStructure.WriteBatch(batch); err != nil {
+			return nil, err
+		}
+
+		return []byte("MSET SUCCESS"), nil
+	case "MGET":
+		// MGET->key->key... replies key->value for every key that exists
+		opSpl := command.parts()
+
+		if len(opSpl) < 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		keys := opSpl[1:]
+
+		var values [][]byte
+		if session != nil && session.Tx != nil {
+			values = make([][]byte, len(keys))
+			for i, key := range keys {
+				value, err := session.Tx.get(key)
+				if err != nil && !errors.Is(err, datastructure.ErrKeyNotFound) && !errors.Is(err, datastructure.ErrWrongType) {
+					return nil, err
+				}
+				values[i] = value
+			}
+		} else {
+			var err error
+			values, err = db.DataStructure.MultiGet(keys)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		results := make([][]byte, 0, len(keys))
+		for i, key := range keys {
+			if values[i] != nil {
+				results = append(results, keyValueLine(key, values[i]))
+			}
+		}
+
+		return listResponse(results), nil
+	case "MDEL":
+		// MDEL->key->key...
+		opSpl := command.parts()
+
+		if len(opSpl) < 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if session != nil && session.Tx != nil {
+			for _, key := range opSpl[1:] {
+				session.Tx.delete(key)
+			}
+			return []byte("MDEL QUEUED"), nil
+		}
+
+		batch := datastructure.NewBatch()
+		for _, key := range opSpl[1:] {
+			batch.Delete(key)
+		}
+
+		if err := db.DataStructure.WriteBatch(batch); err != nil {
+			return nil, err
+		}
+
+		return []byte("MDEL SUCCESS"), nil
+	case "PUT":
+		// PUT->key->value or PUT->key->value->EX->seconds
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 && len(opSpl) != 5 {
+			return nil, errors.New("bad sequence")
+		}
+
+		var expiresAt time.Time
+		if len(opSpl) == 5 {
+			if !bytes.EqualFold(opSpl[3], []byte("EX")) {
+				return nil, errors.New("bad sequence")
+			}
+
+			var err error
+			expiresAt, err = parseExpiry(opSpl[4])
+			if err != nil || !expiresAt.After(time.Now()) {
+				return nil, errors.New("bad expiry")
+			}
+		}
+
+		if session != nil && session.Tx != nil {
+			session.Tx.put(opSpl[1], opSpl[2], expiresAt)
+			return []byte("PUT QUEUED"), nil
+		}
+
+		// The data structure serializes writes itself, readers carry on meanwhile
+		var err error
+		if expiresAt.IsZero() {
+			err = db.DataStructure.Put(opSpl[1], opSpl[2])
+		} else {
+			err = db.DataStructure.PutWithExpiry(opSpl[1], opSpl[2], expiresAt)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte("PUT SUCCESS"), nil
+	case "JSON.SET":
+		// JSON.SET->key->path->value, a bare value is everything after the path as written so it may contain ->
+		opSpl := command.parts()
+
+		if len(opSpl) < 4 || len(opSpl) > 4 && command.Args[2].Literal {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		value := opSpl[3]
+		if len(opSpl) > 4 {
+			value = command.rest(2)
+		}
+
+		if err := db.DataStructure.JSONSet(opSpl[1], opSpl[2], value); err != nil {
+			return nil, err
+		}
+
+		return []byte("JSON.SET SUCCESS"), nil
+	case "JSON.GET":
+		// JSON.GET->key->path, the path defaults to the root $
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 && len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		return db.DataStructure.JSONGet(opSpl[1], jsonPathArg(opSpl, 2))
+	case "JSON.DEL":
+		// JSON.DEL->key->path, the path defaults to the root $ which deletes the key
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 && len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		deleted, err := db.DataStructure.JSONDel(opSpl[1], jsonPathArg(opSpl, 2))
+		if err != nil {
+			return nil, err
+		}
+
+		if deleted {
+			return []byte("1"), nil
+		}
+
+		return []byte("0"), nil
+	case "CREATE":
+		// CREATE INDEX name ON $.field, a path holding whitespace is quoted
+		opSpl := command.parts()
+
+		if len(opSpl) != 5 || !bytes.EqualFold(opSpl[1], []byte("INDEX")) || !bytes.EqualFold(opSpl[3], []byte("ON")) {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		if err := db.DataStructure.CreateIndex(string(opSpl[2]), opSpl[4]); err != nil {
+			return nil, err
+		}
+
+		return []byte("CREATE INDEX SUCCESS"), nil
+	case "FTCREATE":
+		// FTCREATE->index->prefix, without a prefix every key is indexed
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 && len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		var prefix []byte
+		if len(opSpl) == 3 {
+			prefix = opSpl[2]
+		}
+
+		if err := db.DataStructure.CreateTextIndex(string(opSpl[1]), prefix); err != nil {
+			return nil, err
+		}
+
+		return []byte("FTCREATE SUCCESS"), nil
+	case "FTSEARCH":
+		// FTSEARCH->index->query->limit, limit is optional.  The query is taken as written, its quotes mark phrases
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 && len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		limit := DefaultScanLimit
+		if len(opSpl) == 4 {
+			var err error
+			limit, err = strconv.Atoi(string(opSpl[3]))
+			if err != nil || limit <= 0 {
+				return nil, errors.New("bad limit")
+			}
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		matches, err := db.DataStructure.Search(string(opSpl[1]), string(command.raw(1)), limit)
+		if err != nil {
+			return nil, err
+		}
+
+		// Best match first, each with its BM25 score
+		results := make([][]byte, 0, len(matches))
+		for _, match := range matches {
+			results = append(results, keyValueLine(match.Key, strconv.AppendFloat(nil, match.Score, 'f', 4, 64)))
+		}
+
+		return listResponse(results), nil
+	case "VCREATE":
+		// VCREATE->index->metric, metric is cosine or l2
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		metric, err := datastructure.ParseVectorMetric(string(opSpl[2]))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		if err := db.DataStructure.CreateVectorIndex(string(opSpl[1]), metric); err != nil {
+			return nil, err
+		}
+
+		return []byte("VCREATE SUCCESS"), nil
+	case "VADD":
+		// VADD->index->key->vector
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		vector, err := parseVector(opSpl[3])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		if err := db.DataStructure.VectorAdd(string(opSpl[1]), opSpl[2], vector); err != nil {
+			return nil, err
+		}
+
+		return []byte("VADD SUCCESS"), nil
+	case "VDEL":
+		// VDEL->index->key
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		deleted, err := db.DataStructure.VectorDelete(string(opSpl[1]), opSpl[2])
+		if err != nil {
+			return nil, err
+		}
+
+		if deleted {
+			return []byte("1"), nil
+		}
+
+		return []byte("0"), nil
+	case "VDROP":
+		// VDROP->index
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		if err := db.DataStructure.DropVectorIndex(string(opSpl[1])); err != nil {
+			return nil, err
+		}
+
+		return []byte("VDROP SUCCESS"), nil
+	case "VSEARCH":
+		// VSEARCH->index->vector->k
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		vector, err := parseVector(opSpl[2])
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := strconv.Atoi(string(opSpl[3]))
+		if err != nil || k <= 0 {
+			return nil, errors.New("bad k")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		matches, err := db.DataStructure.VectorSearch(string(opSpl[1]), vector, k)
+		if err != nil {
+			return nil, err
+		}
+
+		// Nearest first, each with its distance
+		results := make([][]byte, 0, len(matches))
+		for _, match := range matches {
+			results = append(results, keyValueLine(match.Key, strconv.AppendFloat(nil, float64(match.Distance), 'f', 6, 32)))
+		}
+
+		return listResponse(results), nil
+	case "FIND":
+		// FIND->index->value
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		keys, err := db.DataStructure.Find(string(opSpl[1]), opSpl[2])
+		if err != nil {
+			return nil, err
+		}
+
+		return listResponse(keys), nil
+	case "INCRBYFLOAT":
+		// INCRBYFLOAT->key->increment
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		delta, err := strconv.ParseFloat(string(opSpl[2]), 64)
+		if err != nil {
+			return nil, errors.New("bad increment")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		result, err := db.DataStructure.IncrByFloat(opSpl[1], delta)
+		if err != nil {
+			return nil, err
+		}
+
+		return strconv.AppendFloat(nil, result, 'f', -1, 64), nil
+	case "INCR", "DECR", "INCRBY":
+		// INCR->key, DECR->key or INCRBY->key->increment
+		opSpl := command.parts()
+
+		delta := int64(1)
+		switch {
+		case bytes.EqualFold(opSpl[0], []byte("INCRBY")) && len(opSpl) == 3:
+			var err error
+			delta, err = strconv.ParseInt(string(opSpl[2]), 10, 64)
+			if err != nil {
+				return nil, errors.New("bad increment")
+			}
+		case bytes.EqualFold(opSpl[0], []byte("DECR")) && len(opSpl) == 2:
+			delta = -1
+		case bytes.EqualFold(opSpl[0], []byte("INCR")) && len(opSpl) == 2:
+		default:
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		result, err := db.DataStructure.IncrBy(opSpl[1], delta)
+		if err != nil {
+			return nil, err
+		}
+
+		return strconv.AppendInt(nil, result, 10), nil
+	case "LPUSH":
+		// LPUSH->key->value->value...
+		opSpl := command.parts()
+
+		if len(opSpl) < 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		length, err := db.DataStructure.LPush(opSpl[1], opSpl[2:]...)
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.Itoa(length)), nil
+	case "RPOP":
+		// RPOP->key
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		return db.DataStructure.RPop(opSpl[1])
+	case "LRANGE":
+		// LRANGE->key->start->stop
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		start, err := strconv.Atoi(string(opSpl[2]))
+		if err != nil {
+			return nil, errors.New("bad start")
+		}
+
+		stop, err := strconv.Atoi(string(opSpl[3]))
+		if err != nil {
+			return nil, errors.New("bad stop")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		elements, err := db.DataStructure.LRange(opSpl[1], start, stop)
+		if err != nil {
+			return nil, err
+		}
+
+		return listResponse(elements), nil
+	case "SADD", "SREM":
+		// SADD->key->member->member... or SREM->key->member->member...
+		opSpl := command.parts()
+
+		if len(opSpl) < 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		var count int
+		var err error
+		if bytes.EqualFold(opSpl[0], []byte("SADD")) {
+			count, err = db.DataStructure.SAdd(opSpl[1], opSpl[2:]...)
+		} else {
+			count, err = db.DataStructure.SRem(opSpl[1], opSpl[2:]...)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.Itoa(count)), nil
+	case "SMEMBERS":
+		// SMEMBERS->key
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		members, err := db.DataStructure.SMembers(opSpl[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return listResponse(members), nil
+	case "HSET":
+		// HSET->key->field->value
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		created, err := db.DataStructure.HSet(opSpl[1], opSpl[2], opSpl[3])
+		if err != nil {
+			return nil, err
+		}
+
+		if created {
+			return []byte("1"), nil
+		}
+
+		return []byte("0"), nil
+	case "HGETALL":
+		// HGETALL->key
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		fields, err := db.DataStructure.HGetAll(opSpl[1])
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([][]byte, 0, len(fields))
+		for _, field := range fields {
+			results = append(results, keyValueLine(field.Field, field.Value))
+		}
+
+		return listResponse(results), nil
+	case "HGET":
+		// HGET->key->field
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		return db.DataStructure.HGet(opSpl[1], opSpl[2])
+	case "ZADD":
+		// ZADD->key->score->member->score->member...
+		opSpl := command.parts()
+
+		if len(opSpl) < 4 || len(opSpl)%2 != 0 {
+			return nil, errors.New("bad sequence")
+		}
+
+		members := make([]datastructure.ScoredMember, 0, len(opSpl)/2-1)
+		for i := 2; i < len(opSpl); i += 2 {
+			score, err := parseScore(opSpl[i])
+			if err != nil {
+				return nil, err
+			}
+
+			members = append(members, datastructure.ScoredMember{Member: opSpl[i+1], Score: score})
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		added, err := db.DataStructure.ZAdd(opSpl[1], members...)
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.Itoa(added)), nil
+	case "ZREM":
+		// ZREM->key->member->member...
+		opSpl := command.parts()
+
+		if len(opSpl) < 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		removed, err := db.DataStructure.ZRem(opSpl[1], opSpl[2:]...)
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.Itoa(removed)), nil
+	case "ZSCORE":
+		// ZSCORE->key->member
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		score, err := db.DataStructure.ZScore(opSpl[1], opSpl[2])
+		if err != nil {
+			return nil, err
+		}
+
+		return formatScore(score), nil
+	case "ZRANGEBYSCORE":
+		// ZRANGEBYSCORE->key->min->max
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		min, err := parseScore(opSpl[2])
+		if err != nil {
+			return nil, err
+		}
+
+		max, err := parseScore(opSpl[3])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		members, err := db.DataStructure.ZRangeByScore(opSpl[1], min, max)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([][]byte, 0, len(members))
+		for _, member := range members {
+			results = append(results, keyValueLine(member.Member, formatScore(member.Score)))
+		}
+
+		return listResponse(results), nil
+	case "ZRANK":
+		// ZRANK->key->member
+		opSpl := command.parts()
+
+		if len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		rank, err := db.DataStructure.ZRank(opSpl[1], opSpl[2])
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.Itoa(rank)), nil
+	case "GEOADD":
+		// GEOADD->set->longitude->latitude->member
+		opSpl := command.parts()
+
+		if len(opSpl) != 5 {
+			return nil, errors.New("bad sequence")
+		}
+
+		longitude, err := strconv.ParseFloat(string(opSpl[2]), 64)
+		if err != nil {
+			return nil, errors.New("bad longitude")
+		}
+
+		latitude, err := strconv.ParseFloat(string(opSpl[3]), 64)
+		if err != nil {
+			return nil, errors.New("bad latitude")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		added, err := db.DataStructure.GeoAdd(opSpl[1], datastructure.GeoMember{Member: opSpl[4], Longitude: longitude, Latitude: latitude})
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.Itoa(added)), nil
+	case "GEODIST":
+		// GEODIST->set->member->member optionally ->unit, meters by default
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 && len(opSpl) != 5 {
+			return nil, errors.New("bad sequence")
+		}
+
+		unit := []byte("m")
+		if len(opSpl) == 5 {
+			unit = opSpl[4]
+		}
+
+		meters, err := distanceUnit(unit)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		distance, err := db.DataStructure.GeoDist(opSpl[1], opSpl[2], opSpl[3])
+		if err != nil {
+			return nil, err
+		}
+
+		return formatDistance(distance / meters), nil
+	case "GEORADIUS":
+		// GEORADIUS->set->longitude->latitude->radius->unit
+		opSpl := command.parts()
+
+		if len(opSpl) != 6 {
+			return nil, errors.New("bad sequence")
+		}
+
+		longitude, err := strconv.ParseFloat(string(opSpl[2]), 64)
+		if err != nil {
+			return nil, errors.New("bad longitude")
+		}
+
+		latitude, err := strconv.ParseFloat(string(opSpl[3]), 64)
+		if err != nil {
+			return nil, errors.New("bad latitude")
+		}
+
+		radius, err := strconv.ParseFloat(string(opSpl[4]), 64)
+		if err != nil || radius < 0 {
+			return nil, errors.New("bad radius")
+		}
+
+		meters, err := distanceUnit(opSpl[5])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		found, err := db.DataStructure.GeoRadius(opSpl[1], longitude, latitude, radius*meters)
+		if err != nil {
+			return nil, err
+		}
+
+		results := make([][]byte, 0, len(found))
+		for _, result := range found {
+			results = append(results, keyValueLine(result.Member, formatDistance(result.Distance/meters)))
+		}
+
+		return listResponse(results), nil
+	case "TS.CREATE":
+		// TS.CREATE->key optionally ->retention in milliseconds
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 && len(opSpl) != 3 {
+			return nil, errors.New("bad sequence")
+		}
+
+		var retention int64
+		if len(opSpl) == 3 {
+			var err error
+			retention, err = strconv.ParseInt(string(opSpl[2]), 10, 64)
+			if err != nil || retention < 0 {
+				return nil, errors.New("bad retention")
+			}
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		if err := db.DataStructure.TSCreate(opSpl[1], time.Duration(retention)*time.Millisecond); err != nil {
+			return nil, err
+		}
+
+		return []byte("TS.CREATE SUCCESS"), nil
+	case "TS.ADD":
+		// TS.ADD->key->timestamp->value, * for the current time
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		timestamp := time.Now().UnixMilli()
+		if !bytes.Equal(opSpl[2], []byte("*")) {
+			var err error
+			timestamp, err = strconv.ParseInt(string(opSpl[2]), 10, 64)
+			if err != nil {
+				return nil, errors.New("bad timestamp")
+			}
+		}
+
+		value, err := strconv.ParseFloat(string(opSpl[3]), 64)
+		if err != nil {
+			return nil, datastructure.ErrNotFloat
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		if err := db.DataStructure.TSAdd(opSpl[1], timestamp, value); err != nil {
+			return nil, err
+		}
+
+		return []byte(strconv.FormatInt(timestamp, 10)), nil
+	case "TS.RANGE":
+		// TS.RANGE->key->from->to optionally ->aggregation->bucket in milliseconds, - and + for the oldest and newest
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 && len(opSpl) != 6 {
+			return nil, errors.New("bad sequence")
+		}
+
+		from, err := parseTimestamp(opSpl[2], math.MinInt64)
+		if err != nil {
+			return nil, err
+		}
+
+		to, err := parseTimestamp(opSpl[3], math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
 
-// Config is the ChromoDB configurations struct
-type Config struct {
-	MemoryLimit int    // default is 750mb
-	Port        int    // Port for listener, default is 7676
-	TLS         bool   // Whether listener should listen on TLS or not
-	TLSKey      string // If TLS is set where is the TLS key located?
-	TLSCert     string // if TLS is set where is TLS cert located?
-}
+		var samples []datastructure.Sample
+		if len(opSpl) == 6 {
+			aggregation, err := datastructure.ParseAggregation(string(opSpl[4]))
+			if err != nil {
+				return nil, err
+			}
 
-// MonitorMemory monitors memory usage for database
-func (db *Database) MonitorMemory() {
-	ticker := time.NewTicker(time.Second * 5) // Check memory usage every 5 seconds
+			bucket, err := strconv.ParseInt(string(opSpl[5]), 10, 64)
+			if err != nil || bucket <= 0 {
+				return nil, errors.New("bad bucket")
+			}
 
-	for range ticker.C {
-		var m runtime.MemStats
-		runtime.ReadMemStats(&m)
+			samples, err = db.DataStructure.TSRangeAggregated(opSpl[1], from, to, aggregation, time.Duration(bucket)*time.Millisecond)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			samples, err = db.DataStructure.TSRange(opSpl[1], from, to)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-		db.CurrentMemoryUsage = int(m.Alloc)
-		if m.Alloc > uint64(db.Config.MemoryLimit) {
-			fmt.Println("Memory usage exceeds the limit. Exiting...")
-			os.Exit(1)
+		results := make([][]byte, 0, len(samples))
+		for _, sample := range samples {
+			results = append(results, keyValueLine([]byte(strconv.FormatInt(sample.Timestamp, 10)), formatScore(sample.Value)))
 		}
-	}
-}
 
-// ExecuteCommand takes a query and executes it
-func (db *Database) ExecuteCommand(query []byte) (interface{}, error) {
-	res, err := db.QueryParser(query)
-	if err != nil {
-		return nil, err
-	}
+		return listResponse(results), nil
+	case "TYPE":
+		// TYPE->key
+		opSpl := command.parts()
 
-	return res, nil
-}
+		if len(opSpl) != 2 {
+			return nil, errors.New("bad sequence")
+		}
 
-// QueryParser parses incoming query
-func (db *Database) QueryParser(query []byte) (interface{}, error) {
-	switch {
-	case bytes.HasPrefix(bytes.ToUpper(query), []byte("MEM")):
-		return []byte(fmt.Sprintf("Current memory usage: %d bytes", db.CurrentMemoryUsage)), nil
-	case bytes.HasPrefix(bytes.ToUpper(query), []byte("PUT")):
-		db.StartTransaction()
-		opSpl := bytes.Split(query, []byte("->"))
+		valueType, err := db.DataStructure.Type(opSpl[1])
+		if errors.Is(err, datastructure.ErrKeyNotFound) {
+			return []byte("none"), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		return []byte(valueType.String()), nil
+	case "EXPIRE":
+		// EXPIRE->key->seconds
+		opSpl := command.parts()
 
 		if len(opSpl) != 3 {
-			db.RollbackTransaction()
 			return nil, errors.New("bad sequence")
 		}
 
-		err := db.DataStructure.Put(bytes.TrimSpace(opSpl[1]), bytes.TrimSpace(opSpl[2]))
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		expiresAt, err := parseExpiry(opSpl[2])
 		if err != nil {
-			db.RollbackTransaction()
 			return nil, err
 		}
 
-		db.CommitTransaction()
-		return []byte("PUT SUCCESS"), nil
-	case bytes.HasPrefix(bytes.ToUpper(query), []byte("GET")):
-		db.StartTransaction()
-		opSpl := bytes.Split(query, []byte("->"))
+		if err := db.DataStructure.Expire(opSpl[1], expiresAt); err != nil {
+			return nil, err
+		}
 
-		if len(opSpl) < 2 {
-			db.RollbackTransaction()
+		return []byte("EXPIRE SUCCESS"), nil
+	case "PERSIST":
+		// PERSIST->key
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := notInTransaction(session, opSpl[0]); err != nil {
+			return nil, err
+		}
+
+		if err := db.DataStructure.Persist(opSpl[1]); err != nil {
+			return nil, err
+		}
+
+		return []byte("PERSIST SUCCESS"), nil
+	case "TTL":
+		// TTL->key replies the seconds left, -1 if the key never expires and -2 if it does not exist
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		ttl, err := db.DataStructure.TTL(opSpl[1])
+		if errors.Is(err, datastructure.ErrKeyNotFound) {
+			return []byte("-2"), nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		if ttl == datastructure.NoExpiry {
+			return []byte("-1"), nil
+		}
+
+		return []byte(strconv.FormatInt(int64(ttl.Round(time.Second)/time.Second), 10)), nil
+	case "CAS":
+		// CAS->key->expectedVersion->value, expected version 0 only creates the key
+		opSpl := command.parts()
+
+		if len(opSpl) != 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		expected, err := strconv.ParseUint(string(opSpl[2]), 10, 64)
+		if err != nil {
+			return nil, errors.New("bad version")
+		}
+
+		if session != nil && session.Tx != nil {
+			session.Tx.compareAndSwap(opSpl[1], expected, opSpl[3])
+			return []byte("CAS QUEUED"), nil
+		}
+
+		version, err := db.DataStructure.CompareAndSwap(opSpl[1], expected, opSpl[3])
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(fmt.Sprintf("CAS SUCCESS: version %d", version)), nil
+	case "GETV":
+		// GETV->key replies version->value
+		opSpl := command.parts()
+
+		if len(opSpl) != 2 {
 			return nil, errors.New("bad sequence")
 		}
 
-		res, err := db.DataStructure.Get(bytes.TrimSpace(opSpl[1]))
+		value, version, err := db.DataStructure.GetWithVersion(opSpl[1])
 		if err != nil {
-			db.RollbackTransaction()
 			return nil, err
 		}
 
-		db.CommitTransaction()
-		return res, nil
+		return keyValueLine([]byte(strconv.FormatUint(version, 10)), value), nil
+	case "GET":
+		// Reads never take the write lock.  Inside a transaction they see its snapshot and buffered writes
+		opSpl := command.parts()
+
+		if len(opSpl) < 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if session != nil && session.Tx != nil {
+			return session.Tx.get(opSpl[1])
+		}
+
+		return db.DataStructure.Get(opSpl[1])
 
-	case bytes.HasPrefix(bytes.ToUpper(query), []byte("DISK")):
-		totalDiskSpace, err := getDiskSpace("chromo.db", "chromo.idx")
+	case "DISK":
+		// Every file of the database, the index and vector files included
+		totalDiskSpace, err := getDiskSpace(db.DataStructure.Filenames()...)
 		if err != nil {
 			return nil, err
 		}
 
 		return []byte(fmt.Sprintf("DISK USAGE: %d bytes", totalDiskSpace)), nil
-	case bytes.HasPrefix(bytes.ToUpper(query), []byte("DEL")):
-		db.StartTransaction()
-		opSpl := bytes.Split(query, []byte("->"))
+	case "COMPACT":
+		reclaimed, err := db.DataStructure.Compact()
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(fmt.Sprintf("COMPACT SUCCESS: reclaimed %d bytes", reclaimed)), nil
+	case "VERIFY":
+		damaged, err := db.DataStructure.Verify()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(damaged) == 0 {
+			return []byte("VERIFY SUCCESS: no damaged records"), nil
+		}
+
+		offsets := make([]string, len(damaged))
+		for i, offset := range damaged {
+			offsets[i] = strconv.FormatInt(offset, 10)
+		}
+
+		return []byte(fmt.Sprintf("VERIFY FAILED: damaged records at offsets %s", strings.Join(offsets, ", "))), nil
+	case "SCAN":
+		// SCAN->start->end->limit, end and limit are optional.  Start is inclusive, end exclusive
+		args := command.parts()
+
+		if len(args) < 2 || len(args) > 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		var end []byte
+		if len(args) > 2 {
+			end = args[2]
+		}
+
+		limit := DefaultScanLimit
+		if len(args) > 3 {
+			var err error
+			limit, err = strconv.Atoi(string(args[3]))
+			if err != nil || limit <= 0 {
+				return nil, errors.New("bad limit")
+			}
+		}
+
+		// The iterator locks per key so a long scan does not hold up other clients,
+		// reading from a snapshot keeps the results consistent while they write
+		snapshot := db.DataStructure.Snapshot()
+		defer snapshot.Release()
+
+		it := snapshot.NewIterator()
+		defer it.Close()
+
+		var results [][]byte
+		for ok := it.Seek(args[1]); ok && len(results) < limit; ok = it.Next() {
+			if len(end) > 0 && bytes.Compare(it.Key(), end) >= 0 {
+				break
+			}
+
+			if it.Type() != datastructure.TypeString {
+				results = append(results, typeLine(it.Key(), it.Type()))
+				continue
+			}
+
+			results = append(results, keyValueLine(it.Key(), it.Value()))
+		}
+
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+
+		return listResponse(results), nil
+	case "KEYS":
+		// KEYS->pattern->cursor->count, cursor and count are optional
+		args := command.parts()
+
+		if len(args) < 2 || len(args) > 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		cursor, limit, err := parseCursor(args, 2, 3)
+		if err != nil {
+			return nil, err
+		}
+
+		pattern := args[1]
+		keys, next := db.DataStructure.ScanKeys(cursor, globPrefix(pattern), func(key []byte) bool {
+			return globMatch(pattern, key)
+		}, limit)
+
+		return cursorResponse(next, keys), nil
+	case "PREFIX":
+		// PREFIX->prefix->cursor->count, cursor and count are optional
+		args := command.parts()
+
+		if len(args) < 2 || len(args) > 4 {
+			return nil, errors.New("bad sequence")
+		}
+
+		cursor, limit, err := parseCursor(args, 2, 3)
+		if err != nil {
+			return nil, err
+		}
+
+		keys, next := db.DataStructure.ScanKeys(cursor, args[1], nil, limit)
+
+		results := make([][]byte, 0, len(keys))
+		for _, key := range keys {
+			value, err := db.DataStructure.Get(key)
+			if errors.Is(err, datastructure.ErrKeyNotFound) {
+				continue // deleted since it was listed
+			} else if errors.Is(err, datastructure.ErrWrongType) {
+				valueType, err := db.DataStructure.Type(key)
+				if err != nil {
+					continue // deleted since it was listed
+				}
+
+				results = append(results, typeLine(key, valueType))
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			results = append(results, keyValueLine(key, value))
+		}
+
+		return cursorResponse(next, results), nil
+	case "BEGIN":
+		if session == nil {
+			return nil, ErrNoSession
+		}
+
+		if err := session.Begin(); err != nil {
+			return nil, err
+		}
+
+		return []byte("BEGIN SUCCESS"), nil
+	case "COMMIT":
+		if session == nil {
+			return nil, ErrNoSession
+		}
+
+		if err := db.Commit(session); err != nil {
+			return nil, err
+		}
+
+		return []byte("COMMIT SUCCESS"), nil
+	case "ROLLBACK":
+		if session == nil {
+			return nil, ErrNoSession
+		}
+
+		if session.Tx == nil {
+			return nil, errors.New("no transaction started")
+		}
+
+		session.Rollback()
+		return []byte("ROLLBACK SUCCESS"), nil
+	case "WATCH":
+		// WATCH->key->key...
+		if session == nil {
+			return nil, ErrNoSession
+		}
+
+		opSpl := command.parts()
+
+		if len(opSpl) < 2 {
+			return nil, errors.New("bad sequence")
+		}
+
+		if err := db.Watch(session, opSpl[1:]...); err != nil {
+			return nil, err
+		}
+
+		return []byte("WATCH SUCCESS"), nil
+	case "UNWATCH":
+		if session == nil {
+			return nil, ErrNoSession
+		}
+
+		session.Unwatch()
+		return []byte("UNWATCH SUCCESS"), nil
+	case "DEL":
+		opSpl := command.parts()
 
 		if len(opSpl) < 2 {
-			db.RollbackTransaction()
 			return nil, errors.New("bad sequence")
 		}
 
-		db.DataStructure.Delete(bytes.TrimSpace(opSpl[1]))
+		if session != nil && session.Tx != nil {
+			session.Tx.delete(opSpl[1])
+			return []byte("DEL QUEUED"), nil
+		}
+
+		if err := db.DataStructure.Delete(opSpl[1]); err != nil {
+			return nil, err
+		}
 
-		db.CommitTransaction()
 		return []byte("DEL SUCCESS"), nil
 	}
 
@@ -250,7 +1518,12 @@ func (db *Database) StartTCPTLSListener(ctx context.Context) error {
 				db.Connections[conn.RemoteAddr()] = conn
 				db.ConnMu.Unlock()
 
-				reader := bufio.NewReader(conn)
+				// Writes of an open transaction are discarded when the client disconnects
+				session := db.NewSession()
+				defer session.Rollback()
+
+				// Keep reading through the auth reader, it may already hold queries sent right after auth
+				reader := auth.R
 
 				for {
 
@@ -263,7 +1536,7 @@ func (db *Database) StartTCPTLSListener(ctx context.Context) error {
 					// Check for trailing CRLF
 					if len(line) >= 2 && line[len(line)-2] == '\r' && line[len(line)-1] == '\n' {
 						// Trailing CRLF found
-						res, err := db.QueryParser(line)
+						res, err := db.SessionQueryParser(session, line)
 						if err != nil {
 							conn.Write(append([]byte(err.Error()), []byte("\r\n")...))
 						} else {
@@ -271,7 +1544,7 @@ func (db *Database) StartTCPTLSListener(ctx context.Context) error {
 						}
 					} else if line[len(line)-1] == '\n' {
 						// Trailing LF found
-						res, err := db.QueryParser(line)
+						res, err := db.SessionQueryParser(session, line)
 						if err != nil {
 							conn.Write(append([]byte(err.Error()), []byte("\r\n")...))
 						} else {
@@ -289,10 +1562,180 @@ func (db *Database) StartTCPTLSListener(ctx context.Context) error {
 	fmt.Println("TCP/TLS listener is listening on", addr)
 
 	// Wait for the shutdown signal
-	select {
-	case <-ctx.Done():
-		return nil
+	<-ctx.Done()
+
+	// Stop accepting and hang up on clients so their sessions end
+	_ = listener.Close()
+	db.closeConnections()
+
+	return nil
+}
+
+// closeConnections closes every client connection
+func (db *Database) closeConnections() {
+	db.ConnMu.Lock()
+	defer db.ConnMu.Unlock()
+
+	for addr, c := range db.Connections {
+		c.Close()
+		delete(db.Connections, addr)
+	}
+}
+
+// parseExpiry parses a number of seconds from now into the time a key expires at
+func parseExpiry(seconds []byte) (time.Time, error) {
+	n, err := strconv.ParseInt(string(seconds), 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("bad expiry")
 	}
+
+	return time.Now().Add(time.Duration(n) * time.Second), nil
+}
+
+// listResponse formats multiple results as a line with the number of results followed by one line per result
+func listResponse(results [][]byte) []byte {
+	response := []byte(strconv.Itoa(len(results)))
+	for _, result := range results {
+		response = append(response, "\r\n"...)
+		response = append(response, result...)
+	}
+	return response
+}
+
+// parseCursor parses the optional hex encoded cursor and limit at the provided argument positions.
+// A cursor of 0 or no cursor starts from the beginning
+func parseCursor(args [][]byte, cursorArg, limitArg int) ([]byte, int, error) {
+	var cursor []byte
+	if len(args) > cursorArg && len(args[cursorArg]) > 0 && string(args[cursorArg]) != "0" {
+		var err error
+		cursor, err = hex.DecodeString(string(args[cursorArg]))
+		if err != nil {
+			return nil, 0, errors.New("bad cursor")
+		}
+	}
+
+	limit := DefaultScanLimit
+	if len(args) > limitArg && len(args[limitArg]) > 0 {
+		var err error
+		limit, err = strconv.Atoi(string(args[limitArg]))
+		if err != nil || limit <= 0 {
+			return nil, 0, errors.New("bad limit")
+		}
+	}
+
+	return cursor, limit, nil
+}
+
+// cursorResponse formats a page of results as a line with the hex encoded cursor to continue from, 0 once
+// there is nothing left, followed by the results formatted by listResponse
+func cursorResponse(cursor []byte, results [][]byte) []byte {
+	response := []byte("0")
+	if len(cursor) > 0 {
+		response = []byte(hex.EncodeToString(cursor))
+	}
+
+	response = append(response, "\r\n"...)
+	return append(response, listResponse(results)...)
+}
+
+// keyValueLine formats a key-value pair as key->value
+func keyValueLine(key, value []byte) []byte {
+	line := make([]byte, 0, len(key)+2+len(value))
+	line = append(line, key...)
+	line = append(line, "->"...)
+	return append(line, value...)
+}
+
+// typeLine formats a key holding a list, set or hash as a key->(type) line
+func typeLine(key []byte, valueType datastructure.ValueType) []byte {
+	return keyValueLine(key, []byte("("+valueType.String()+")"))
+}
+
+// parseScore parses the score of a sorted set member, inf and -inf included
+func parseScore(arg []byte) (float64, error) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("bad score")
+	}
+
+	return score, nil
+}
+
+// formatScore formats the score of a sorted set member
+func formatScore(score float64) []byte {
+	return strconv.AppendFloat(nil, score, 'f', -1, 64)
+}
+
+// distanceUnit returns the number of meters in a distance unit, m, km, mi or ft
+func distanceUnit(unit []byte) (float64, error) {
+	switch string(bytes.ToLower(unit)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "mi":
+		return 1609.344, nil
+	case "ft":
+		return 0.3048, nil
+	}
+
+	return 0, errors.New("bad unit")
+}
+
+// formatDistance formats a distance between geo set members
+func formatDistance(distance float64) []byte {
+	return strconv.AppendFloat(nil, distance, 'f', 4, 64)
+}
+
+// parseTimestamp parses a time series timestamp in milliseconds, - or + standing for the given bound
+func parseTimestamp(arg []byte, bound int64) (int64, error) {
+	if bytes.Equal(arg, []byte("-")) || bytes.Equal(arg, []byte("+")) {
+		return bound, nil
+	}
+
+	timestamp, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errors.New("bad timestamp")
+	}
+
+	return timestamp, nil
+}
+
+// parseVector parses a vector written as comma separated numbers, optionally in brackets, e.g. [0.1, 0.2, 0.3]
+func parseVector(arg []byte) ([]float32, error) {
+	arg = bytes.TrimSuffix(bytes.TrimPrefix(arg, []byte("[")), []byte("]"))
+
+	parts := bytes.Split(arg, []byte(","))
+
+	vector := make([]float32, len(parts))
+	for i, part := range parts {
+		value, err := strconv.ParseFloat(string(bytes.TrimSpace(part)), 32)
+		if err != nil {
+			return nil, errors.New("bad vector")
+		}
+
+		vector[i] = float32(value)
+	}
+
+	return vector, nil
+}
+
+// jsonPathArg returns the JSON path argument at position i, the root $ if there is none
+func jsonPathArg(args [][]byte, i int) []byte {
+	if len(args) > i {
+		return args[i]
+	}
+
+	return []byte("$")
+}
+
+// notInTransaction returns an error for a command that cannot be run inside a transaction of session
+func notInTransaction(session *Session, command []byte) error {
+	if session != nil && session.Tx != nil {
+		return fmt.Errorf("%s inside a transaction is not supported", bytes.ToUpper(command))
+	}
+
+	return nil
 }
 
 // getDiskSpace gets combined disk space of provided files
@@ -320,27 +1763,11 @@ func (db *Database) Stop() {
 		_ = db.TCPListener.Close()
 	}
 	// Wait for all active connections to finish
-	for _, c := range db.Connections {
-		c.Close()
-		delete(db.Connections, c.RemoteAddr())
+	if db.ConnMu != nil {
+		db.closeConnections()
 	}
 
 	db.Wg.Wait()
 
 	fmt.Println("TCP/TLS listener stopped")
 }
-
-// StartTransaction locks to start a transaction
-func (db *Database) StartTransaction() {
-	db.Mu.Lock()
-}
-
-// RollbackTransaction unlocks on error
-func (db *Database) RollbackTransaction() {
-	db.Mu.Unlock()
-}
-
-// CommitTransaction similar to unlock but for commit
-func (db *Database) CommitTransaction() {
-	db.Mu.Unlock()
-}
@@ -24,10 +24,13 @@ import (
 	"chromodb/datastructure"
 	"context"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 	"os"
-	"sync"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -55,7 +58,6 @@ func TestDatabase_ExecuteCommand(t *testing.T) {
 			Username: "testuser",
 			Password: "testpassword",
 		},
-		Mu: &sync.Mutex{},
 	}
 
 	// Put a key-value pair in the database
@@ -146,3 +148,914 @@ func TestDatabase_StartTCPTLSListener(t *testing.T) {
 	// Stop the TCP listener
 	database.Stop()
 }
+
+func TestDatabase_Scan(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, key := range []string{"key1", "key2", "key3", "key4", "other"} {
+		if _, err := database.ExecuteCommand([]byte("PUT->" + key + "->" + key + "_value")); err != nil {
+			t.Fatalf("Error executing PUT command: %v", err)
+		}
+	}
+
+	result, err := database.ExecuteCommand([]byte("SCAN->key2->key4"))
+	if err != nil {
+		t.Fatalf("Error executing SCAN command: %v", err)
+	}
+
+	expected := "2\r\nkey2->key2_value\r\nkey3->key3_value"
+	if string(result.([]byte)) != expected {
+		t.Errorf("Expected result %q, got %q", expected, string(result.([]byte)))
+	}
+
+	result, err = database.ExecuteCommand([]byte("SCAN->key->->3"))
+	if err != nil {
+		t.Fatalf("Error executing SCAN command: %v", err)
+	}
+
+	expected = "3\r\nkey1->key1_value\r\nkey2->key2_value\r\nkey3->key3_value"
+	if string(result.([]byte)) != expected {
+		t.Errorf("Expected result %q, got %q", expected, string(result.([]byte)))
+	}
+}
+
+func TestDatabase_KeysAndPrefix(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, key := range []string{"user:1", "user:2", "user:3", "session:1"} {
+		if err := db.Put([]byte(key), []byte("v"+key)); err != nil {
+			t.Fatalf("Error putting key-value pair: %v", err)
+		}
+	}
+
+	// Page through the user keys two at a time
+	result, err := database.ExecuteCommand([]byte("KEYS->user:*->0->2"))
+	if err != nil {
+		t.Fatalf("Error executing KEYS command: %v", err)
+	}
+
+	lines := bytes.Split(result.([]byte), []byte("\r\n"))
+	if len(lines) != 4 || string(lines[1]) != "2" || string(lines[2]) != "user:1" || string(lines[3]) != "user:2" {
+		t.Fatalf("Unexpected first page %q", result)
+	}
+
+	result, err = database.ExecuteCommand([]byte("KEYS->user:*->" + string(lines[0]) + "->2"))
+	if err != nil {
+		t.Fatalf("Error executing KEYS command: %v", err)
+	}
+
+	expected := "0\r\n1\r\nuser:3"
+	if string(result.([]byte)) != expected {
+		t.Errorf("Expected result %q, got %q", expected, result)
+	}
+
+	result, err = database.ExecuteCommand([]byte("PREFIX->session"))
+	if err != nil {
+		t.Fatalf("Error executing PREFIX command: %v", err)
+	}
+
+	expected = "0\r\n1\r\nsession:1->vsession:1"
+	if string(result.([]byte)) != expected {
+		t.Errorf("Expected result %q, got %q", expected, result)
+	}
+
+	// PREFIX takes its cursor and count in the same order as KEYS
+	result, err = database.ExecuteCommand([]byte("PREFIX->user:->0->2"))
+	if err != nil {
+		t.Fatalf("Error executing PREFIX command: %v", err)
+	}
+
+	lines = bytes.Split(result.([]byte), []byte("\r\n"))
+	if len(lines) != 4 || string(lines[1]) != "2" || string(lines[2]) != "user:1->vuser:1" || string(lines[3]) != "user:2->vuser:2" {
+		t.Fatalf("Unexpected first page %q", result)
+	}
+
+	result, err = database.ExecuteCommand([]byte("PREFIX->user:->" + string(lines[0]) + "->2"))
+	if err != nil {
+		t.Fatalf("Error executing PREFIX command: %v", err)
+	}
+
+	expected = "0\r\n1\r\nuser:3->vuser:3"
+	if string(result.([]byte)) != expected {
+		t.Errorf("Expected result %q, got %q", expected, result)
+	}
+}
+
+func TestDatabase_Transactions(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	session := database.NewSession()
+
+	for _, query := range []string{"BEGIN", "PUT->a->1", "PUT->b->2", "DEL->a"} {
+		if _, err := database.ExecuteSessionCommand(session, []byte(query)); err != nil {
+			t.Fatalf("Error executing %s: %v", query, err)
+		}
+	}
+
+	// The session sees its own writes
+	result, err := database.ExecuteSessionCommand(session, []byte("GET->b"))
+	if err != nil || string(result.([]byte)) != "2" {
+		t.Errorf("Expected session to read its own write, got %v %v", result, err)
+	}
+
+	// Nobody else does until commit
+	if _, err := database.ExecuteCommand([]byte("GET->b")); err != datastructure.ErrKeyNotFound {
+		t.Errorf("Expected uncommitted write to be invisible, got %v", err)
+	}
+
+	if _, err := database.ExecuteSessionCommand(session, []byte("COMMIT")); err != nil {
+		t.Fatalf("Error executing COMMIT: %v", err)
+	}
+
+	result, err = database.ExecuteCommand([]byte("GET->b"))
+	if err != nil || string(result.([]byte)) != "2" {
+		t.Errorf("Expected committed value 2, got %v %v", result, err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("GET->a")); err != datastructure.ErrKeyNotFound {
+		t.Errorf("Expected a to be deleted within the transaction, got %v", err)
+	}
+
+	// Rolled back writes are discarded
+	for _, query := range []string{"BEGIN", "PUT->b->3", "ROLLBACK"} {
+		if _, err := database.ExecuteSessionCommand(session, []byte(query)); err != nil {
+			t.Fatalf("Error executing %s: %v", query, err)
+		}
+	}
+
+	result, err = database.ExecuteCommand([]byte("GET->b"))
+	if err != nil || string(result.([]byte)) != "2" {
+		t.Errorf("Expected rolled back value to be discarded, got %v %v", result, err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("BEGIN")); err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession without a session, got %v", err)
+	}
+
+	// Commands that cannot be buffered are rejected the same way
+	if _, err := database.ExecuteSessionCommand(session, []byte("BEGIN")); err != nil {
+		t.Fatal(err)
+	}
+
+	for query, name := range map[string]string{
+		"CREATE INDEX by_city ON $.city": "CREATE",
+		"INCR->counter":                  "INCR",
+		"incrby->counter->2":             "INCRBY",
+		"INCRBYFLOAT->counter->0.5":      "INCRBYFLOAT",
+		"EXPIRE->b->60":                  "EXPIRE",
+		"PERSIST->b":                     "PERSIST",
+	} {
+		_, err := database.ExecuteSessionCommand(session, []byte(query))
+		if expected := name + " inside a transaction is not supported"; err == nil || err.Error() != expected {
+			t.Errorf("Expected %q for %s, got %v", expected, query, err)
+		}
+	}
+}
+
+func TestDatabase_WatchAndCAS(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	if _, err := database.ExecuteCommand([]byte("PUT->counter->1")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := database.ExecuteCommand([]byte("GETV->counter"))
+	if err != nil || string(result.([]byte)) != "1->1" {
+		t.Fatalf("Expected 1->1, got %v %v", result, err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("CAS->counter->0->2")); err != datastructure.ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	result, err = database.ExecuteCommand([]byte("CAS->counter->1->2"))
+	if err != nil || string(result.([]byte)) != "CAS SUCCESS: version 2" {
+		t.Errorf("Expected CAS SUCCESS: version 2, got %v %v", result, err)
+	}
+
+	// A write by another client between WATCH and COMMIT aborts the transaction
+	session := database.NewSession()
+	for _, query := range []string{"WATCH->counter", "BEGIN", "PUT->counter->10"} {
+		if _, err := database.ExecuteSessionCommand(session, []byte(query)); err != nil {
+			t.Fatalf("Error executing %s: %v", query, err)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("PUT->counter->3")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.ExecuteSessionCommand(session, []byte("COMMIT")); err != datastructure.ErrConflict {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	result, err = database.ExecuteCommand([]byte("GET->counter"))
+	if err != nil || string(result.([]byte)) != "3" {
+		t.Errorf("Expected 3, got %v %v", result, err)
+	}
+
+	// Without a conflicting write the transaction commits
+	for _, query := range []string{"WATCH->counter", "BEGIN", "PUT->counter->4", "COMMIT"} {
+		if _, err := database.ExecuteSessionCommand(session, []byte(query)); err != nil {
+			t.Fatalf("Error executing %s: %v", query, err)
+		}
+	}
+
+	result, err = database.ExecuteCommand([]byte("GET->counter"))
+	if err != nil || string(result.([]byte)) != "4" {
+		t.Errorf("Expected 4, got %v %v", result, err)
+	}
+}
+
+func TestDatabase_TransactionSnapshot(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	if _, err := database.ExecuteCommand([]byte("PUT->key->1")); err != nil {
+		t.Fatal(err)
+	}
+
+	session := database.NewSession()
+	if _, err := database.ExecuteSessionCommand(session, []byte("BEGIN")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client writes after BEGIN
+	if _, err := database.ExecuteCommand([]byte("PUT->key->2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction keeps reading as of BEGIN
+	result, err := database.ExecuteSessionCommand(session, []byte("GET->key"))
+	if err != nil || string(result.([]byte)) != "1" {
+		t.Errorf("Expected 1 inside the transaction, got %v %v", result, err)
+	}
+
+	if _, err := database.ExecuteSessionCommand(session, []byte("ROLLBACK")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = database.ExecuteSessionCommand(session, []byte("GET->key"))
+	if err != nil || string(result.([]byte)) != "2" {
+		t.Errorf("Expected 2 after the transaction, got %v %v", result, err)
+	}
+}
+
+func TestDatabase_Expiry(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"PUT->session->data->EX->60", "PUT SUCCESS"},
+		{"TTL->session", "60"},
+		{"PERSIST->session", "PERSIST SUCCESS"},
+		{"TTL->missing", "-2"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %s for %s, got %v %v", step[1], step[0], result, err)
+		}
+	}
+
+	result, err := database.ExecuteCommand([]byte("TTL->session"))
+	if err != nil || string(result.([]byte)) != "-1" {
+		t.Errorf("Expected -1 after PERSIST, got %v %v", result, err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("EXPIRE->session->0")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("GET->session")); err != datastructure.ErrKeyNotFound {
+		t.Errorf("Expected expired key to be missing, got %v", err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("PUT->session->data->EX->0")); err == nil {
+		t.Errorf("Expected an error for a non-positive expiry")
+	}
+}
+
+func TestDatabase_Counters(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"INCR->counter", "1"},
+		{"INCRBY->counter->10", "11"},
+		{"DECR->counter", "10"},
+		{"INCRBYFLOAT->counter->0.25", "10.25"},
+		{"GET->counter", "10.25"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %s for %s, got %v %v", step[1], step[0], result, err)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("INCR->counter")); !errors.Is(err, datastructure.ErrNotInteger) {
+		t.Errorf("Expected ErrNotInteger, got %v", err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("INCRBY->counter->abc")); err == nil {
+		t.Errorf("Expected an error for a bad increment")
+	}
+}
+
+func TestDatabase_MultiKeyCommands(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	session := database.NewSession()
+
+	for _, step := range [][2]string{
+		{"MSET->a->1->b->2->c->3", "MSET SUCCESS"},
+		{"MGET->a->missing->c", "2\r\na->1\r\nc->3"},
+		{"MDEL->a->b->missing", "MDEL SUCCESS"},
+		{"MGET->a->b->c", "1\r\nc->3"},
+		{"BEGIN", "BEGIN SUCCESS"},
+		{"MSET->d->4->e->5", "MSET QUEUED"},
+		{"MDEL->c", "MDEL QUEUED"},
+		{"MGET->c->d->e", "2\r\nd->4\r\ne->5"},
+		{"COMMIT", "COMMIT SUCCESS"},
+		{"MGET->c->d->e", "2\r\nd->4\r\ne->5"},
+	} {
+		result, err := database.ExecuteSessionCommand(session, []byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	for _, query := range []string{"MSET->a", "MSET->a->1->b", "MGET", "MDEL"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestDatabase_Collections(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"LPUSH->jobs->a->b", "2"},
+		{"LPUSH->jobs->c", "3"},
+		{"LRANGE->jobs->0->-1", "3\r\nc\r\nb\r\na"},
+		{"RPOP->jobs", "a"},
+		{"SADD->tags->go->db->go", "2"},
+		{"SREM->tags->db->missing", "1"},
+		{"SMEMBERS->tags", "1\r\ngo"},
+		{"HSET->user->name->alex", "1"},
+		{"HSET->user->name->chromo", "0"},
+		{"HSET->user->lang->go", "1"},
+		{"HGET->user->name", "chromo"},
+		{"HGETALL->user", "2\r\nlang->go\r\nname->chromo"},
+		{"PUT->plain->value", "PUT SUCCESS"},
+		{"TYPE->jobs", "list"},
+		{"TYPE->tags", "set"},
+		{"TYPE->user", "hash"},
+		{"TYPE->plain", "string"},
+		{"TYPE->missing", "none"},
+		{"SCAN->a->z", "4\r\njobs->(list)\r\nplain->value\r\ntags->(set)\r\nuser->(hash)"},
+		{"MGET->jobs->plain", "1\r\nplain->value"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("GET->jobs")); !errors.Is(err, datastructure.ErrWrongType) {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("LPUSH->plain->a")); !errors.Is(err, datastructure.ErrWrongType) {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+
+	// A failed delete is reported, not replied to as a success
+	if _, err := database.ExecuteCommand([]byte("DEL->x'ff00'")); !errors.Is(err, datastructure.ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey, got %v", err)
+	}
+
+	session := database.NewSession()
+	if _, err := database.ExecuteSessionCommand(session, []byte("BEGIN")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.ExecuteSessionCommand(session, []byte("SADD->tags->db")); err == nil {
+		t.Errorf("Expected SADD to be rejected inside a transaction")
+	}
+}
+
+func TestDatabase_SortedSets(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"ZADD->board->30->alex->10->bob->20->carol", "3"},
+		{"ZADD->board->40->bob", "0"},
+		{"ZSCORE->board->bob", "40"},
+		{"ZRANK->board->carol", "0"},
+		{"ZRANK->board->bob", "2"},
+		{"ZRANGEBYSCORE->board->20->30", "2\r\ncarol->20\r\nalex->30"},
+		{"ZRANGEBYSCORE->board->-inf->+inf", "3\r\ncarol->20\r\nalex->30\r\nbob->40"},
+		{"ZREM->board->carol->missing", "1"},
+		{"ZRANK->board->alex", "0"},
+		{"TYPE->board", "zset"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	for _, query := range []string{"ZADD->board->1", "ZADD->board->abc->member", "ZADD->board->nan->member", "ZRANGEBYSCORE->board->1"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("ZSCORE->board->carol")); !errors.Is(err, datastructure.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDatabase_Geo(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"GEOADD->sicily->13.361389->38.115556->palermo", "1"},
+		{"GEOADD->sicily->15.087269->37.502669->catania", "1"},
+		{"GEOADD->sicily->15.087269->37.502669->catania", "0"},
+		{"GEODIST->sicily->palermo->catania->km", "166.2742"},
+		{"GEORADIUS->sicily->15->37->200->km", "2\r\ncatania->56.4413\r\npalermo->190.4424"},
+		{"GEORADIUS->sicily->15->37->100->km", "1\r\ncatania->56.4413"},
+		{"GEORADIUS->sicily->0->0->100->mi", "0"},
+		{"TYPE->sicily", "zset"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	for _, query := range []string{"GEOADD->sicily->13->38", "GEOADD->sicily->abc->38->x", "GEOADD->sicily->13->89->x", "GEODIST->sicily->palermo->catania->parsecs", "GEORADIUS->sicily->15->37->-1->km"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("GEODIST->sicily->palermo->missing")); !errors.Is(err, datastructure.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestDatabase_TimeSeries(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"TS.CREATE->cpu->60000", "TS.CREATE SUCCESS"},
+		{"TS.ADD->cpu->1000->10", "1000"},
+		{"TS.ADD->cpu->2000->20", "2000"},
+		{"TS.ADD->cpu->11000->5", "11000"},
+		{"TS.ADD->cpu->12000->1.5", "12000"},
+		{"TS.RANGE->cpu->-->+", "4\r\n1000->10\r\n2000->20\r\n11000->5\r\n12000->1.5"},
+		{"TS.RANGE->cpu->1500->11000", "2\r\n2000->20\r\n11000->5"},
+		{"TS.RANGE->cpu->-->+->avg->10000", "2\r\n0->15\r\n10000->3.25"},
+		{"TS.RANGE->cpu->-->+->max->10000", "2\r\n0->20\r\n10000->5"},
+		{"TS.RANGE->cpu->-->+->count->100000", "1\r\n0->4"},
+		{"TS.ADD->cpu->71500->7", "71500"},
+		{"TS.RANGE->cpu->-->+", "2\r\n12000->1.5\r\n71500->7"},
+		{"TS.RANGE->missing->-->+", "0"},
+		{"TYPE->cpu", "timeseries"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	for _, query := range []string{"TS.ADD->cpu->100", "TS.ADD->cpu->abc->1", "TS.ADD->cpu->80000->abc", "TS.ADD->cpu->1000->1", "TS.RANGE->cpu->-->+->median->1000", "TS.RANGE->cpu->-->+->avg->0", "TS.CREATE->cpu->-1"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("TS.ADD->cpu->*->1")); err != nil {
+		t.Errorf("Expected the current time to be accepted, got %v", err)
+	}
+}
+
+func TestDatabase_QuotedArguments(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{`PUT->"a->b"->'  spaced value  '`, "PUT SUCCESS"},
+		{`GET->'a->b'`, "  spaced value  "},
+		{`PUT->x'00ff'->"line\r\nbreak"`, "PUT SUCCESS"},
+		{`GET->b64'AP8='`, "line\r\nbreak"},
+		{`PUT->plain->He said "hi"`, "PUT SUCCESS"},
+		{`get -> plain`, `He said "hi"`},
+		{`PUT->it's->rock 'n' roll`, "PUT SUCCESS"},
+		{`GET->it's`, "rock 'n' roll"},
+		{`HSET->h->f->v`, "1"},
+		{`HGETALL->h`, "1\r\nf->v"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	for query, expected := range map[string]string{
+		`PUT->key->"bad \q"`:      `syntax error at position 16: unknown escape \q`,
+		`PUT->key->"unterminated`: "syntax error at position 11: unterminated literal",
+		`PUT->key->'unterminated`: "syntax error at position 11: unterminated literal",
+		`PUT->key->x'zz'`:         "syntax error at position 13: bad hex digit 'z'",
+		`PUT->key->b64'!!'`:       "syntax error at position 15: bad base64 literal",
+	} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil || err.Error() != expected {
+			t.Errorf("Expected %q for %s, got %v", expected, query, err)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("GET->key")); !errors.Is(err, datastructure.ErrKeyNotFound) {
+		t.Errorf("Expected nothing to be stored by a malformed query, got %v", err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("GETX->key")); err == nil || err.Error() != "nonexistent command" {
+		t.Errorf("Expected nonexistent command, got %v", err)
+	}
+}
+
+func TestDatabase_JSON(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{`JSON.SET->user->$->{"name": "alex", "note": "a->b", "tags": ["x"]}`, "JSON.SET SUCCESS"},
+		{`JSON.SET->user->$.age->30`, "JSON.SET SUCCESS"},
+		{`JSON.SET->user->$.tags[0]->'"y"'`, "JSON.SET SUCCESS"},
+		{"JSON.GET->user->$.note", `"a->b"`},
+		{"JSON.GET->user->$.tags", `["y"]`},
+		{"JSON.GET->user", `{"age":30,"name":"alex","note":"a->b","tags":["y"]}`},
+		{"GET->user", `{"age":30,"name":"alex","note":"a->b","tags":["y"]}`},
+		{"JSON.DEL->user->$.note", "1"},
+		{"JSON.DEL->user->$.note", "0"},
+		{"JSON.GET->user", `{"age":30,"name":"alex","tags":["y"]}`},
+		{"JSON.DEL->user", "1"},
+		{"TYPE->user", "none"},
+		{`JSON.SET->k->$->'{"a":1}'`, "JSON.SET SUCCESS"},
+		{`JSON.SET->k->$.a->x'3132'`, "JSON.SET SUCCESS"},
+		{`JSON.SET->k->$.b->"{\"c\": \"d->e\"}"`, "JSON.SET SUCCESS"},
+		{"JSON.GET->k", `{"a":12,"b":{"c":"d->e"}}`},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("JSON.SET->doc->$->{bad")); !errors.Is(err, datastructure.ErrNotJSON) {
+		t.Errorf("Expected ErrNotJSON, got %v", err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("JSON.SET->doc->$")); err == nil {
+		t.Errorf("Expected an error for a missing value")
+	}
+
+	// Only a bare value runs on past a ->
+	if _, err := database.ExecuteCommand([]byte(`JSON.SET->doc->$->'{"a":1}'->x`)); err == nil {
+		t.Errorf("Expected an error for text after a literal value")
+	}
+}
+
+func TestDatabase_SecondaryIndexes(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{`PUT->user1->{"name": "alex", "city": "Toronto"}`, "PUT SUCCESS"},
+		{"CREATE INDEX by_city ON $.city", "CREATE INDEX SUCCESS"},
+		{`JSON.SET->user2->$->{"name": "bob", "city": "Toronto"}`, "JSON.SET SUCCESS"},
+		{`MSET->user3->{"city": "Paris"}->user4->{"city": "Toronto"}`, "MSET SUCCESS"},
+		{"FIND->by_city->Toronto", "3\r\nuser1\r\nuser2\r\nuser4"},
+		{"DEL->user1", "DEL SUCCESS"},
+		{"FIND->by_city->Toronto", "2\r\nuser2\r\nuser4"},
+		{"FIND->by_city->Berlin", "0"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("CREATE INDEX by_city ON $.city")); !errors.Is(err, datastructure.ErrIndexExists) {
+		t.Errorf("Expected ErrIndexExists, got %v", err)
+	}
+
+	if _, err := database.ExecuteCommand([]byte("FIND->missing->x")); !errors.Is(err, datastructure.ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+
+	for _, query := range []string{"CREATE INDEX by_name", "CREATE INDEX by_name AT $.name", "FIND->by_city"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+}
+
+func TestDatabase_Search(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"FTCREATE->products->product:", "FTCREATE SUCCESS"},
+		{"PUT->product:1->Red wireless mouse", "PUT SUCCESS"},
+		{"PUT->product:2->Blue wired mouse", "PUT SUCCESS"},
+		{"PUT->note:1->Wireless mouse", "PUT SUCCESS"},
+		{"PUT->product:3->Mouse, wireless", "PUT SUCCESS"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	for query, expected := range map[string][]string{
+		"FTSEARCH->products->mouse":                     {"product:3", "product:1", "product:2"},
+		"FTSEARCH->products->mouse->1":                  {"product:3"},
+		"FTSEARCH->products->wireless mouse":            {"product:3", "product:1"},
+		`FTSEARCH->products->"wireless mouse"`:          {"product:1"},
+		`FTSEARCH->products->"wireless mouse"->10`:      {"product:1"},
+		`FTSEARCH->products->"wireless mouse" OR wired`: {"product:2", "product:1"},
+		"FTSEARCH->products->red AND wired":             {},
+	} {
+		result, err := database.ExecuteCommand([]byte(query))
+		if err != nil {
+			t.Errorf("Error executing %s: %v", query, err)
+			continue
+		}
+
+		lines := strings.Split(string(result.([]byte)), "\r\n")
+		if lines[0] != strconv.Itoa(len(expected)) {
+			t.Errorf("Expected %d results for %s, got %q", len(expected), query, result)
+			continue
+		}
+
+		for i, key := range expected {
+			if !strings.HasPrefix(lines[i+1], key+"->") {
+				t.Errorf("Expected %s at %d for %s, got %q", key, i, query, lines[i+1])
+			}
+		}
+	}
+
+	for _, query := range []string{"FTSEARCH->products", "FTSEARCH->products->(mouse", "FTSEARCH->products->mouse->0", "FTCREATE->a->b->c"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("FTSEARCH->missing->mouse")); !errors.Is(err, datastructure.ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+}
+
+func TestDatabase_VectorSearch(t *testing.T) {
+	tempDir := t.TempDir()
+
+	db, err := datastructure.OpenDB(tempDir+"/chromo.db", tempDir+"/chromo.idx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	database := &Database{
+		DataStructure: db,
+	}
+
+	for _, step := range [][2]string{
+		{"PUT->home->1 Main St", "PUT SUCCESS"},
+		{"PUT->work->2 High St", "PUT SUCCESS"},
+		{"PUT->gym->3 Park Rd", "PUT SUCCESS"},
+		{"PUT->cafe->4 Mill Ln", "PUT SUCCESS"},
+		{"VCREATE->places->l2", "VCREATE SUCCESS"},
+		{"VADD->places->home->0,0", "VADD SUCCESS"},
+		{"VADD->places->work->[3, 4]", "VADD SUCCESS"},
+		{"VADD->places->gym->1,1", "VADD SUCCESS"},
+		{"VADD->places->cafe->0,1", "VADD SUCCESS"},
+		{"VSEARCH->places->[0, 0]->2", "2\r\nhome->0.000000\r\ncafe->1.000000"},
+		{"VDEL->places->cafe", "1"},
+		{"VDEL->places->cafe", "0"},
+		{"VSEARCH->places->[0, 0]->2", "2\r\nhome->0.000000\r\ngym->1.414214"},
+		{"DEL->home", "DEL SUCCESS"},
+		{"VSEARCH->places->[0, 0]->1", "1\r\ngym->1.414214"},
+		{"VSEARCH->places->3,4->1", "1\r\nwork->0.000000"},
+	} {
+		result, err := database.ExecuteCommand([]byte(step[0]))
+		if err != nil || string(result.([]byte)) != step[1] {
+			t.Errorf("Expected %q for %s, got %q %v", step[1], step[0], result, err)
+		}
+	}
+
+	for _, query := range []string{"VCREATE->other->manhattan", "VADD->places->a->1,x", "VADD->places->a->1,2,3", "VSEARCH->places->1,1->0", "VSEARCH->places->1,1"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err == nil {
+			t.Errorf("Expected an error for %s", query)
+		}
+	}
+
+	if _, err := database.ExecuteCommand([]byte("VADD->missing->a->1,2")); !errors.Is(err, datastructure.ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound, got %v", err)
+	}
+	if _, err := database.ExecuteCommand([]byte("VADD->places->nowhere->1,2")); !errors.Is(err, datastructure.ErrKeyNotFound) {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Disk usage counts the vector log and the index files along with the data files
+	var size int64
+	for _, name := range []string{"chromo.db", "chromo.idx", "chromo.wal", "chromo.vec"} {
+		info, err := os.Stat(tempDir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+
+	if result, err := database.ExecuteCommand([]byte("DISK")); err != nil || string(result.([]byte)) != fmt.Sprintf("DISK USAGE: %d bytes", size) {
+		t.Errorf("Expected %d bytes, got %q %v", size, result, err)
+	}
+
+	for _, query := range []string{"CREATE INDEX by_city ON $.city", "FTCREATE->docs->doc:"} {
+		if _, err := database.ExecuteCommand([]byte(query)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"chromo.sidx", "chromo.sidc", "chromo.ftx", "chromo.ftc"} {
+		info, err := os.Stat(tempDir + "/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+
+	if result, err := database.ExecuteCommand([]byte("DISK")); err != nil || string(result.([]byte)) != fmt.Sprintf("DISK USAGE: %d bytes", size) {
+		t.Errorf("Expected %d bytes with the index files, got %q %v", size, result, err)
+	}
+
+	if result, err := database.ExecuteCommand([]byte("VDROP->places")); err != nil || string(result.([]byte)) != "VDROP SUCCESS" {
+		t.Errorf("Expected VDROP SUCCESS, got %q %v", result, err)
+	}
+	if _, err := database.ExecuteCommand([]byte("VSEARCH->places->0,0->1")); !errors.Is(err, datastructure.ErrIndexNotFound) {
+		t.Errorf("Expected ErrIndexNotFound after VDROP, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+* ChromoDB
+* ******************************************************************
+* Originally authored by Alex Gaetano Padula
+* Copyright (C) ChromoDB
+*
+* This program is free software: you can redistribute it and/or modify
+* it under the terms of the GNU General Public License as published by
+* the Free Software Foundation, either version 3 of the License, or
+* (at your option) any later version.
+*
+* This program is distributed in the hope that it will be useful,
+* but WITHOUT ANY WARRANTY; without even the implied warranty of
+* MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+* GNU General Public License for more details.
+*
+* You should have received a copy of the GNU General Public License
+* along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+package system
+
+import (
+	"chromodb/datastructure"
+	"errors"
+	"time"
+)
+
+// ErrNoSession is returned for transaction commands issued without a session
+var ErrNoSession = errors.New("transactions require a session")
+
+// Session is the state of a single client, one per network connection or shell
+type Session struct {
+	Tx      *Transaction      // Open transaction, nil outside of BEGIN and COMMIT/ROLLBACK
+	db      *Database         // Database the session runs against
+	watches map[string]uint64 // Versions of the watched keys when WATCH was issued
+}
+
+// Transaction buffers the writes of a session between BEGIN and COMMIT.
+// Reads see the database as of BEGIN plus the transaction's own writes
+type Transaction struct {
+	batch    *datastructure.Batch
+	writes   map[string]pendingWrite // Latest buffered write per key so reads see the transaction's own writes
+	snapshot *datastructure.Snapshot // Point-in-time view taken at BEGIN
+}
+
+// pendingWrite is a buffered write of a transaction
+type pendingWrite struct {
+	value     []byte
+	deleted   bool
+	expiresAt time.Time // Zero if the key never expires
+}
+
+// NewSession creates a session
+func (db *Database) NewSession() *Session {
+	return &Session{db: db}
+}
+
+// Begin starts a transaction on the session
+func (s *Session) Begin() error {
+	if s.Tx != nil {
+		return errors.New("transaction already started")
+	}
+
+	s.Tx = &Transaction{
+		batch:    datastructure.NewBatch(),
+		writes:   make(map[string]pendingWrite),
+		snapshot: s.db.DataStructure.Snapshot(),
+	}
+
+	return nil
+}
+
+// Rollback discards the open transaction of the session, if any, and forgets the watched keys
+func (s *Session) Rollback() {
+	if s.Tx != nil {
+		s.Tx.snapshot.Release()
+	}
+
+	s.Tx = nil
+	s.watches = nil
+}
+
+// Watch remembers the current version of keys.  The next COMMIT fails if any of them changed in the meantime
+func (db *Database) Watch(s *Session, keys ...[]byte) error {
+	if s.Tx != nil {
+		return errors.New("WATCH inside a transaction is not allowed")
+	}
+
+	if s.watches == nil {
+		s.watches = make(map[string]uint64)
+	}
+
+	for _, key := range keys {
+		s.watches[string(key)] = db.DataStructure.Version(key)
+	}
+
+	return nil
+}
+
+// Unwatch forgets the watched keys of the session
+func (s *Session) Unwatch() {
+	s.watches = nil
+}
+
+// put buffers a put in the transaction, a zero expiresAt means the key never expires
+func (tx *Transaction) put(key, value []byte, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		tx.batch.Put(key, value)
+	} else {
+		tx.batch.PutWithExpiry(key, value, expiresAt)
+	}
+
+	tx.writes[string(key)] = pendingWrite{value: value, expiresAt: expiresAt}
+}
+
+// compareAndSwap buffers a put in the transaction that only applies if key is at the expected version
+func (tx *Transaction) compareAndSwap(key []byte, expected uint64, value []byte) {
+	tx.batch.Expect(key, expected)
+	tx.put(key, value, time.Time{})
+}
+
+// delete buffers a delete in the transaction
+func (tx *Transaction) delete(key []byte) {
+	tx.batch.Delete(key)
+	tx.writes[string(key)] = pendingWrite{deleted: true}
+}
+
+// get returns the value buffered for key, or the value as of BEGIN if the transaction did not write to key
+func (tx *Transaction) get(key []byte) ([]byte, error) {
+	write, ok := tx.writes[string(key)]
+	if !ok {
+		return tx.snapshot.Get(key)
+	}
+
+	if write.deleted || (!write.expiresAt.IsZero() && !write.expiresAt.After(time.Now())) {
+		return nil, datastructure.ErrKeyNotFound
+	}
+
+	return write.value, nil
+}
+
+// Commit applies the buffered writes of the session's transaction atomically and ends the transaction.
+// Nothing is applied and datastructure.ErrConflict is returned if a watched key changed since WATCH
+func (db *Database) Commit(s *Session) error {
+	if s.Tx == nil {
+		return errors.New("no transaction started")
+	}
+
+	tx := s.Tx
+	watches := s.watches
+	s.Rollback()
+
+	for key, version := range watches {
+		tx.batch.Expect([]byte(key), version)
+	}
+
+	// WriteBatch applies the whole batch under the data structure's write lock
+	return db.DataStructure.WriteBatch(tx.batch)
+}